@@ -1,29 +1,186 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"log/slog"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 
 	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/api"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/controller"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/install"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/scheduler"
 	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/tracing"
 )
 
+// flushTraces exports any spans not yet sent. os.Exit skips deferred calls, so exit calls it instead.
+var flushTraces = func() {}
+
+func exit(code int) {
+	flushTraces()
+	os.Exit(code)
+}
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "render-install" {
+		renderInstall()
+		return
+	}
+
+	start := time.Now()
+
+	// The run report is written for these early failures too, so every exit of a one-shot launcher has one
 	conf, err := config.NewConfig()
 	if err != nil {
 		slog.Error("creating config", "error", err.Error())
+		service.WriteReport(conf, service.NewReport(conf, start, service.Result{}, fmt.Errorf("creating config: %w", err)))
+		os.Exit(1)
+	}
+
+	flushTraces, err = tracing.Setup(conf)
+	if err != nil {
+		slog.Error("setting up tracing", "error", err.Error())
+		service.WriteReport(conf, service.NewReport(conf, start, service.Result{}, fmt.Errorf("setting up tracing: %w", err)))
 		os.Exit(1)
 	}
+	defer flushTraces()
+
+	if conf.LauncherMode == "controller" {
+		runController(conf)
+		return
+	}
+
+	if conf.LauncherMode == "scheduler" {
+		runScheduler(conf)
+		return
+	}
+
+	if conf.LauncherMode == "server" {
+		runServer(conf)
+		return
+	}
 
 	s, err := service.NewService(conf)
 	if err != nil {
 		slog.Error("creating service", "error", err.Error())
-		os.Exit(2)
+		service.WriteReport(conf, service.NewReport(conf, start, service.Result{}, fmt.Errorf("creating service: %w", err)))
+		exit(2)
+	}
+
+	if err = s.CheckPermissions(); err != nil {
+		slog.Error("checking RBAC permissions", "error", err.Error())
+		service.WriteReport(conf, service.NewReport(conf, start, service.Result{}, fmt.Errorf("checking RBAC permissions: %w", err)))
+		exit(3)
 	}
 
 	err = s.Run()
+	if errors.Is(err, service.ErrSkipped) {
+		// Logged by the service. A distinct code so a skipped run isn't mistaken for a failed one
+		exit(5)
+	}
+	if errors.Is(err, service.ErrVerificationFailed) {
+		slog.Error("verifying the backup", "error", err.Error())
+		exit(4)
+	}
 	if err != nil {
 		slog.Error("running the service", "error", err.Error())
+		exit(3)
+	}
+}
+
+func runController(conf config.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	c, err := controller.NewController(conf)
+	if err != nil {
+		slog.Error("creating controller", "error", err.Error())
+		exit(2)
+	}
+
+	err = c.Run(ctx)
+	if err != nil {
+		slog.Error("running the controller", "error", err.Error())
+		exit(3)
+	}
+}
+
+func runScheduler(conf config.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := scheduler.NewScheduler(conf)
+	if err != nil {
+		slog.Error("creating scheduler", "error", err.Error())
+		exit(2)
+	}
+
+	if err = checkPermissions(conf); err != nil {
+		slog.Error("checking RBAC permissions", "error", err.Error())
+		exit(3)
+	}
+
+	err = s.Run(ctx)
+	if err != nil {
+		slog.Error("running the scheduler", "error", err.Error())
+		exit(3)
+	}
+}
+
+func runServer(conf config.Config) {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	s, err := api.NewServer(conf)
+	if err != nil {
+		slog.Error("creating API server", "error", err.Error())
+		exit(2)
+	}
+
+	// API triggered runs never verify
+	checkConf := conf
+	checkConf.VerifyBackups = false
+	if err = checkPermissions(checkConf); err != nil {
+		slog.Error("checking RBAC permissions", "error", err.Error())
+		exit(3)
+	}
+
+	err = s.Run(ctx)
+	if err != nil {
+		slog.Error("running the API server", "error", err.Error())
+		exit(3)
+	}
+}
+
+// checkPermissions runs the RBAC self-check once at startup for the long-running modes, which launch backups with this
+// process's configuration. The controller isn't checked as each schedule's backups go to the schedule's own namespace.
+func checkPermissions(conf config.Config) error {
+	conf.LauncherMode = "backup"
+
+	s, err := service.NewService(conf)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+
+	return s.CheckPermissions()
+}
+
+// renderInstall prints the manifests for running the launcher with the current configuration, without connecting to MongoDB or K8s.
+func renderInstall() {
+	conf, err := config.LoadInstallConfig()
+	if err != nil {
+		slog.Error("creating config", "error", err.Error())
+		os.Exit(1)
+	}
+
+	if err = install.Render(conf, os.Stdout); err != nil {
+		slog.Error("rendering install manifests", "error", err.Error())
 		os.Exit(3)
 	}
 }
@@ -3,13 +3,19 @@ package config
 import (
 	"context"
 	"fmt"
+	"io"
 	"log/slog"
 	"os"
+	"path"
 	"path/filepath"
+	"strconv"
 	"strings"
+	"time"
 
+	"github.com/robfig/cron/v3"
 	"go.mongodb.org/mongo-driver/v2/mongo"
 	"go.mongodb.org/mongo-driver/v2/mongo/options"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -24,14 +30,125 @@ type MongoDBClient interface {
 	RunCommand(ctx context.Context, runCommand interface{}) SingleResult
 }
 
+// MongoDBMemberClient is a client connected directly to a single replica set member rather than the replica set as a whole.
+type MongoDBMemberClient interface {
+	MongoDBClient
+	Database(name string) MongoDBClient
+	Disconnect(ctx context.Context) error
+}
+
+type MongoDBMemberConnector interface {
+	ConnectToMember(ctx context.Context, host string) (MongoDBMemberClient, error)
+}
+
+// BackupSchedule is a cron expression for one backup type, evaluated by the built-in scheduler.
+type BackupSchedule struct {
+	BackupType string
+	Cron       string
+}
+
+// BlackoutWindow is a period when backups are not launched. It is either every firing of a cron schedule for a duration, or
+// a fixed time range from Start to End.
+type BlackoutWindow struct {
+	Spec     string
+	Schedule cron.Schedule
+	Duration time.Duration
+	Start    time.Time
+	End      time.Time
+}
+
+// ZoneMapping places members matching Pattern in AZ. Patterns are either an exact host or a glob as in path.Match, e.g.
+// '*.eu-west-1a.compute.internal'. Source is where the mapping came from, for logging which one answered.
+type ZoneMapping struct {
+	Pattern string
+	AZ      string
+	Source  string
+}
+
+// LoadThresholds are the serverStatus levels above which a secondary is considered too busy to back up from. 0 means no limit.
+type LoadThresholds struct {
+	OpsPerSec         float64
+	ActiveConnections float64
+	CacheDirtyRatio   float64
+	CacheUsedRatio    float64
+	Queued            float64
+}
+
 type Config struct {
-	MongoDBClient  MongoDBClient
-	K8sClient      kubernetes.Interface
-	ExcludeReplica string
-	LogLevel       string
-	DockerImageURI string
-	BackupType     string
-	Hostname       string
+	MongoDBClient            MongoDBClient
+	MongoDBMemberConnector   MongoDBMemberConnector
+	MongoDBSeedHosts         []string
+	K8sClient                kubernetes.Interface
+	K8sDynamicClient         dynamic.Interface
+	ExcludeReplica           string
+	LogLevel                 string
+	DockerImageURI           string
+	LauncherMode             string
+	BackupType               string
+	BackupMode               string
+	SnapshotClass            string
+	SnapshotVolume           string
+	SnapshotReadyTimeout     time.Duration
+	VerifyBackups            bool
+	VerifyImageURI           string
+	JobWaitTimeout           time.Duration
+	VerifyJobTimeout         time.Duration
+	RestoreBackupID          string
+	RestoreConfirmed         bool
+	ProtectedNamespaces      []string
+	ControllerNamespace      string
+	ControllerResyncInterval time.Duration
+	Schedules                []BackupSchedule
+	ScheduleLocation         *time.Location
+	CatchUpPolicy            string
+	StartingDeadline         time.Duration
+	SchedulerTick            time.Duration
+	LeaseName                string
+	SchedulerStateConfigMap  string
+	HealthAddr               string
+	PodNamespace             string
+	PodName                  string
+	JobProvenance            bool
+	JobOwnerCascade          bool
+	NodePool                 string
+	NodePoolPreflight        bool
+	UnschedulableTimeout     time.Duration
+	ProtectSourcePod         bool
+	ProtectSourceNode        bool
+	MemberFreezeDuration     time.Duration
+	ZonePodAnnotation        string
+	ZoneMap                  []ZoneMapping
+	ZoneMapConfigMap         string
+	ZoneResolvers            []string
+	ZoneDNSTXTName           string
+	RBACSelfCheck            bool
+	LaunchEvents             bool
+	OTLPEndpoint             string
+	ReportFile               string
+	TerminationLogPath       string
+	BlackoutWindows          []BlackoutWindow
+	BlackoutLocation         *time.Location
+	PauseAnnotation          string
+	PauseConfigMap           string
+	FreshnessWindow          time.Duration
+	LoadAware                bool
+	LoadThresholds           LoadThresholds
+	LoadSampleInterval       time.Duration
+	LoadDeferTimeout         time.Duration
+	LoadDeferInterval        time.Duration
+	InstallNamespace         string
+	InstallLauncherImage     string
+	InstallSchedule          string
+	InstallSecrets           bool
+	MemberOverride           string
+	APIAddr                  string
+	APIAuth                  string
+	APIToken                 string
+	APIAllowedGroups         []string
+	APIAudiences             []string
+	APIRunHistory            int
+	APIMaxConcurrentRuns     int
+	Hostname                 string
 }
 
 // realMongoClient wraps the MongoDB Database struct to work around the fact that mongo.SingleResult has no exported fields we can mock.
@@ -43,8 +160,98 @@ func (r *realMongoClient) RunCommand(ctx context.Context, runCommand interface{}
 	return r.db.RunCommand(ctx, runCommand)
 }
 
+// Ping connects to the replica set, which the driver otherwise does lazily on the first command.
+func (r *realMongoClient) Ping(ctx context.Context) error {
+	return r.db.Client().Ping(ctx, nil)
+}
+
+// Disconnect closes the replica set connection pool, for long-running modes which replace their clients.
+func (r *realMongoClient) Disconnect(ctx context.Context) error {
+	return r.db.Client().Disconnect(ctx)
+}
+
+type realMongoMemberClient struct {
+	realMongoClient
+	client *mongo.Client
+}
+
+func (r *realMongoMemberClient) Database(name string) MongoDBClient {
+	return &realMongoClient{db: r.client.Database(name)}
+}
+
+func (r *realMongoMemberClient) Disconnect(ctx context.Context) error {
+	return r.client.Disconnect(ctx)
+}
+
+// realMongoMemberConnector reuses the replica set connection settings, but connects directly to a single host.
+type realMongoMemberConnector struct {
+	uri        string
+	credential options.Credential
+}
+
+func (r *realMongoMemberConnector) ConnectToMember(_ context.Context, host string) (MongoDBMemberClient, error) {
+	clientOpts := options.Client().ApplyURI(r.uri).SetAuth(r.credential).SetHosts([]string{host}).SetDirect(true)
+
+	client, err := mongo.Connect(clientOpts)
+	if err != nil {
+		return nil, fmt.Errorf("creating MongoDB client for member %s: %w", host, err)
+	}
+
+	return &realMongoMemberClient{
+		realMongoClient: realMongoClient{db: client.Database("admin")},
+		client:          client,
+	}, nil
+}
+
+// NewConfig reads the configuration from the environment and creates the MongoDB and K8s clients.
 func NewConfig() (Config, error) {
+	conf, err := LoadConfig()
+	if err != nil {
+		return conf, err
+	}
+
+	// MongoDB Client. The controller connects per schedule, using the schedule's connection Secret
+	if conf.LauncherMode != "controller" {
+		conf.MongoDBClient, conf.MongoDBMemberConnector, err = mongoDBClient()
+		if err != nil {
+			return conf, fmt.Errorf("creating MongoDB client: %w", err)
+		}
+
+		// The hosts in MONGODB_URI, which tell the RBAC self-check which namespaces MongoDB runs in
+		conf.MongoDBSeedHosts = seedHosts(os.Getenv("MONGODB_URI"))
+	}
+
+	// K8s Client
+	restConfig, err := k8sRestConfig()
+	if err != nil {
+		return conf, fmt.Errorf("creating K8s client config: %w", err)
+	}
+
+	k8sc, err := kubernetes.NewForConfig(restConfig)
+	if err != nil {
+		return conf, fmt.Errorf("creating K8s client: %w", err)
+	}
+	conf.K8sClient = k8sc
+
+	// K8s dynamic client, used for custom resources such as VolumeSnapshots
+	k8sDynamic, err := dynamic.NewForConfig(restConfig)
+	if err != nil {
+		return conf, fmt.Errorf("creating K8s dynamic client: %w", err)
+	}
+	conf.K8sDynamicClient = k8sDynamic
+
+	return conf, nil
+}
+
+// LoadConfig reads and validates the configuration from the environment, without connecting to MongoDB or K8s.
+func LoadConfig() (Config, error) {
+	return loadConfigLoggingTo(os.Stdout)
+}
+
+// loadConfigLoggingTo is LoadConfig with the logs written to logOutput.
+func loadConfigLoggingTo(logOutput io.Writer) (Config, error) {
 	conf := Config{}
+	var err error
 
 	// Logger
 	logLevelStr := strings.ToLower(os.Getenv("LOG_LEVEL"))
@@ -64,29 +271,237 @@ func NewConfig() (Config, error) {
 		level = slog.LevelInfo
 	}
 
-	handler := slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
+	handler := slog.NewTextHandler(logOutput, &slog.HandlerOptions{
 		Level: level,
 	})
 
 	slog.SetDefault(slog.New(handler))
 
+	// Where to write the JSON run report. Read first, so a report can still be written if the rest of the config is invalid
+	conf.ReportFile = os.Getenv("RUN_REPORT_FILE")
+	conf.TerminationLogPath = "/dev/termination-log"
+	if v, found := os.LookupEnv("TERMINATION_LOG_PATH"); found {
+		conf.TerminationLogPath = v
+	}
+
 	// A MongoDB replica which you do NOT want to use as a target. It might have another special role, and you don't want to add performance overhead
 	conf.ExcludeReplica = os.Getenv("EXCLUDE_REPLICA")
 
-	// Docker image to use when creating new K8s backup jobs
+	// Whether to launch a backup, a restore, or run as a controller reconciling MongoDBBackupSchedule resources
+	launcherMode := os.Getenv("LAUNCHER_MODE")
+	switch launcherMode {
+	case "":
+		conf.LauncherMode = "backup"
+	case "backup", "restore", "controller", "scheduler", "server":
+		conf.LauncherMode = launcherMode
+	default:
+		return conf, fmt.Errorf("LAUNCHER_MODE must be 'backup', 'restore', 'controller', 'scheduler' or 'server'")
+	}
+
+	if conf.LauncherMode == "restore" {
+		if err := restoreConfig(&conf); err != nil {
+			return conf, err
+		}
+	}
+
+	if conf.LauncherMode == "controller" {
+		if err := controllerConfig(&conf); err != nil {
+			return conf, err
+		}
+	}
+
+	if conf.LauncherMode == "scheduler" {
+		if err := schedulerConfig(&conf); err != nil {
+			return conf, err
+		}
+	}
+
+	if conf.LauncherMode == "server" {
+		if err := serverConfig(&conf); err != nil {
+			return conf, err
+		}
+	}
+
+	// Docker image to use when creating new K8s backup jobs. In controller mode it is the default for schedules which do not set one
 	dockerImageURI := os.Getenv("DOCKER_IMAGE_URI")
-	if dockerImageURI == "" {
+	if dockerImageURI == "" && conf.LauncherMode != "controller" {
 		return conf, fmt.Errorf("docker image URI - DOCKER_IMAGE_URI - has not been set")
 	}
 	conf.DockerImageURI = dockerImageURI
 
 	// What type of backup to trigger
 	backupType := os.Getenv("BACKUP_TYPE")
-	if backupType != "hourly" && backupType != "daily" {
+	if conf.LauncherMode == "backup" && backupType != "hourly" && backupType != "daily" {
 		return conf, fmt.Errorf("BACKUP_TYPE must be 'hourly' or 'daily'")
 	}
+	if conf.LauncherMode == "server" && backupType == "" {
+		// The default for API triggered backups which do not ask for a type
+		backupType = "daily"
+	}
 	conf.BackupType = backupType
 
+	// How to take the backup. 'dump' launches a mongodump Job, 'snapshot' takes a CSI VolumeSnapshot of the member's PVC
+	backupMode := os.Getenv("BACKUP_MODE")
+	switch backupMode {
+	case "":
+		conf.BackupMode = "dump"
+	case "dump", "snapshot":
+		conf.BackupMode = backupMode
+	default:
+		return conf, fmt.Errorf("BACKUP_MODE must be 'dump' or 'snapshot'")
+	}
+
+	// Snapshot mode settings. The class and volume are optional; the cluster default class and the pod's only PVC are used if unset
+	conf.SnapshotClass = os.Getenv("SNAPSHOT_CLASS")
+	conf.SnapshotVolume = os.Getenv("SNAPSHOT_VOLUME")
+	conf.SnapshotReadyTimeout, err = durationFromEnv("SNAPSHOT_READY_TIMEOUT", 10*time.Minute)
+	if err != nil {
+		return conf, err
+	}
+
+	// Whether to wait for the backup Job and then launch a Job which restores it into an ephemeral mongod and compares it against the source
+	conf.VerifyBackups = os.Getenv("VERIFY_BACKUPS") == "true"
+	if conf.VerifyBackups && conf.BackupMode != "dump" {
+		return conf, fmt.Errorf("VERIFY_BACKUPS is only supported when BACKUP_MODE is 'dump'")
+	}
+
+	// Docker image to use for verification Jobs. Defaults to the backup image
+	conf.VerifyImageURI = os.Getenv("VERIFY_IMAGE_URI")
+	if conf.VerifyImageURI == "" {
+		conf.VerifyImageURI = conf.DockerImageURI
+	}
+
+	// How long to wait for a backup Job to finish, and for a verification Job to finish
+	conf.JobWaitTimeout, err = durationFromEnv("JOB_WAIT_TIMEOUT", 4*time.Hour)
+	if err != nil {
+		return conf, err
+	}
+	conf.VerifyJobTimeout, err = durationFromEnv("VERIFY_JOB_TIMEOUT", 2*time.Hour)
+	if err != nil {
+		return conf, err
+	}
+
+	// Karpenter NodePool the created Jobs are scheduled onto
+	conf.NodePool = os.Getenv("NODEPOOL_NAME")
+	if conf.NodePool == "" {
+		conf.NodePool = "backups"
+	}
+
+	// Whether to check the NodePool exists, has capacity, carries the backups taint and allows the target AZ before creating a Job.
+	// Off by default, as it needs cluster-wide read access to NodePools which many installs don't grant
+	conf.NodePoolPreflight = os.Getenv("NODEPOOL_PREFLIGHT") == "true"
+
+	// How long the backup pod may stay unschedulable before the Job is moved to a secondary in another AZ. Disabled when 0
+	conf.UnschedulableTimeout, err = durationFromEnv("UNSCHEDULABLE_TIMEOUT", 0)
+	if err != nil {
+		return conf, err
+	}
+
+	// Whether to stop Karpenter disrupting the MongoDB pod (and optionally its node) being backed up until the backup Job finishes
+	conf.ProtectSourcePod = os.Getenv("PROTECT_SOURCE_POD") == "true"
+	conf.ProtectSourceNode = os.Getenv("PROTECT_SOURCE_NODE") == "true"
+	if conf.ProtectSourceNode && !conf.ProtectSourcePod {
+		return conf, fmt.Errorf("PROTECT_SOURCE_NODE requires PROTECT_SOURCE_POD=true")
+	}
+
+	// How long a backup is expected to take. When set, the target member is frozen with replSetFreeze for this long, renewed until the backup Job finishes
+	conf.MemberFreezeDuration, err = durationFromEnv("MEMBER_FREEZE_DURATION", 0)
+	if err != nil {
+		return conf, err
+	}
+	if conf.MemberFreezeDuration != 0 && conf.MemberFreezeDuration < 2*time.Second {
+		return conf, fmt.Errorf("MEMBER_FREEZE_DURATION must be at least 2s")
+	}
+
+	// Annotation on the MongoDB pods holding their AZ, e.g. written by an init container. Used when the launcher cannot read nodes
+	conf.ZonePodAnnotation = os.Getenv("ZONE_POD_ANNOTATION")
+	if conf.ZonePodAnnotation == "" {
+		conf.ZonePodAnnotation = "mongodb-backups/zone"
+	}
+
+	// Whether to check every permission the enabled features need with SelfSubjectAccessReviews, before doing any work against the members
+	conf.RBACSelfCheck = os.Getenv("RBAC_SELF_CHECK") != "false"
+
+	// Whether to record K8s Events describing each launch decision on the launcher's Pod and the Job it creates
+	conf.LaunchEvents = os.Getenv("LAUNCH_EVENTS") != "false"
+
+	// OTLP/HTTP endpoint to export traces to (e.g. http://otel-collector:4318). Tracing is off when unset
+	conf.OTLPEndpoint = os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT")
+
+	// Static member to AZ map, in the form <host>=<az>,<host>=<az>. The last resort when no other zone source answers
+	conf.ZoneMap, err = ParseZoneMap("ZONE_MAP", os.Getenv("ZONE_MAP"))
+	if err != nil {
+		return conf, err
+	}
+
+	// File holding more static zone mappings, one <host>=<az> per line
+	if file := os.Getenv("ZONE_MAP_FILE"); file != "" {
+		data, err := os.ReadFile(file)
+		if err != nil {
+			return conf, fmt.Errorf("reading ZONE_MAP_FILE: %w", err)
+		}
+		fileZones, err := ParseZoneMap("ZONE_MAP_FILE", string(data))
+		if err != nil {
+			return conf, err
+		}
+		conf.ZoneMap = append(conf.ZoneMap, fileZones...)
+	}
+
+	// ConfigMap in the launcher's namespace holding more static zone mappings under its 'zones' key. Read at launch time
+	conf.ZoneMapConfigMap = os.Getenv("ZONE_MAP_CONFIGMAP")
+
+	// Order to try the zone resolvers in, e.g. 'node-label,static-map,dns-txt'. Defaults to every resolver but dns-txt
+	for _, name := range strings.Split(os.Getenv("ZONE_RESOLVERS"), ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			conf.ZoneResolvers = append(conf.ZoneResolvers, name)
+		}
+	}
+
+	// DNS name of the TXT record holding a member's AZ for the dns-txt resolver. {host} is replaced with the member's hostname
+	conf.ZoneDNSTXTName = os.Getenv("ZONE_DNS_TXT_NAME")
+	if conf.ZoneDNSTXTName == "" {
+		conf.ZoneDNSTXTName = "_zone.{host}"
+	}
+
+	// Timezone the blackout windows are evaluated in
+	tz := os.Getenv("BLACKOUT_TIMEZONE")
+	if tz == "" {
+		tz = "UTC"
+	}
+	conf.BlackoutLocation, err = time.LoadLocation(tz)
+	if err != nil {
+		return conf, fmt.Errorf("loading BLACKOUT_TIMEZONE: %w", err)
+	}
+
+	// Semicolon separated periods when backups are skipped, either '<cron expression> for <duration>' or '<start>/<end>'
+	conf.BlackoutWindows, err = blackoutWindowsFromEnv("BLACKOUT_WINDOWS", conf.BlackoutLocation)
+	if err != nil {
+		return conf, err
+	}
+
+	// Annotation on the MongoDB StatefulSet which pauses backups when set to anything but "false". Set to "" to not check it
+	conf.PauseAnnotation = "mongodb-backups/paused"
+	if v, found := os.LookupEnv("PAUSE_ANNOTATION"); found {
+		conf.PauseAnnotation = v
+	}
+
+	// Optional ConfigMap in the launcher's namespace whose 'paused' key pauses backups in the same way
+	conf.PauseConfigMap = os.Getenv("PAUSE_CONFIGMAP")
+
+	// Skip the backup if one of an equal or higher tier succeeded within this long. 0 (the default) always launches
+	conf.FreshnessWindow, err = durationFromEnv("FRESHNESS_WINDOW", 0)
+	if err != nil {
+		return conf, err
+	}
+
+	// Whether to sample serverStatus on each candidate secondary, ranking the least busy first
+	conf.LoadAware = os.Getenv("LOAD_AWARE_SELECTION") == "true"
+	if conf.LoadAware {
+		if err = loadConfig(&conf); err != nil {
+			return conf, err
+		}
+	}
+
 	// Get the hostname so we annotate the created jobs with the owner
 	hostname := os.Getenv("HOSTNAME")
 	if hostname != "" {
@@ -95,27 +510,421 @@ func NewConfig() (Config, error) {
 		conf.Hostname = "unknown"
 	}
 
-	// MongoDB Client
-	mongoDBc, err := mongoDBClient()
-	if err != nil {
-		return conf, fmt.Errorf("creating MongoDB client: %w", err)
+	// The namespace the launcher itself is running in. Set POD_NAMESPACE via the downward API, otherwise the service account namespace is used
+	conf.PodNamespace = podNamespace()
+
+	// The launcher's own pod name. Set POD_NAME via the downward API, otherwise the hostname is used
+	conf.PodName = os.Getenv("POD_NAME")
+	if conf.PodName == "" {
+		conf.PodName = hostname
 	}
-	conf.MongoDBClient = &realMongoClient{
-		db: mongoDBc,
+
+	// Whether to find the launcher's own Pod, Job and CronJob and label the created Jobs with them, so they can be traced back to the run which created them
+	conf.JobProvenance = os.Getenv("JOB_PROVENANCE") == "true"
+
+	// Whether to also make the launcher's Job the owner of the created Jobs, so deleting it (or its CronJob) cascades. Only possible within the same namespace
+	conf.JobOwnerCascade = os.Getenv("JOB_OWNER_CASCADE") == "true"
+	if conf.JobOwnerCascade && !conf.JobProvenance {
+		return conf, fmt.Errorf("JOB_OWNER_CASCADE requires JOB_PROVENANCE=true")
 	}
 
-	// K8s Client
-	k8sc, err := k8sClient()
+	return conf, nil
+}
+
+// LoadInstallConfig reads the launcher configuration plus the settings render-install needs to generate the install manifests.
+// Logs go to stderr, so they don't end up in the manifests written to stdout.
+func LoadInstallConfig() (Config, error) {
+	conf, err := loadConfigLoggingTo(os.Stderr)
 	if err != nil {
-		return conf, fmt.Errorf("creating K8s client: %w", err)
+		return conf, err
+	}
+
+	if conf.LauncherMode != "backup" {
+		return conf, fmt.Errorf("render-install only supports LAUNCHER_MODE 'backup'")
 	}
-	conf.K8sClient = k8sc
+
+	// Namespace to install into. The launcher runs alongside MongoDB, where the backup Jobs are created
+	conf.InstallNamespace = os.Getenv("INSTALL_NAMESPACE")
+	if conf.InstallNamespace == "" {
+		conf.InstallNamespace = conf.PodNamespace
+	}
+
+	// Image of the launcher itself, run by the CronJob
+	conf.InstallLauncherImage = os.Getenv("INSTALL_LAUNCHER_IMAGE")
+	if conf.InstallLauncherImage == "" {
+		return conf, fmt.Errorf("launcher image - INSTALL_LAUNCHER_IMAGE - has not been set")
+	}
+
+	// CronJob schedule. Defaults to hourly or daily (02:00) depending on the backup type
+	conf.InstallSchedule = os.Getenv("INSTALL_SCHEDULE")
+	if conf.InstallSchedule == "" {
+		conf.InstallSchedule = "0 * * * *"
+		if conf.BackupType == "daily" {
+			conf.InstallSchedule = "0 2 * * *"
+		}
+	}
+
+	// Whether to include the MongoDB Secret and the backup Jobs' ConfigMap. Off by default, as applying the output again would
+	// overwrite the real ones
+	conf.InstallSecrets = os.Getenv("INSTALL_SECRETS") == "true"
 
 	return conf, nil
 }
 
-func k8sClient() (*kubernetes.Clientset, error) {
-	var client *kubernetes.Clientset
+// ParseZoneMap parses <host>=<az> pairs separated by commas or newlines, ignoring blank lines and '#' comments. Hosts may
+// be glob patterns. source names where the text came from, in errors and on each mapping.
+func ParseZoneMap(source, text string) ([]ZoneMapping, error) {
+	var zones []ZoneMapping
+
+	for _, line := range strings.Split(text, "\n") {
+		line, _, _ = strings.Cut(line, "#")
+
+		for _, pair := range strings.Split(line, ",") {
+			if pair = strings.TrimSpace(pair); pair == "" {
+				continue
+			}
+
+			host, az, found := strings.Cut(pair, "=")
+			host, az = strings.TrimSpace(host), strings.TrimSpace(az)
+			if !found || host == "" || az == "" {
+				return nil, fmt.Errorf("parsing %s: expected <host>=<az> but got '%s'", source, pair)
+			}
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, fmt.Errorf("parsing %s: invalid host pattern '%s': %w", source, host, err)
+			}
+
+			zones = append(zones, ZoneMapping{Pattern: host, AZ: az, Source: source})
+		}
+	}
+
+	return zones, nil
+}
+
+// blackoutTimeLayouts are accepted for the ends of fixed blackout windows. Times without an offset are in BLACKOUT_TIMEZONE.
+var blackoutTimeLayouts = []string{time.RFC3339, "2006-01-02T15:04"}
+
+// blackoutWindowsFromEnv parses a semicolon separated list of blackout windows from the environment variable, e.g.
+// '0 1 * * 6 for 4h;2025-06-01T00:00/2025-06-02T06:00'.
+func blackoutWindowsFromEnv(name string, location *time.Location) ([]BlackoutWindow, error) {
+	var windows []BlackoutWindow
+
+	for _, spec := range strings.Split(os.Getenv(name), ";") {
+		if spec = strings.TrimSpace(spec); spec == "" {
+			continue
+		}
+
+		if expression, duration, found := strings.Cut(spec, " for "); found {
+			schedule, err := cron.ParseStandard(strings.TrimSpace(expression))
+			if err != nil {
+				return nil, fmt.Errorf("parsing %s cron expression '%s': %w", name, expression, err)
+			}
+			d, err := time.ParseDuration(strings.TrimSpace(duration))
+			if err != nil || d <= 0 {
+				return nil, fmt.Errorf("parsing %s: '%s' must be a positive duration such as 4h", name, duration)
+			}
+			windows = append(windows, BlackoutWindow{Spec: spec, Schedule: schedule, Duration: d})
+			continue
+		}
+
+		startStr, endStr, found := strings.Cut(spec, "/")
+		if !found {
+			return nil, fmt.Errorf("parsing %s: expected '<cron expression> for <duration>' or '<start>/<end>' but got '%s'", name, spec)
+		}
+		start, err := parseBlackoutTime(startStr, location)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s start: %w", name, err)
+		}
+		end, err := parseBlackoutTime(endStr, location)
+		if err != nil {
+			return nil, fmt.Errorf("parsing %s end: %w", name, err)
+		}
+		if !end.After(start) {
+			return nil, fmt.Errorf("parsing %s: window '%s' ends before it starts", name, spec)
+		}
+		windows = append(windows, BlackoutWindow{Spec: spec, Start: start, End: end})
+	}
+
+	return windows, nil
+}
+
+func parseBlackoutTime(v string, location *time.Location) (time.Time, error) {
+	v = strings.TrimSpace(v)
+	for _, layout := range blackoutTimeLayouts {
+		if t, err := time.ParseInLocation(layout, v, location); err == nil {
+			return t, nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("'%s' is not in the form %s", v, strings.Join(blackoutTimeLayouts, " or "))
+}
+
+func loadConfig(conf *Config) error {
+	var err error
+
+	// Levels above which a secondary is too busy. Each is optional
+	thresholds := []struct {
+		env   string
+		value *float64
+	}{
+		{"LOAD_MAX_OPS_PER_SEC", &conf.LoadThresholds.OpsPerSec},
+		{"LOAD_MAX_ACTIVE_CONNECTIONS", &conf.LoadThresholds.ActiveConnections},
+		{"LOAD_MAX_CACHE_DIRTY_RATIO", &conf.LoadThresholds.CacheDirtyRatio},
+		{"LOAD_MAX_CACHE_USED_RATIO", &conf.LoadThresholds.CacheUsedRatio},
+		{"LOAD_MAX_QUEUED", &conf.LoadThresholds.Queued},
+	}
+	for _, t := range thresholds {
+		if *t.value, err = floatFromEnv(t.env); err != nil {
+			return err
+		}
+	}
+
+	// How long between the two serverStatus samples the operation rate is worked out from
+	conf.LoadSampleInterval, err = durationFromEnv("LOAD_SAMPLE_INTERVAL", 5*time.Second)
+	if err != nil {
+		return err
+	}
+	if conf.LoadSampleInterval <= 0 {
+		return fmt.Errorf("LOAD_SAMPLE_INTERVAL must be greater than 0")
+	}
+
+	// How long to wait for a candidate to drop below the thresholds before backing up from the least busy anyway. 0 doesn't wait
+	conf.LoadDeferTimeout, err = durationFromEnv("LOAD_DEFER_TIMEOUT", 0)
+	if err != nil {
+		return err
+	}
+
+	// How often to sample the candidates again whilst deferring
+	conf.LoadDeferInterval, err = durationFromEnv("LOAD_DEFER_INTERVAL", time.Minute)
+	if err != nil {
+		return err
+	}
+	if conf.LoadDeferInterval <= 0 {
+		return fmt.Errorf("LOAD_DEFER_INTERVAL must be greater than 0")
+	}
+
+	return nil
+}
+
+// floatFromEnv parses a non-negative number from the environment variable, or returns 0 if it is unset.
+func floatFromEnv(name string) (float64, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return 0, nil
+	}
+
+	f, err := strconv.ParseFloat(v, 64)
+	if err != nil || f < 0 {
+		return 0, fmt.Errorf("parsing %s: '%s' must be a non-negative number", name, v)
+	}
+
+	return f, nil
+}
+
+// durationFromEnv parses a Go duration string (e.g. 90m) from the environment variable, or returns the default if it is unset.
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	v := os.Getenv(name)
+	if v == "" {
+		return defaultValue, nil
+	}
+
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		return 0, fmt.Errorf("parsing %s: %w", name, err)
+	}
+
+	return d, nil
+}
+
+func podNamespace() string {
+	if ns := os.Getenv("POD_NAMESPACE"); ns != "" {
+		return ns
+	}
+
+	if ns, err := os.ReadFile("/var/run/secrets/kubernetes.io/serviceaccount/namespace"); err == nil {
+		return strings.TrimSpace(string(ns))
+	}
+
+	return "default"
+}
+
+func schedulerConfig(conf *Config) error {
+	// Semicolon separated <backup type>=<cron expression> pairs, e.g. 'hourly=0 * * * *;daily=30 2 * * *'
+	raw := os.Getenv("SCHEDULES")
+	if raw == "" {
+		return fmt.Errorf("SCHEDULES must be set in scheduler mode. e.g. 'hourly=0 * * * *;daily=30 2 * * *'")
+	}
+	for _, entry := range strings.Split(raw, ";") {
+		if strings.TrimSpace(entry) == "" {
+			continue
+		}
+		backupType, expression, found := strings.Cut(entry, "=")
+		backupType, expression = strings.TrimSpace(backupType), strings.TrimSpace(expression)
+		if !found || (backupType != "hourly" && backupType != "daily") {
+			return fmt.Errorf("SCHEDULES entry '%s' must be in the form <hourly|daily>=<cron expression>", entry)
+		}
+		if _, err := cron.ParseStandard(expression); err != nil {
+			return fmt.Errorf("parsing SCHEDULES cron expression for %s: %w", backupType, err)
+		}
+		conf.Schedules = append(conf.Schedules, BackupSchedule{BackupType: backupType, Cron: expression})
+	}
+
+	// Timezone the cron expressions are evaluated in
+	tz := os.Getenv("SCHEDULE_TIMEZONE")
+	if tz == "" {
+		tz = "UTC"
+	}
+	location, err := time.LoadLocation(tz)
+	if err != nil {
+		return fmt.Errorf("loading SCHEDULE_TIMEZONE: %w", err)
+	}
+	conf.ScheduleLocation = location
+
+	// What to do about runs which were missed, e.g. whilst there was no leader. 'skip' drops them, 'once' launches a single catch-up backup
+	conf.CatchUpPolicy = os.Getenv("CATCH_UP_POLICY")
+	switch conf.CatchUpPolicy {
+	case "":
+		conf.CatchUpPolicy = "once"
+	case "skip", "once":
+	default:
+		return fmt.Errorf("CATCH_UP_POLICY must be 'skip' or 'once'")
+	}
+
+	// How late a run can start and still count as on time, like a CronJob's startingDeadlineSeconds
+	if conf.StartingDeadline, err = durationFromEnv("STARTING_DEADLINE", 5*time.Minute); err != nil {
+		return err
+	}
+
+	// How often schedules are evaluated by the leader
+	if conf.SchedulerTick, err = durationFromEnv("SCHEDULER_TICK", 30*time.Second); err != nil {
+		return err
+	}
+
+	// Lease used for leader election, and ConfigMap used to record the last run of each schedule. Both live in POD_NAMESPACE
+	conf.LeaseName = os.Getenv("LEASE_NAME")
+	if conf.LeaseName == "" {
+		conf.LeaseName = "mongodb-backup-launcher"
+	}
+	conf.SchedulerStateConfigMap = os.Getenv("SCHEDULER_STATE_CONFIGMAP")
+	if conf.SchedulerStateConfigMap == "" {
+		conf.SchedulerStateConfigMap = "mongodb-backup-launcher-scheduler"
+	}
+
+	// Address for the /healthz and /readyz endpoints
+	conf.HealthAddr = os.Getenv("HEALTH_ADDR")
+	if conf.HealthAddr == "" {
+		conf.HealthAddr = ":8080"
+	}
+
+	return nil
+}
+
+func serverConfig(conf *Config) error {
+	// Address the HTTP API listens on
+	conf.APIAddr = os.Getenv("API_ADDR")
+	if conf.APIAddr == "" {
+		conf.APIAddr = ":8080"
+	}
+
+	// How callers authenticate. 'token' compares against a static bearer token, 'tokenreview' validates K8s service account tokens
+	conf.APIAuth = os.Getenv("API_AUTH")
+	switch conf.APIAuth {
+	case "token":
+		conf.APIToken = os.Getenv("API_TOKEN")
+		if conf.APIToken == "" {
+			return fmt.Errorf("API_TOKEN must be set when API_AUTH is 'token'")
+		}
+	case "tokenreview":
+		// Optional comma separated groups the caller must be in, e.g. system:serviceaccounts:platform
+		for _, g := range strings.Split(os.Getenv("API_ALLOWED_GROUPS"), ",") {
+			if g = strings.TrimSpace(g); g != "" {
+				conf.APIAllowedGroups = append(conf.APIAllowedGroups, g)
+			}
+		}
+		// Optional comma separated audiences the token must have been issued for, e.g. from a projected service account token
+		for _, a := range strings.Split(os.Getenv("API_AUDIENCES"), ",") {
+			if a = strings.TrimSpace(a); a != "" {
+				conf.APIAudiences = append(conf.APIAudiences, a)
+			}
+		}
+		// Otherwise any service account token in the cluster could trigger backups
+		if len(conf.APIAllowedGroups) == 0 && len(conf.APIAudiences) == 0 {
+			return fmt.Errorf("API_ALLOWED_GROUPS or API_AUDIENCES must be set when API_AUTH is 'tokenreview'")
+		}
+	default:
+		return fmt.Errorf("API_AUTH must be 'token' or 'tokenreview'")
+	}
+
+	// How many runs are kept for the status and list endpoints
+	conf.APIRunHistory = 100
+	if v := os.Getenv("API_RUN_HISTORY"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("API_RUN_HISTORY must be a positive integer")
+		}
+		conf.APIRunHistory = n
+	}
+
+	// How many triggered runs can be launching at once. Further requests are rejected until one finishes
+	conf.APIMaxConcurrentRuns = 4
+	if v := os.Getenv("API_MAX_CONCURRENT_RUNS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("API_MAX_CONCURRENT_RUNS must be a positive integer")
+		}
+		conf.APIMaxConcurrentRuns = n
+	}
+
+	return nil
+}
+
+func controllerConfig(conf *Config) error {
+	// Namespace to watch for MongoDBBackupSchedule resources. Defaults to all namespaces
+	conf.ControllerNamespace = os.Getenv("CONTROLLER_NAMESPACE")
+
+	// How often every schedule is re-checked to see if it is due
+	var err error
+	conf.ControllerResyncInterval, err = durationFromEnv("CONTROLLER_RESYNC_INTERVAL", 30*time.Second)
+	if err != nil {
+		return err
+	}
+
+	// Lease used for leader election between controller replicas. It lives in POD_NAMESPACE
+	conf.LeaseName = os.Getenv("LEASE_NAME")
+	if conf.LeaseName == "" {
+		conf.LeaseName = "mongodb-backup-controller"
+	}
+
+	return nil
+}
+
+func restoreConfig(conf *Config) error {
+	// Which backup to restore. Passed straight through to the restore script
+	conf.RestoreBackupID = os.Getenv("RESTORE_BACKUP_ID")
+	if conf.RestoreBackupID == "" {
+		return fmt.Errorf("backup to restore - RESTORE_BACKUP_ID - has not been set")
+	}
+
+	// Restores overwrite data, so they must be explicitly confirmed
+	conf.RestoreConfirmed = os.Getenv("RESTORE_CONFIRM") == "true"
+	if !conf.RestoreConfirmed {
+		return fmt.Errorf("restores must be confirmed by setting RESTORE_CONFIRM=true")
+	}
+
+	// Namespaces where a restore must never be written to the PRIMARY. Point MONGODB_URI at a scratch replica set instead
+	protected := "production"
+	if v, found := os.LookupEnv("RESTORE_PROTECTED_NAMESPACES"); found {
+		protected = v
+	}
+	for _, ns := range strings.Split(protected, ",") {
+		if ns = strings.TrimSpace(ns); ns != "" {
+			conf.ProtectedNamespaces = append(conf.ProtectedNamespaces, ns)
+		}
+	}
+
+	return nil
+}
+
+func k8sRestConfig() (*rest.Config, error) {
 	var config *rest.Config
 	var err error
 
@@ -132,28 +941,47 @@ func k8sClient() (*kubernetes.Clientset, error) {
 		}
 	}
 
-	client, err = kubernetes.NewForConfig(config)
-	if err != nil {
-		return nil, fmt.Errorf("creating K8s client: %w", err)
-	}
-
-	return client, nil
+	return config, nil
 }
 
-func mongoDBClient() (*mongo.Database, error) {
+func mongoDBClient() (MongoDBClient, MongoDBMemberConnector, error) {
 	mongoUsername := os.Getenv("MONGODB_USERNAME")
 	if mongoUsername == "" {
-		return nil, fmt.Errorf("mongoDB username - MONGODB_USERNAME - has not been set")
+		return nil, nil, fmt.Errorf("mongoDB username - MONGODB_USERNAME - has not been set")
 	}
 
 	mongoPassword := os.Getenv("MONGODB_PASSWORD")
 	if mongoPassword == "" {
-		return nil, fmt.Errorf("mongoDB password - MONGODB_PASSWORD - has not been set")
+		return nil, nil, fmt.Errorf("mongoDB password - MONGODB_PASSWORD - has not been set")
+	}
+
+	return ConnectMongoDB(os.Getenv("MONGODB_URI"), mongoUsername, mongoPassword)
+}
+
+// seedHosts lists the host:port pairs of a mongodb:// URI, without any credentials.
+func seedHosts(mongoURI string) []string {
+	authority := strings.TrimPrefix(mongoURI, "mongodb://")
+	if i := strings.IndexAny(authority, "/?"); i != -1 {
+		authority = authority[:i]
+	}
+	if i := strings.LastIndex(authority, "@"); i != -1 {
+		authority = authority[i+1:]
+	}
+
+	var hosts []string
+	for _, host := range strings.Split(authority, ",") {
+		if host != "" {
+			hosts = append(hosts, host)
+		}
 	}
 
-	mongoURI := os.Getenv("MONGODB_URI")
+	return hosts
+}
+
+// ConnectMongoDB creates a client for the replica set, and a connector for reaching its members directly with the same settings.
+func ConnectMongoDB(mongoURI, mongoUsername, mongoPassword string) (MongoDBClient, MongoDBMemberConnector, error) {
 	if !strings.HasPrefix(mongoURI, "mongodb://") {
-		return nil, fmt.Errorf("set your 'MONGODB_URI' environment variable. Must start with 'mongodb://'. See: https://www.mongodb.com/docs/drivers/go/current/fundamentals/connections/")
+		return nil, nil, fmt.Errorf("set your 'MONGODB_URI' environment variable. Must start with 'mongodb://'. See: https://www.mongodb.com/docs/drivers/go/current/fundamentals/connections/")
 	}
 
 	mongoDBCredential := options.Credential{
@@ -166,8 +994,13 @@ func mongoDBClient() (*mongo.Database, error) {
 
 	client, err := mongo.Connect(clientOpts)
 	if err != nil {
-		return nil, fmt.Errorf("creating MongoDB client: %w", err)
+		return nil, nil, fmt.Errorf("creating MongoDB client: %w", err)
+	}
+
+	memberConnector := &realMongoMemberConnector{
+		uri:        mongoURI,
+		credential: mongoDBCredential,
 	}
 
-	return client.Database("admin"), nil
+	return &realMongoClient{db: client.Database("admin")}, memberConnector, nil
 }
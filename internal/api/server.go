@@ -0,0 +1,377 @@
+package api
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// A run is launched once its backup Job has been created. The Job itself is not followed, so check it for the backup's outcome.
+const (
+	runPending  = "pending"
+	runLaunched = "launched"
+	runFailed   = "failed"
+	runSkipped  = "skipped"
+)
+
+// maxRequestBytes bounds the trigger request body, which only ever holds a backup type and member.
+const maxRequestBytes = 64 << 10
+
+// Run is an API triggered launch, as returned by the status and list endpoints.
+type Run struct {
+	ID             string     `json:"id"`
+	Status         string     `json:"status"`
+	BackupType     string     `json:"backupType"`
+	MemberOverride string     `json:"memberOverride,omitempty"`
+	RequestedBy    string     `json:"requestedBy"`
+	Member         string     `json:"member,omitempty"`
+	AZ             string     `json:"az,omitempty"`
+	Namespace      string     `json:"namespace,omitempty"`
+	JobName        string     `json:"jobName,omitempty"`
+	Error          string     `json:"error,omitempty"`
+	CreatedAt      time.Time  `json:"createdAt"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+}
+
+type triggerRequest struct {
+	BackupType string `json:"backupType"`
+	Member     string `json:"member"`
+}
+
+// Server exposes an authenticated HTTP API for triggering ad-hoc backups.
+type Server struct {
+	conf   config.Config
+	launch func(backupType, member string) (service.Result, error)
+
+	mu      sync.Mutex
+	runs    []*Run
+	running int
+	wg      sync.WaitGroup
+}
+
+func NewServer(conf config.Config) (*Server, error) {
+	s := &Server{conf: conf}
+	s.launch = s.runService
+
+	return s, nil
+}
+
+func (s *Server) runService(backupType, member string) (service.Result, error) {
+	svc, err := service.NewService(s.runConfig(backupType, member))
+	if err != nil {
+		return service.Result{}, fmt.Errorf("creating service: %w", err)
+	}
+
+	return svc.Launch()
+}
+
+// runConfig is the launcher's config for an API run. An API run is an explicit request for a backup, so it is never skipped as
+// covered by a recent one.
+func (s *Server) runConfig(backupType, member string) config.Config {
+	conf := s.conf
+	conf.LauncherMode = "backup"
+	conf.BackupType = backupType
+	conf.MemberOverride = member
+	conf.VerifyBackups = false
+	conf.FreshnessWindow = 0
+
+	return conf
+}
+
+// Run serves the API until the context is cancelled, then waits for in-flight launches to finish.
+func (s *Server) Run(ctx context.Context) error {
+	server := &http.Server{
+		Addr:              s.conf.APIAddr,
+		Handler:           s.Handler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		slog.Info("Starting API server", "addr", s.conf.APIAddr, "auth", s.conf.APIAuth)
+		errCh <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errCh:
+		return fmt.Errorf("serving API: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		return fmt.Errorf("shutting down API server: %w", err)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		s.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-shutdownCtx.Done():
+		return fmt.Errorf("timed out waiting for in-flight launches to finish")
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST /v1/runs", s.authenticated(s.handleTrigger))
+	mux.HandleFunc("GET /v1/runs", s.authenticated(s.handleList))
+	mux.HandleFunc("GET /v1/runs/{id}", s.authenticated(s.handleGet))
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	return mux
+}
+
+func (s *Server) handleTrigger(w http.ResponseWriter, r *http.Request, user string) {
+	var req triggerRequest
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxRequestBytes)).Decode(&req); err != nil {
+			status := http.StatusBadRequest
+			if maxBytesErr := new(http.MaxBytesError); errors.As(err, &maxBytesErr) {
+				status = http.StatusRequestEntityTooLarge
+			}
+			writeError(w, status, fmt.Sprintf("decoding request: %s", err))
+			return
+		}
+	}
+
+	if req.BackupType == "" {
+		req.BackupType = s.conf.BackupType
+	}
+	if req.BackupType != "hourly" && req.BackupType != "daily" {
+		writeError(w, http.StatusBadRequest, "backupType must be 'hourly' or 'daily'")
+		return
+	}
+	if req.Member != "" && req.Member == s.conf.ExcludeReplica {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("member %s is excluded by EXCLUDE_REPLICA", req.Member))
+		return
+	}
+
+	id, err := newRunID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err.Error())
+		return
+	}
+
+	run := &Run{
+		ID:             id,
+		Status:         runPending,
+		BackupType:     req.BackupType,
+		MemberOverride: req.Member,
+		RequestedBy:    user,
+		CreatedAt:      time.Now().UTC(),
+	}
+	if !s.addRun(run) {
+		writeError(w, http.StatusTooManyRequests, fmt.Sprintf("%d runs are already launching. Try again once one has finished", s.conf.APIMaxConcurrentRuns))
+		return
+	}
+
+	slog.Info("Ad-hoc backup requested", "run", run.ID, "backupType", run.BackupType, "member", run.MemberOverride, "requestedBy", user)
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		result, err := s.launch(run.BackupType, run.MemberOverride)
+		s.finishRun(run, result, err)
+	}()
+
+	writeJSON(w, http.StatusAccepted, s.snapshot(run))
+}
+
+func (s *Server) handleGet(w http.ResponseWriter, r *http.Request, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, run := range s.runs {
+		if run.ID == r.PathValue("id") {
+			writeJSON(w, http.StatusOK, *run)
+			return
+		}
+	}
+
+	writeError(w, http.StatusNotFound, "run not found")
+}
+
+func (s *Server) handleList(w http.ResponseWriter, _ *http.Request, _ string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// Most recent first
+	runs := make([]Run, 0, len(s.runs))
+	for i := len(s.runs) - 1; i >= 0; i-- {
+		runs = append(runs, *s.runs[i])
+	}
+
+	writeJSON(w, http.StatusOK, map[string][]Run{"runs": runs})
+}
+
+// addRun records a new run, unless API_MAX_CONCURRENT_RUNS runs are already launching.
+func (s *Server) addRun(run *Run) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running >= s.conf.APIMaxConcurrentRuns {
+		return false
+	}
+	s.running++
+	s.runs = append(s.runs, run)
+
+	return true
+}
+
+// trimHistory drops the oldest finished runs to keep API_RUN_HISTORY of them. Runs still launching are always kept, so their
+// status can be read.
+func (s *Server) trimHistory() {
+	finished := 0
+	for _, run := range s.runs {
+		if run.Status != runPending {
+			finished++
+		}
+	}
+
+	for i := 0; finished > s.conf.APIRunHistory; {
+		if s.runs[i].Status == runPending {
+			i++
+			continue
+		}
+		s.runs = slices.Delete(s.runs, i, i+1)
+		finished--
+	}
+}
+
+func (s *Server) finishRun(run *Run, result service.Result, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.trimHistory()
+
+	s.running--
+
+	now := time.Now().UTC()
+	run.FinishedAt = &now
+	run.Member = result.Member
+	run.AZ = result.AZ
+	run.Namespace = result.Namespace
+	run.JobName = result.JobName
+
+	if errors.Is(err, service.ErrSkipped) {
+		run.Status = runSkipped
+		run.Error = err.Error()
+		slog.Info("Ad-hoc backup skipped", "run", run.ID, "reason", err.Error())
+		return
+	}
+	if err != nil {
+		run.Status = runFailed
+		run.Error = err.Error()
+		slog.Error("Ad-hoc backup failed", "run", run.ID, "error", err.Error())
+		return
+	}
+
+	run.Status = runLaunched
+	slog.Info("Ad-hoc backup launched", "run", run.ID, "job", run.JobName)
+}
+
+func (s *Server) snapshot(run *Run) Run {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return *run
+}
+
+// authenticated rejects requests without a valid bearer token, and passes the caller's identity on to the handler.
+func (s *Server) authenticated(next func(http.ResponseWriter, *http.Request, string)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token, found := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !found || token == "" {
+			writeError(w, http.StatusUnauthorized, "missing bearer token")
+			return
+		}
+
+		user, err := s.authenticate(r.Context(), token)
+		if err != nil {
+			slog.Warn("Rejected API request", "path", r.URL.Path, "error", err.Error())
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+
+		next(w, r, user)
+	}
+}
+
+func (s *Server) authenticate(ctx context.Context, token string) (string, error) {
+	if s.conf.APIAuth == "token" {
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.APIToken)) != 1 {
+			return "", errors.New("invalid static token")
+		}
+		return "static-token", nil
+	}
+
+	review, err := s.conf.K8sClient.AuthenticationV1().TokenReviews().Create(ctx, &authenticationv1.TokenReview{
+		Spec: authenticationv1.TokenReviewSpec{Token: token, Audiences: s.conf.APIAudiences},
+	}, metav1.CreateOptions{})
+	if err != nil {
+		return "", fmt.Errorf("creating TokenReview: %w", err)
+	}
+	if !review.Status.Authenticated {
+		return "", fmt.Errorf("token not authenticated: %s", review.Status.Error)
+	}
+
+	// The API server only authenticates the token for the audiences it was issued for, and reports which of ours matched
+	if len(s.conf.APIAudiences) > 0 && !slices.ContainsFunc(review.Status.Audiences, func(a string) bool {
+		return slices.Contains(s.conf.APIAudiences, a)
+	}) {
+		return "", fmt.Errorf("token for user %s was not issued for any of the allowed audiences", review.Status.User.Username)
+	}
+
+	if len(s.conf.APIAllowedGroups) > 0 && !slices.ContainsFunc(review.Status.User.Groups, func(g string) bool {
+		return slices.Contains(s.conf.APIAllowedGroups, g)
+	}) {
+		return "", fmt.Errorf("user %s is not in any of the allowed groups", review.Status.User.Username)
+	}
+
+	return review.Status.User.Username, nil
+}
+
+func newRunID() (string, error) {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", fmt.Errorf("generating run ID: %w", err)
+	}
+
+	return hex.EncodeToString(b), nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		slog.Warn("writing API response", "error", err.Error())
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, msg string) {
+	writeJSON(w, status, map[string]string{"error": msg})
+}
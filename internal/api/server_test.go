@@ -0,0 +1,267 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func newTestServer(conf config.Config) *Server {
+	if conf.BackupType == "" {
+		conf.BackupType = "daily"
+	}
+	if conf.APIRunHistory == 0 {
+		conf.APIRunHistory = 10
+	}
+	if conf.APIMaxConcurrentRuns == 0 {
+		conf.APIMaxConcurrentRuns = 10
+	}
+
+	s, _ := NewServer(conf)
+	s.launch = func(backupType, member string) (service.Result, error) {
+		if member == "mongodb-0.mongodb.database.svc.cluster.local" {
+			return service.Result{}, errors.New("requested member is not a SECONDARY")
+		}
+		return service.Result{
+			Member:    "mongodb-1.mongodb.database.svc.cluster.local",
+			AZ:        "eu-west-1a",
+			Namespace: "database",
+			JobName:   "targeted-mongodb-backups-abcde",
+		}, nil
+	}
+
+	return s
+}
+
+func do(s *Server, method, path, token, body string) (*httptest.ResponseRecorder, Run) {
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	rec := httptest.NewRecorder()
+	s.Handler().ServeHTTP(rec, req)
+
+	// Errors and lists decode to an empty Run, which the callers don't look at
+	var run Run
+	_ = json.Unmarshal(rec.Body.Bytes(), &run)
+
+	return rec, run
+}
+
+func Test_staticToken(t *testing.T) {
+	s := newTestServer(config.Config{APIAuth: "token", APIToken: "s3cret"})
+
+	rec, _ := do(s, http.MethodPost, "/v1/runs", "", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "wrong", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	rec, run := do(s, http.MethodPost, "/v1/runs", "s3cret", `{"backupType": "hourly"}`)
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "hourly", run.BackupType)
+	assert.Equal(t, "static-token", run.RequestedBy)
+	s.wg.Wait()
+
+	rec, run = do(s, http.MethodGet, "/v1/runs/"+run.ID, "s3cret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, runLaunched, run.Status)
+	assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", run.Member)
+	assert.Equal(t, "eu-west-1a", run.AZ)
+	assert.Equal(t, "targeted-mongodb-backups-abcde", run.JobName)
+	assert.NotNil(t, run.FinishedAt)
+}
+
+func Test_triggerAndList(t *testing.T) {
+	s := newTestServer(config.Config{APIAuth: "token", APIToken: "s3cret", APIRunHistory: 2})
+
+	rec, _ := do(s, http.MethodPost, "/v1/runs", "s3cret", `{"backupType": "weekly"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code)
+
+	s.conf.ExcludeReplica = "mongodb-2.mongodb.database.svc.cluster.local"
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "s3cret", `{"member": "mongodb-2.mongodb.database.svc.cluster.local"}`)
+	assert.Equal(t, http.StatusBadRequest, rec.Code, "expected the excluded member to be rejected")
+
+	_, first := do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	_, failed := do(s, http.MethodPost, "/v1/runs", "s3cret", `{"member": "mongodb-0.mongodb.database.svc.cluster.local"}`)
+	_, latest := do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	s.wg.Wait()
+
+	assert.Equal(t, "daily", first.BackupType, "expected the default backup type")
+
+	_, run := do(s, http.MethodGet, "/v1/runs/"+failed.ID, "s3cret", "")
+	assert.Equal(t, runFailed, run.Status)
+	assert.Contains(t, run.Error, "not a SECONDARY")
+
+	rec, _ = do(s, http.MethodGet, "/v1/runs/"+first.ID, "s3cret", "")
+	assert.Equal(t, http.StatusNotFound, rec.Code, "expected the oldest run to have been dropped from the history")
+
+	rec, _ = do(s, http.MethodGet, "/v1/runs", "s3cret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	var list map[string][]Run
+	assert.NoError(t, json.Unmarshal(rec.Body.Bytes(), &list))
+	assert.Len(t, list["runs"], 2)
+	assert.Equal(t, latest.ID, list["runs"][0].ID, "expected the most recent run first")
+}
+
+func Test_runConfig(t *testing.T) {
+	s := newTestServer(config.Config{LauncherMode: "api", BackupType: "daily", VerifyBackups: true, FreshnessWindow: 45 * time.Minute})
+
+	conf := s.runConfig("hourly", "mongodb-1.mongodb.database.svc.cluster.local")
+	assert.Equal(t, "backup", conf.LauncherMode)
+	assert.Equal(t, "hourly", conf.BackupType)
+	assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", conf.MemberOverride)
+	assert.False(t, conf.VerifyBackups)
+	assert.Zero(t, conf.FreshnessWindow, "expected an API run never to be skipped as covered by a recent backup")
+}
+
+func Test_triggerBodyTooLarge(t *testing.T) {
+	s := newTestServer(config.Config{APIAuth: "token", APIToken: "s3cret"})
+
+	body := `{"backupType": "hourly", "member": "` + strings.Repeat("a", maxRequestBytes) + `"}`
+	rec, _ := do(s, http.MethodPost, "/v1/runs", "s3cret", body)
+	assert.Equal(t, http.StatusRequestEntityTooLarge, rec.Code)
+	assert.Empty(t, s.runs)
+}
+
+func Test_historyKeepsPendingRuns(t *testing.T) {
+	s := newTestServer(config.Config{APIAuth: "token", APIToken: "s3cret", APIRunHistory: 1})
+
+	release := make(chan struct{})
+	s.launch = func(backupType, member string) (service.Result, error) {
+		<-release
+		return service.Result{JobName: "targeted-mongodb-backups-abcde"}, nil
+	}
+
+	_, first := do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	_, second := do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+
+	// Both are still launching, so neither can be dropped from the history yet
+	for _, id := range []string{first.ID, second.ID} {
+		rec, run := do(s, http.MethodGet, "/v1/runs/"+id, "s3cret", "")
+		assert.Equal(t, http.StatusOK, rec.Code)
+		assert.Equal(t, runPending, run.Status)
+	}
+
+	close(release)
+	s.wg.Wait()
+
+	// Once they have finished, the history is trimmed back down
+	assert.Len(t, s.runs, 1)
+	rec, run := do(s, http.MethodGet, "/v1/runs/"+second.ID, "s3cret", "")
+	assert.Equal(t, http.StatusOK, rec.Code)
+	assert.Equal(t, runLaunched, run.Status)
+}
+
+func Test_tokenReview(t *testing.T) {
+	k8sClient := fake.NewClientset()
+	k8sClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		switch review.Spec.Token {
+		case "platform-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{
+				Username: "system:serviceaccount:platform:deployer",
+				Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:platform"},
+			}}
+		case "other-token":
+			review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{
+				Username: "system:serviceaccount:other:app",
+				Groups:   []string{"system:serviceaccounts", "system:serviceaccounts:other"},
+			}}
+		}
+		return true, review, nil
+	})
+
+	s := newTestServer(config.Config{
+		K8sClient:        k8sClient,
+		APIAuth:          "tokenreview",
+		APIAllowedGroups: []string{"system:serviceaccounts:platform"},
+	})
+
+	rec, run := do(s, http.MethodPost, "/v1/runs", "platform-token", "")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+	assert.Equal(t, "system:serviceaccount:platform:deployer", run.RequestedBy)
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "other-token", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "expected callers outside the allowed groups to be rejected")
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "invalid-token", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code)
+
+	s.wg.Wait()
+}
+
+func Test_tokenReviewAudiences(t *testing.T) {
+	k8sClient := fake.NewClientset()
+	k8sClient.PrependReactor("create", "tokenreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authenticationv1.TokenReview).DeepCopy()
+		review.Status = authenticationv1.TokenReviewStatus{Authenticated: true, User: authenticationv1.UserInfo{Username: "system:serviceaccount:platform:deployer"}}
+
+		// Tokens are issued for a single audience, and the API server reports it if it was one of those requested
+		audience, _ := strings.CutSuffix(review.Spec.Token, "-token")
+		switch {
+		case review.Spec.Token == "unscoped-token":
+			// Authenticated without saying which audience matched
+		case slices.Contains(review.Spec.Audiences, audience):
+			review.Status.Audiences = []string{audience}
+		default:
+			review.Status = authenticationv1.TokenReviewStatus{Error: "token audiences is invalid for the target audiences"}
+		}
+		return true, review, nil
+	})
+
+	s := newTestServer(config.Config{
+		K8sClient:    k8sClient,
+		APIAuth:      "tokenreview",
+		APIAudiences: []string{"mongodb-backup-launcher"},
+	})
+
+	rec, _ := do(s, http.MethodPost, "/v1/runs", "mongodb-backup-launcher-token", "")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "https://kubernetes.default.svc-token", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "expected tokens for other audiences to be rejected")
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "unscoped-token", "")
+	assert.Equal(t, http.StatusUnauthorized, rec.Code, "expected tokens not confirmed for an allowed audience to be rejected")
+
+	s.wg.Wait()
+}
+
+func Test_triggerConcurrencyLimit(t *testing.T) {
+	s := newTestServer(config.Config{APIAuth: "token", APIToken: "s3cret", APIMaxConcurrentRuns: 1})
+
+	release := make(chan struct{})
+	s.launch = func(string, string) (service.Result, error) {
+		<-release
+		return service.Result{}, nil
+	}
+
+	rec, _ := do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	assert.Equal(t, http.StatusAccepted, rec.Code)
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	assert.Equal(t, http.StatusTooManyRequests, rec.Code)
+
+	close(release)
+	s.wg.Wait()
+
+	rec, _ = do(s, http.MethodPost, "/v1/runs", "s3cret", "")
+	assert.Equal(t, http.StatusAccepted, rec.Code, "expected a slot once the first run finished")
+	s.wg.Wait()
+}
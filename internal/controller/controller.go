@@ -0,0 +1,493 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	"github.com/robfig/cron/v3"
+	apiequality "k8s.io/apimachinery/pkg/api/equality"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+	"k8s.io/client-go/util/retry"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// MongoDBConnector creates MongoDB clients from a schedule's connection Secret. Swapped out in tests.
+type MongoDBConnector interface {
+	Connect(uri, username, password string) (config.MongoDBClient, config.MongoDBMemberConnector, error)
+}
+
+type realMongoDBConnector struct{}
+
+func (realMongoDBConnector) Connect(uri, username, password string) (config.MongoDBClient, config.MongoDBMemberConnector, error) {
+	return config.ConnectMongoDB(uri, username, password)
+}
+
+type mongoDBClients struct {
+	secretVersion   string
+	client          config.MongoDBClient
+	memberConnector config.MongoDBMemberConnector
+}
+
+// Controller reconciles MongoDBBackupSchedule resources, launching a backup through Service whenever one is due.
+type Controller struct {
+	conf      config.Config
+	connector MongoDBConnector
+	now       func() time.Time
+
+	// MongoDB clients are kept per schedule so each run doesn't open a new connection pool
+	mu      sync.Mutex
+	clients map[string]mongoDBClients
+
+	// Schedules with a launch still going, so they aren't launched again until it finishes
+	running  map[string]bool
+	launches sync.WaitGroup
+}
+
+func NewController(conf config.Config) (*Controller, error) {
+	if conf.K8sDynamicClient == nil {
+		return nil, fmt.Errorf("controller mode requires a K8s dynamic client")
+	}
+
+	return &Controller{
+		conf:      conf,
+		connector: realMongoDBConnector{},
+		now:       time.Now,
+		clients:   make(map[string]mongoDBClients),
+		running:   make(map[string]bool),
+	}, nil
+}
+
+// Run takes part in leader election until the context is cancelled. Only the replica holding the Lease reconciles schedules, so
+// running several replicas doesn't launch each backup several times.
+func (c *Controller) Run(ctx context.Context) error {
+	slog.Info("Starting controller", "identity", c.conf.Hostname, "lease", c.conf.LeaseName, "leaseNamespace", c.conf.PodNamespace,
+		"namespace", c.conf.ControllerNamespace, "resync", c.conf.ControllerResyncInterval)
+
+	// Run returns whenever leadership is lost, so stand for election again until we are shut down. An elector can't be reused
+	// once it has stopped, so each attempt gets a new one
+	for ctx.Err() == nil {
+		elector, err := c.newElector()
+		if err != nil {
+			return err
+		}
+		elector.Run(ctx)
+	}
+
+	slog.Info("Stopping controller. Waiting for running launches to finish")
+	c.launches.Wait()
+
+	return nil
+}
+
+func (c *Controller) newElector() (*leaderelection.LeaderElector, error) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      c.conf.LeaseName,
+			Namespace: c.conf.PodNamespace,
+		},
+		Client: c.conf.K8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: c.conf.Hostname,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: c.lead,
+			OnStoppedLeading: func() {
+				slog.Info("Stopped leading", "identity", c.conf.Hostname)
+			},
+			OnNewLeader: func(identity string) {
+				slog.Info("Current leader", "identity", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating leader elector: %w", err)
+	}
+
+	return elector, nil
+}
+
+// lead reconciles every schedule on each resync interval, for as long as we hold the Lease.
+func (c *Controller) lead(ctx context.Context) {
+	slog.Info("Started leading", "identity", c.conf.Hostname)
+
+	ticker := time.NewTicker(c.conf.ControllerResyncInterval)
+	defer ticker.Stop()
+
+	for {
+		if err := c.reconcileAll(ctx); err != nil {
+			slog.Error("reconciling schedules", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (c *Controller) reconcileAll(ctx context.Context) error {
+	list, err := c.conf.K8sDynamicClient.Resource(scheduleGVR).Namespace(c.conf.ControllerNamespace).List(ctx, metav1.ListOptions{})
+	if err != nil {
+		return fmt.Errorf("listing MongoDBBackupSchedules: %w", err)
+	}
+
+	listed := make(map[string]bool, len(list.Items))
+	for i := range list.Items {
+		listed[list.Items[i].GetNamespace()+"/"+list.Items[i].GetName()] = true
+
+		if err := c.reconcile(ctx, &list.Items[i]); err != nil {
+			slog.Error("reconciling schedule", "namespace", list.Items[i].GetNamespace(), "name", list.Items[i].GetName(), "error", err.Error())
+		}
+	}
+
+	c.evictClients(listed)
+
+	return nil
+}
+
+// evictClients disconnects the MongoDB clients of schedules which have been deleted. Clients still in use by a launch are
+// kept until a later pass.
+func (c *Controller) evictClients(listed map[string]bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for key, cached := range c.clients {
+		if listed[key] || c.running[key] {
+			continue
+		}
+		delete(c.clients, key)
+		disconnect(key, cached.client)
+	}
+}
+
+func (c *Controller) reconcile(ctx context.Context, obj *unstructured.Unstructured) error {
+	var schedule MongoDBBackupSchedule
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &schedule); err != nil {
+		return fmt.Errorf("decoding schedule: %w", err)
+	}
+
+	now := c.now()
+	status := schedule.Status
+	status.Conditions = append([]metav1.Condition(nil), schedule.Status.Conditions...)
+
+	cronSchedule, err := cron.ParseStandard(schedule.Spec.Schedule)
+	if err == nil && schedule.Spec.BackupType != "hourly" && schedule.Spec.BackupType != "daily" {
+		err = fmt.Errorf("backupType must be 'hourly' or 'daily'")
+	}
+	if err != nil {
+		apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+			Type:               conditionReady,
+			Status:             metav1.ConditionFalse,
+			Reason:             "InvalidSpec",
+			Message:            err.Error(),
+			ObservedGeneration: schedule.Generation,
+		})
+		return c.updateStatus(ctx, obj, schedule.Status, status)
+	}
+
+	apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionReady,
+		Status:             metav1.ConditionTrue,
+		Reason:             "Scheduled",
+		ObservedGeneration: schedule.Generation,
+	})
+
+	last := schedule.CreationTimestamp.Time
+	if status.LastRunTime != nil {
+		last = status.LastRunTime.Time
+	}
+	next := cronSchedule.Next(last)
+
+	if schedule.Spec.Suspend || now.Before(next) {
+		if schedule.Spec.Suspend {
+			apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               conditionReady,
+				Status:             metav1.ConditionFalse,
+				Reason:             "Suspended",
+				ObservedGeneration: schedule.Generation,
+			})
+		}
+		status.NextRunTime = &metav1.Time{Time: next}
+		return c.updateStatus(ctx, obj, schedule.Status, status)
+	}
+
+	key := schedule.Namespace + "/" + schedule.Name
+	if !c.startLaunch(key) {
+		slog.Info("Schedule is due but its previous run is still going", "namespace", schedule.Namespace, "name", schedule.Name)
+		return c.updateStatus(ctx, obj, schedule.Status, status)
+	}
+
+	// Only one run is launched however many were missed, in the same way as a CronJob with a starting deadline
+	slog.Info("Schedule is due", "namespace", schedule.Namespace, "name", schedule.Name, "due", next)
+
+	// The run is recorded before launching, so a status update which fails afterwards can't launch the same slot twice
+	status.LastRunTime = &metav1.Time{Time: now}
+	status.NextRunTime = &metav1.Time{Time: cronSchedule.Next(now)}
+	apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+		Type:               conditionLastRunSucceeded,
+		Status:             metav1.ConditionUnknown,
+		Reason:             "Launching",
+		ObservedGeneration: schedule.Generation,
+	})
+	if err := c.updateStatus(ctx, obj, schedule.Status, status); err != nil {
+		c.finishLaunch(key)
+		return fmt.Errorf("recording run before launching: %w", err)
+	}
+
+	// Launches can hold the source pod or freeze a member for a while, so each runs in the background rather than holding up
+	// the other schedules
+	go func() {
+		defer c.finishLaunch(key)
+
+		result, runErr := c.launch(ctx, &schedule)
+		if runErr != nil {
+			slog.Error("launching backup", "namespace", schedule.Namespace, "name", schedule.Name, "error", runErr.Error())
+		}
+
+		// The result is still recorded if the controller is stopping
+		if err := c.recordResult(context.WithoutCancel(ctx), &schedule, result, runErr); err != nil {
+			slog.Error("recording run result", "namespace", schedule.Namespace, "name", schedule.Name, "error", err.Error())
+		}
+	}()
+
+	return nil
+}
+
+// startLaunch marks the schedule as running, returning false if its previous run hasn't finished.
+func (c *Controller) startLaunch(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.running[key] {
+		return false
+	}
+	c.running[key] = true
+	c.launches.Add(1)
+
+	return true
+}
+
+func (c *Controller) finishLaunch(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	delete(c.running, key)
+	c.launches.Done()
+}
+
+// recordResult writes the outcome of a run to the schedule's status. The schedule is read again as its status was updated
+// before launching, and the update is retried so a transient failure doesn't lose the result.
+func (c *Controller) recordResult(ctx context.Context, launched *MongoDBBackupSchedule, result service.Result, runErr error) error {
+	return retry.OnError(retry.DefaultBackoff, func(err error) bool { return !apierrors.IsNotFound(err) }, func() error {
+		obj, err := c.conf.K8sDynamicClient.Resource(scheduleGVR).Namespace(launched.Namespace).Get(ctx, launched.Name, metav1.GetOptions{})
+		if err != nil {
+			return fmt.Errorf("getting schedule %s/%s: %w", launched.Namespace, launched.Name, err)
+		}
+
+		var schedule MongoDBBackupSchedule
+		if err := runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &schedule); err != nil {
+			return fmt.Errorf("decoding schedule: %w", err)
+		}
+
+		status := schedule.Status
+		status.Conditions = append([]metav1.Condition(nil), schedule.Status.Conditions...)
+		status.LastSelectedMember = result.Member
+		status.LastAZ = result.AZ
+		status.LastJobName = result.JobName
+
+		if errors.Is(runErr, service.ErrSkipped) {
+			apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               conditionLastRunSucceeded,
+				Status:             metav1.ConditionFalse,
+				Reason:             "LaunchSkipped",
+				Message:            runErr.Error(),
+				ObservedGeneration: launched.Generation,
+			})
+		} else if runErr != nil {
+			apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               conditionLastRunSucceeded,
+				Status:             metav1.ConditionFalse,
+				Reason:             "LaunchFailed",
+				Message:            runErr.Error(),
+				ObservedGeneration: launched.Generation,
+			})
+		} else {
+			apimeta.SetStatusCondition(&status.Conditions, metav1.Condition{
+				Type:               conditionLastRunSucceeded,
+				Status:             metav1.ConditionTrue,
+				Reason:             "JobCreated",
+				Message:            fmt.Sprintf("created job %s/%s", result.Namespace, result.JobName),
+				ObservedGeneration: launched.Generation,
+			})
+		}
+
+		return c.updateStatus(ctx, obj, schedule.Status, status)
+	})
+}
+
+// launch builds a Service for the schedule, reusing the controller's K8s clients, and runs a single backup.
+func (c *Controller) launch(ctx context.Context, schedule *MongoDBBackupSchedule) (service.Result, error) {
+	client, memberConnector, err := c.mongoDBClients(ctx, schedule)
+	if err != nil {
+		return service.Result{}, err
+	}
+
+	conf := c.conf
+	conf.LauncherMode = "backup"
+	conf.BackupMode = "dump"
+	conf.VerifyBackups = false
+	conf.BackupType = schedule.Spec.BackupType
+	conf.ExcludeReplica = schedule.Spec.SelectionPolicy.ExcludeReplica
+	conf.MongoDBClient = client
+	conf.MongoDBMemberConnector = memberConnector
+	template := schedule.Spec.JobTemplate
+	if template.Image != "" {
+		conf.DockerImageURI = template.Image
+	}
+	if conf.DockerImageURI == "" {
+		return service.Result{}, fmt.Errorf("jobTemplate.image is not set and there is no default DOCKER_IMAGE_URI")
+	}
+	if template.NodePool != "" {
+		conf.NodePool = template.NodePool
+	}
+
+	overrides := service.JobOverrides{
+		ServiceAccountName: template.ServiceAccountName,
+		Resources:          template.Resources,
+		Env:                template.Env,
+		Tolerations:        template.Tolerations,
+	}
+	if ref := template.CredentialsSecret; ref != nil {
+		overrides.CredentialsSecret = ref.Name
+		overrides.UsernameKey = ref.UsernameKey
+		overrides.PasswordKey = ref.PasswordKey
+	}
+
+	s, err := service.NewService(conf, service.WithJobOverrides(overrides))
+	if err != nil {
+		return service.Result{}, fmt.Errorf("creating service: %w", err)
+	}
+
+	return s.Launch()
+}
+
+func (c *Controller) mongoDBClients(ctx context.Context, schedule *MongoDBBackupSchedule) (config.MongoDBClient, config.MongoDBMemberConnector, error) {
+	ref := schedule.Spec.ConnectionSecret
+	secret, err := c.conf.K8sClient.CoreV1().Secrets(schedule.Namespace).Get(ctx, ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, nil, fmt.Errorf("getting connection secret %s: %w", ref.Name, err)
+	}
+
+	key := schedule.Namespace + "/" + schedule.Name
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	cached, found := c.clients[key]
+	if found && cached.secretVersion == secret.ResourceVersion {
+		return cached.client, cached.memberConnector, nil
+	}
+
+	uriKey, usernameKey, passwordKey := defaultString(ref.URIKey, "uri"), defaultString(ref.UsernameKey, "username"), defaultString(ref.PasswordKey, "password")
+	for _, k := range []string{uriKey, usernameKey, passwordKey} {
+		if _, found := secret.Data[k]; !found {
+			return nil, nil, fmt.Errorf("connection secret %s is missing key '%s'", ref.Name, k)
+		}
+	}
+
+	client, memberConnector, err := c.connector.Connect(string(secret.Data[uriKey]), string(secret.Data[usernameKey]), string(secret.Data[passwordKey]))
+	if err != nil {
+		return nil, nil, fmt.Errorf("connecting to MongoDB: %w", err)
+	}
+
+	// The Secret has been rotated. Only this schedule's launch uses the old client, and it is about to use the new one
+	if found {
+		disconnect(key, cached.client)
+	}
+
+	c.clients[key] = mongoDBClients{
+		secretVersion:   secret.ResourceVersion,
+		client:          client,
+		memberConnector: memberConnector,
+	}
+
+	return client, memberConnector, nil
+}
+
+func (c *Controller) updateStatus(ctx context.Context, obj *unstructured.Unstructured, old, updated ScheduleStatus) error {
+	if apiequality.Semantic.DeepEqual(old, updated) {
+		return nil
+	}
+
+	statusObj, err := runtime.DefaultUnstructuredConverter.ToUnstructured(&updated)
+	if err != nil {
+		return fmt.Errorf("encoding status: %w", err)
+	}
+
+	obj = obj.DeepCopy()
+	obj.Object["status"] = statusObj
+
+	_, err = c.conf.K8sDynamicClient.Resource(scheduleGVR).Namespace(obj.GetNamespace()).UpdateStatus(ctx, obj, metav1.UpdateOptions{})
+	if err != nil {
+		return fmt.Errorf("updating status of schedule %s/%s: %w", obj.GetNamespace(), obj.GetName(), err)
+	}
+
+	return nil
+}
+
+// disconnecter is implemented by MongoDB clients which hold a connection pool open.
+type disconnecter interface {
+	Disconnect(ctx context.Context) error
+}
+
+// disconnectTimeout bounds closing an evicted client, which is done while holding the client cache lock.
+const disconnectTimeout = 10 * time.Second
+
+func disconnect(key string, client config.MongoDBClient) {
+	d, ok := client.(disconnecter)
+	if !ok {
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), disconnectTimeout)
+	defer cancel()
+
+	if err := d.Disconnect(ctx); err != nil {
+		slog.Warn("Unable to disconnect evicted MongoDB client", "schedule", key, "error", err.Error())
+	}
+}
+
+func defaultString(v, defaultValue string) string {
+	if v == "" {
+		return defaultValue
+	}
+
+	return v
+}
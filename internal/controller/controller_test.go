@@ -0,0 +1,461 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	coordinationv1 "k8s.io/api/coordination/v1"
+	v1 "k8s.io/api/core/v1"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/pointer"
+)
+
+// fakeSingleResult decodes a canned BSON document into whatever the caller asks for.
+type fakeSingleResult struct {
+	doc bson.M
+}
+
+func (f fakeSingleResult) Decode(v any) error {
+	raw, err := bson.Marshal(f.doc)
+	if err != nil {
+		return err
+	}
+	return bson.Unmarshal(raw, v)
+}
+
+type fakeMongoClient struct {
+	doc          bson.M
+	disconnected bool
+}
+
+func (f *fakeMongoClient) RunCommand(_ context.Context, _ interface{}) config.SingleResult {
+	return fakeSingleResult{doc: f.doc}
+}
+
+func (f *fakeMongoClient) Disconnect(_ context.Context) error {
+	f.disconnected = true
+	return nil
+}
+
+type fakeConnector struct {
+	connects int
+	uri      string
+	clients  []*fakeMongoClient
+}
+
+func (f *fakeConnector) Connect(uri, _, _ string) (config.MongoDBClient, config.MongoDBMemberConnector, error) {
+	f.connects++
+	f.uri = uri
+	client := &fakeMongoClient{doc: bson.M{
+		"ok":  1,
+		"set": "rs0",
+		"members": bson.A{
+			bson.M{"name": "mongodb-0.mongodb.database.svc.cluster.local", "stateStr": "PRIMARY"},
+			bson.M{"name": "mongodb-1.mongodb.database.svc.cluster.local", "stateStr": "SECONDARY"},
+		},
+	}}
+	f.clients = append(f.clients, client)
+	return client, nil, nil
+}
+
+func newSchedule(spec map[string]interface{}, created time.Time) *unstructured.Unstructured {
+	return &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "backups.mongodb-launcher.io/v1alpha1",
+		"kind":       "MongoDBBackupSchedule",
+		"metadata": map[string]interface{}{
+			"name":              "hourly",
+			"namespace":         "database",
+			"creationTimestamp": created.Format(time.RFC3339),
+		},
+		"spec": spec,
+	}}
+}
+
+func newTestController(now time.Time, schedule *unstructured.Unstructured) (*Controller, *fakeConnector, *fake.Clientset, *dynamicfake.FakeDynamicClient) {
+	k8sClient := fake.NewClientset(
+		&v1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: "database", ResourceVersion: "1"},
+			Data: map[string][]byte{
+				"uri":      []byte("mongodb://mongodb.database.svc.cluster.local:27017"),
+				"username": []byte("backup"),
+				"password": []byte("secret"),
+			},
+		},
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongodb-1", Namespace: "database"},
+			Spec:       v1.PodSpec{NodeName: "node1"},
+			Status:     v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}},
+		},
+		&v1.Node{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:   "node1",
+				Labels: map[string]string{"topology.kubernetes.io/zone": "eu-west-1c"},
+			},
+			Status: v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+		},
+	)
+
+	dynamicClient := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{scheduleGVR: "MongoDBBackupScheduleList"}, schedule)
+
+	connector := &fakeConnector{}
+	c := &Controller{
+		conf: config.Config{
+			K8sClient:        k8sClient,
+			K8sDynamicClient: dynamicClient,
+			DockerImageURI:   "backup:latest",
+			Hostname:         "controller-0",
+			LeaseName:        "mongodb-backup-controller",
+			PodNamespace:     "backups",
+
+			ControllerResyncInterval: 10 * time.Millisecond,
+		},
+		connector: connector,
+		now:       func() time.Time { return now },
+		clients:   make(map[string]mongoDBClients),
+		running:   make(map[string]bool),
+	}
+
+	return c, connector, k8sClient, dynamicClient
+}
+
+func getSchedule(t *testing.T, dynamicClient *dynamicfake.FakeDynamicClient) MongoDBBackupSchedule {
+	obj, err := dynamicClient.Resource(scheduleGVR).Namespace("database").Get(context.Background(), "hourly", metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	var schedule MongoDBBackupSchedule
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &schedule))
+
+	return schedule
+}
+
+func Test_reconcileDue(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	schedule := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "0 * * * *",
+		"backupType":       "hourly",
+	}, created)
+
+	c, connector, k8sClient, dynamicClient := newTestController(now, schedule)
+
+	assert.NoError(t, c.reconcileAll(context.Background()))
+	c.launches.Wait()
+
+	jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, jobs.Items, 1, "expected the schedule to be due and a backup job to be created")
+	assert.Equal(t, "hourly", jobs.Items[0].Labels["backup-type"])
+	assert.Equal(t, "backup:latest", jobs.Items[0].Spec.Template.Spec.Containers[0].Image)
+	assert.Equal(t, "mongodb://mongodb.database.svc.cluster.local:27017", connector.uri)
+
+	updated := getSchedule(t, dynamicClient)
+	assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", updated.Status.LastSelectedMember)
+	assert.Equal(t, "eu-west-1c", updated.Status.LastAZ)
+	assert.True(t, updated.Status.LastRunTime.Time.Equal(now))
+	assert.True(t, updated.Status.NextRunTime.Time.Equal(time.Date(2025, 1, 1, 11, 0, 0, 0, time.UTC)))
+	assert.True(t, apimeta.IsStatusConditionTrue(updated.Status.Conditions, conditionReady))
+	assert.True(t, apimeta.IsStatusConditionTrue(updated.Status.Conditions, conditionLastRunSucceeded))
+
+	// A second pass in the same hour must not launch again, and must reuse the MongoDB client
+	c.now = func() time.Time { return now.Add(10 * time.Minute) }
+	assert.NoError(t, c.reconcileAll(context.Background()))
+	c.launches.Wait()
+
+	jobs, err = k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, jobs.Items, 1)
+	assert.Equal(t, 1, connector.connects)
+}
+
+func Test_reconcileJobTemplate(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	schedule := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "0 * * * *",
+		"backupType":       "hourly",
+		"jobTemplate": map[string]interface{}{
+			"image":              "orders-backup:latest",
+			"nodePool":           "orders-backups",
+			"serviceAccountName": "orders-backups",
+			"credentialsSecret":  map[string]interface{}{"name": "orders-mongodb"},
+			"resources":          map[string]interface{}{"requests": map[string]interface{}{"memory": "4Gi"}},
+			"env":                []interface{}{map[string]interface{}{"name": "S3_BUCKET", "value": "orders-backups"}},
+		},
+	}, created)
+
+	c, _, k8sClient, _ := newTestController(now, schedule)
+
+	assert.NoError(t, c.reconcileAll(context.Background()))
+	c.launches.Wait()
+
+	jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	if !assert.Len(t, jobs.Items, 1) {
+		return
+	}
+
+	podSpec := jobs.Items[0].Spec.Template.Spec
+	container := podSpec.Containers[0]
+	assert.Equal(t, "orders-backup:latest", container.Image)
+	assert.Equal(t, "orders-backups", podSpec.ServiceAccountName)
+	assert.Contains(t, podSpec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[1].Values, "orders-backups")
+	assert.Equal(t, "4Gi", container.Resources.Requests.Memory().String())
+	assert.Contains(t, container.Env, v1.EnvVar{Name: "S3_BUCKET", Value: "orders-backups"})
+	for _, e := range container.Env {
+		if e.Name == "MONGO_INITDB_ROOT_USERNAME" {
+			assert.Equal(t, "orders-mongodb", e.ValueFrom.SecretKeyRef.Name)
+		}
+	}
+}
+
+func Test_reconcileNotDue(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 9, 45, 0, 0, time.UTC)
+
+	schedule := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "0 * * * *",
+		"backupType":       "hourly",
+	}, created)
+
+	c, connector, k8sClient, dynamicClient := newTestController(now, schedule)
+
+	assert.NoError(t, c.reconcileAll(context.Background()))
+
+	jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, jobs.Items)
+	assert.Equal(t, 0, connector.connects)
+
+	updated := getSchedule(t, dynamicClient)
+	assert.Nil(t, updated.Status.LastRunTime)
+	assert.True(t, updated.Status.NextRunTime.Time.Equal(time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)))
+}
+
+func Test_reconcileInvalidSpec(t *testing.T) {
+	now := time.Date(2025, 1, 1, 9, 45, 0, 0, time.UTC)
+
+	schedule := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "every hour",
+		"backupType":       "hourly",
+	}, now)
+
+	c, _, _, dynamicClient := newTestController(now, schedule)
+
+	assert.NoError(t, c.reconcileAll(context.Background()))
+
+	updated := getSchedule(t, dynamicClient)
+	condition := apimeta.FindStatusCondition(updated.Status.Conditions, conditionReady)
+	assert.NotNil(t, condition)
+	assert.Equal(t, metav1.ConditionFalse, condition.Status)
+	assert.Equal(t, "InvalidSpec", condition.Reason)
+}
+
+// failStatusUpdates makes the numbered status updates of the schedule fail, counting from 1.
+func failStatusUpdates(dynamicClient *dynamicfake.FakeDynamicClient, failing ...int) {
+	updates := 0
+	dynamicClient.PrependReactor("update", "mongodbbackupschedules", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		if action.GetSubresource() != "status" {
+			return false, nil, nil
+		}
+		updates++
+		if slices.Contains(failing, updates) {
+			return true, nil, errors.New("etcd unavailable")
+		}
+		return false, nil, nil
+	})
+}
+
+func Test_reconcileDueStatusUpdateFails(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	newDueSchedule := func() *unstructured.Unstructured {
+		return newSchedule(map[string]interface{}{
+			"connectionSecret": map[string]interface{}{"name": "mongodb"},
+			"schedule":         "0 * * * *",
+			"backupType":       "hourly",
+		}, created)
+	}
+
+	t.Run("BeforeLaunching", func(t *testing.T) {
+		c, connector, k8sClient, dynamicClient := newTestController(now, newDueSchedule())
+		failStatusUpdates(dynamicClient, 1)
+
+		// The run couldn't be recorded, so it isn't launched. The next pass launches it
+		assert.NoError(t, c.reconcileAll(context.Background()))
+		c.launches.Wait()
+
+		jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, jobs.Items)
+		assert.Equal(t, 0, connector.connects)
+		assert.Nil(t, getSchedule(t, dynamicClient).Status.LastRunTime)
+
+		assert.NoError(t, c.reconcileAll(context.Background()))
+		c.launches.Wait()
+
+		jobs, err = k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, jobs.Items, 1)
+	})
+
+	t.Run("AfterLaunching", func(t *testing.T) {
+		c, _, k8sClient, dynamicClient := newTestController(now, newDueSchedule())
+		failStatusUpdates(dynamicClient, 2)
+
+		// Recording the result is retried, and the run is never launched twice
+		assert.NoError(t, c.reconcileAll(context.Background()))
+		c.launches.Wait()
+		assert.NoError(t, c.reconcileAll(context.Background()))
+		c.launches.Wait()
+
+		jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Len(t, jobs.Items, 1)
+
+		updated := getSchedule(t, dynamicClient)
+		assert.True(t, updated.Status.LastRunTime.Time.Equal(now))
+		assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", updated.Status.LastSelectedMember)
+		assert.True(t, apimeta.IsStatusConditionTrue(updated.Status.Conditions, conditionLastRunSucceeded))
+	})
+}
+
+func Test_reconcileStillRunning(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	schedule := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "0 * * * *",
+		"backupType":       "hourly",
+	}, created)
+
+	c, connector, k8sClient, dynamicClient := newTestController(now, schedule)
+	c.running["database/hourly"] = true
+
+	assert.NoError(t, c.reconcileAll(context.Background()))
+
+	jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Empty(t, jobs.Items)
+	assert.Equal(t, 0, connector.connects)
+	assert.Nil(t, getSchedule(t, dynamicClient).Status.LastRunTime)
+}
+
+func Test_mongoDBClientsEviction(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	obj := newSchedule(map[string]interface{}{
+		"connectionSecret": map[string]interface{}{"name": "mongodb"},
+		"schedule":         "0 * * * *",
+		"backupType":       "hourly",
+	}, created)
+
+	c, connector, k8sClient, dynamicClient := newTestController(now, obj)
+
+	var schedule MongoDBBackupSchedule
+	assert.NoError(t, runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &schedule))
+
+	_, _, err := c.mongoDBClients(context.Background(), &schedule)
+	assert.NoError(t, err)
+
+	// Rotating the Secret replaces the client and closes the old one
+	secret, err := k8sClient.CoreV1().Secrets("database").Get(context.Background(), "mongodb", metav1.GetOptions{})
+	assert.NoError(t, err)
+	secret.ResourceVersion = "2"
+	_, err = k8sClient.CoreV1().Secrets("database").Update(context.Background(), secret, metav1.UpdateOptions{})
+	assert.NoError(t, err)
+
+	_, _, err = c.mongoDBClients(context.Background(), &schedule)
+	assert.NoError(t, err)
+	assert.Len(t, connector.clients, 2)
+	assert.True(t, connector.clients[0].disconnected)
+	assert.False(t, connector.clients[1].disconnected)
+
+	// Deleting the schedule closes its client
+	assert.NoError(t, dynamicClient.Resource(scheduleGVR).Namespace("database").Delete(context.Background(), "hourly", metav1.DeleteOptions{}))
+	assert.NoError(t, c.reconcileAll(context.Background()))
+
+	assert.True(t, connector.clients[1].disconnected)
+	assert.Empty(t, c.clients)
+}
+
+func Test_runLeaderElection(t *testing.T) {
+	created := time.Date(2025, 1, 1, 9, 30, 0, 0, time.UTC)
+	now := time.Date(2025, 1, 1, 10, 0, 5, 0, time.UTC)
+
+	newDueSchedule := func() *unstructured.Unstructured {
+		return newSchedule(map[string]interface{}{
+			"connectionSecret": map[string]interface{}{"name": "mongodb"},
+			"schedule":         "0 * * * *",
+			"backupType":       "hourly",
+		}, created)
+	}
+
+	t.Run("Leader", func(t *testing.T) {
+		c, _, k8sClient, _ := newTestController(now, newDueSchedule())
+
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan error)
+		go func() { done <- c.Run(ctx) }()
+
+		assert.Eventually(t, func() bool {
+			jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+			return err == nil && len(jobs.Items) == 1
+		}, 5*time.Second, 10*time.Millisecond, "expected the leader to launch the due schedule")
+
+		lease, err := k8sClient.CoordinationV1().Leases("backups").Get(context.Background(), "mongodb-backup-controller", metav1.GetOptions{})
+		assert.NoError(t, err)
+		assert.Equal(t, "controller-0", *lease.Spec.HolderIdentity)
+
+		cancel()
+		assert.NoError(t, <-done)
+	})
+
+	t.Run("NotLeader", func(t *testing.T) {
+		c, connector, k8sClient, _ := newTestController(now, newDueSchedule())
+
+		held := metav1.NewMicroTime(time.Now())
+		_, err := k8sClient.CoordinationV1().Leases("backups").Create(context.Background(), &coordinationv1.Lease{
+			ObjectMeta: metav1.ObjectMeta{Name: "mongodb-backup-controller", Namespace: "backups"},
+			Spec: coordinationv1.LeaseSpec{
+				HolderIdentity:       pointer.String("controller-1"),
+				LeaseDurationSeconds: pointer.Int32(3600),
+				AcquireTime:          &held,
+				RenewTime:            &held,
+			},
+		}, metav1.CreateOptions{})
+		assert.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		assert.NoError(t, c.Run(ctx))
+
+		jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+		assert.NoError(t, err)
+		assert.Empty(t, jobs.Items, "expected only the leader to launch")
+		assert.Equal(t, 0, connector.connects)
+	})
+}
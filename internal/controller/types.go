@@ -0,0 +1,92 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var scheduleGVR = schema.GroupVersionResource{
+	Group:    "backups.mongodb-launcher.io",
+	Version:  "v1alpha1",
+	Resource: "mongodbbackupschedules",
+}
+
+const (
+	conditionReady            = "Ready"
+	conditionLastRunSucceeded = "LastRunSucceeded"
+)
+
+// MongoDBBackupSchedule is the custom resource reconciled in controller mode. See deploy/crds for the CRD.
+type MongoDBBackupSchedule struct {
+	metav1.TypeMeta   `json:",inline"`
+	metav1.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec   ScheduleSpec   `json:"spec"`
+	Status ScheduleStatus `json:"status,omitempty"`
+}
+
+type ScheduleSpec struct {
+	// Secret in the same namespace as the schedule, holding the replica set URI and credentials
+	ConnectionSecret ConnectionSecret `json:"connectionSecret"`
+
+	// Standard 5 field cron expression
+	Schedule string `json:"schedule"`
+
+	// 'hourly' or 'daily'. Passed through to the backup script
+	BackupType string `json:"backupType"`
+
+	Suspend         bool            `json:"suspend,omitempty"`
+	SelectionPolicy SelectionPolicy `json:"selectionPolicy,omitempty"`
+	JobTemplate     JobTemplate     `json:"jobTemplate,omitempty"`
+}
+
+type ConnectionSecret struct {
+	Name        string `json:"name"`
+	URIKey      string `json:"uriKey,omitempty"`
+	UsernameKey string `json:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+type SelectionPolicy struct {
+	// A member which should never be backed up from. Equivalent to EXCLUDE_REPLICA
+	ExcludeReplica string `json:"excludeReplica,omitempty"`
+}
+
+type JobTemplate struct {
+	// Image run by the backup Job. Defaults to the controller's DOCKER_IMAGE_URI
+	Image string `json:"image,omitempty"`
+
+	// Karpenter NodePool the backup Job runs on. Defaults to the controller's NODEPOOL_NAME
+	NodePool string `json:"nodePool,omitempty"`
+
+	// Defaults to 'backups'
+	ServiceAccountName string `json:"serviceAccountName,omitempty"`
+
+	// Secret in the MongoDB namespace the backup Job reads the credentials from. Defaults to the 'mongodb' Secret
+	CredentialsSecret *CredentialsSecret `json:"credentialsSecret,omitempty"`
+
+	// Replaces the default 1Gi memory and 2 CPU
+	Resources *corev1.ResourceRequirements `json:"resources,omitempty"`
+
+	// Added to the backup container, e.g. the bucket to write to. They can't replace the launcher's own variables
+	Env []corev1.EnvVar `json:"env,omitempty"`
+
+	// Added to the toleration of the backups NodePool taint
+	Tolerations []corev1.Toleration `json:"tolerations,omitempty"`
+}
+
+type CredentialsSecret struct {
+	Name        string `json:"name"`
+	UsernameKey string `json:"usernameKey,omitempty"`
+	PasswordKey string `json:"passwordKey,omitempty"`
+}
+
+type ScheduleStatus struct {
+	LastRunTime        *metav1.Time       `json:"lastRunTime,omitempty"`
+	NextRunTime        *metav1.Time       `json:"nextRunTime,omitempty"`
+	LastSelectedMember string             `json:"lastSelectedMember,omitempty"`
+	LastAZ             string             `json:"lastAZ,omitempty"`
+	LastJobName        string             `json:"lastJobName,omitempty"`
+	Conditions         []metav1.Condition `json:"conditions,omitempty"`
+}
@@ -0,0 +1,236 @@
+package install
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/utils/pointer"
+	"sigs.k8s.io/yaml"
+)
+
+// launcherName is used for the launcher's own CronJob, ServiceAccount and RBAC.
+const launcherName = "mongodb-backup-launcher"
+
+// launcherEnv are the settings passed through to the launcher CronJob when they are set. Credentials come from the
+// MongoDB Secret, and the pod's identity from the downward API, instead.
+var launcherEnv = []string{
+	"LOG_LEVEL",
+	"EXCLUDE_REPLICA",
+	"MONGODB_URI",
+	"DOCKER_IMAGE_URI",
+	"BACKUP_TYPE",
+	"BACKUP_MODE",
+	"SNAPSHOT_CLASS",
+	"SNAPSHOT_VOLUME",
+	"SNAPSHOT_READY_TIMEOUT",
+	"VERIFY_BACKUPS",
+	"VERIFY_IMAGE_URI",
+	"JOB_WAIT_TIMEOUT",
+	"VERIFY_JOB_TIMEOUT",
+	"NODEPOOL_NAME",
+	"NODEPOOL_PREFLIGHT",
+	"UNSCHEDULABLE_TIMEOUT",
+	"PROTECT_SOURCE_POD",
+	"PROTECT_SOURCE_NODE",
+	"MEMBER_FREEZE_DURATION",
+	"ZONE_POD_ANNOTATION",
+	"ZONE_MAP",
+	"ZONE_MAP_CONFIGMAP",
+	"ZONE_RESOLVERS",
+	"ZONE_DNS_TXT_NAME",
+	"RBAC_SELF_CHECK",
+	"LAUNCH_EVENTS",
+	"OTEL_EXPORTER_OTLP_ENDPOINT",
+	"RUN_REPORT_FILE",
+	"TERMINATION_LOG_PATH",
+	"BLACKOUT_WINDOWS",
+	"BLACKOUT_TIMEZONE",
+	"PAUSE_ANNOTATION",
+	"PAUSE_CONFIGMAP",
+	"FRESHNESS_WINDOW",
+	"LOAD_AWARE_SELECTION",
+	"LOAD_MAX_OPS_PER_SEC",
+	"LOAD_MAX_ACTIVE_CONNECTIONS",
+	"LOAD_MAX_CACHE_DIRTY_RATIO",
+	"LOAD_MAX_CACHE_USED_RATIO",
+	"LOAD_MAX_QUEUED",
+	"LOAD_SAMPLE_INTERVAL",
+	"LOAD_DEFER_TIMEOUT",
+	"LOAD_DEFER_INTERVAL",
+	"JOB_PROVENANCE",
+	"JOB_OWNER_CASCADE",
+}
+
+// Render writes the manifests needed to run the launcher as a CronJob, along with the ServiceAccount the backup Jobs it creates
+// use, and optionally the ConfigMap and Secret they reference. Names come from the service package so the two cannot drift apart.
+func Render(conf config.Config, w io.Writer) error {
+	svc, err := service.NewService(conf)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+
+	ns := conf.InstallNamespace
+	labels := map[string]string{"app.kubernetes.io/name": launcherName}
+
+	objects := []runtime.Object{
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: service.JobServiceAccount, Namespace: ns, Labels: labels},
+		},
+		&corev1.ServiceAccount{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+			ObjectMeta: metav1.ObjectMeta{Name: launcherName, Namespace: ns, Labels: labels},
+		},
+	}
+
+	// Left out unless asked for, as applying the manifests again would overwrite the real credentials and settings
+	if conf.InstallSecrets {
+		objects = append(objects,
+			&corev1.ConfigMap{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "ConfigMap"},
+				ObjectMeta: metav1.ObjectMeta{Name: service.JobConfigMap, Namespace: ns, Labels: labels},
+				Data:       map[string]string{},
+			},
+			&corev1.Secret{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"},
+				ObjectMeta: metav1.ObjectMeta{Name: service.MongoDBSecret, Namespace: ns, Labels: labels},
+				Type:       corev1.SecretTypeOpaque,
+				StringData: map[string]string{
+					service.MongoDBSecretUsernameKey: envOrPlaceholder("MONGODB_USERNAME"),
+					service.MongoDBSecretPasswordKey: envOrPlaceholder("MONGODB_PASSWORD"),
+				},
+			},
+		)
+	}
+
+	roleRules, clusterRules := svc.PolicyRules(ns)
+	subjects := []rbacv1.Subject{{Kind: rbacv1.ServiceAccountKind, Name: launcherName, Namespace: ns}}
+
+	objects = append(objects,
+		&rbacv1.Role{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "Role"},
+			ObjectMeta: metav1.ObjectMeta{Name: launcherName, Namespace: ns, Labels: labels},
+			Rules:      roleRules,
+		},
+		&rbacv1.RoleBinding{
+			TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "RoleBinding"},
+			ObjectMeta: metav1.ObjectMeta{Name: launcherName, Namespace: ns, Labels: labels},
+			RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "Role", Name: launcherName},
+			Subjects:   subjects,
+		},
+	)
+
+	// Cluster-scoped objects are named after the namespace, so launchers in several namespaces don't collide
+	if len(clusterRules) > 0 {
+		clusterName := fmt.Sprintf("%s-%s", launcherName, ns)
+		objects = append(objects,
+			&rbacv1.ClusterRole{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRole"},
+				ObjectMeta: metav1.ObjectMeta{Name: clusterName, Labels: labels},
+				Rules:      clusterRules,
+			},
+			&rbacv1.ClusterRoleBinding{
+				TypeMeta:   metav1.TypeMeta{APIVersion: "rbac.authorization.k8s.io/v1", Kind: "ClusterRoleBinding"},
+				ObjectMeta: metav1.ObjectMeta{Name: clusterName, Labels: labels},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: clusterName},
+				Subjects:   subjects,
+			},
+		)
+	}
+
+	objects = append(objects, cronJob(conf, labels))
+
+	for _, obj := range objects {
+		b, err := yaml.Marshal(obj)
+		if err != nil {
+			return fmt.Errorf("marshalling %T: %w", obj, err)
+		}
+		if _, err = fmt.Fprintf(w, "---\n%s", b); err != nil {
+			return fmt.Errorf("writing manifests: %w", err)
+		}
+	}
+
+	return nil
+}
+
+func cronJob(conf config.Config, labels map[string]string) *batchv1.CronJob {
+	env := []corev1.EnvVar{
+		secretEnv("MONGODB_USERNAME", service.MongoDBSecretUsernameKey),
+		secretEnv("MONGODB_PASSWORD", service.MongoDBSecretPasswordKey),
+		fieldEnv("POD_NAME", "metadata.name"),
+		fieldEnv("POD_NAMESPACE", "metadata.namespace"),
+	}
+	for _, name := range launcherEnv {
+		if v, found := os.LookupEnv(name); found {
+			env = append(env, corev1.EnvVar{Name: name, Value: v})
+		}
+	}
+
+	return &batchv1.CronJob{
+		TypeMeta: metav1.TypeMeta{APIVersion: "batch/v1", Kind: "CronJob"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      fmt.Sprintf("%s-%s", launcherName, conf.BackupType),
+			Namespace: conf.InstallNamespace,
+			Labels:    labels,
+		},
+		Spec: batchv1.CronJobSpec{
+			Schedule:          conf.InstallSchedule,
+			ConcurrencyPolicy: batchv1.ForbidConcurrent,
+			JobTemplate: batchv1.JobTemplateSpec{
+				Spec: batchv1.JobSpec{
+					BackoffLimit: pointer.Int32(0),
+					Template: corev1.PodTemplateSpec{
+						ObjectMeta: metav1.ObjectMeta{Labels: labels},
+						Spec: corev1.PodSpec{
+							ServiceAccountName: launcherName,
+							RestartPolicy:      corev1.RestartPolicyNever,
+							Containers: []corev1.Container{
+								{
+									Name:  "launcher",
+									Image: conf.InstallLauncherImage,
+									Env:   env,
+								},
+							},
+						},
+					},
+				},
+			},
+		},
+	}
+}
+
+func secretEnv(name, key string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name: name,
+		ValueFrom: &corev1.EnvVarSource{
+			SecretKeyRef: &corev1.SecretKeySelector{
+				LocalObjectReference: corev1.LocalObjectReference{Name: service.MongoDBSecret},
+				Key:                  key,
+			},
+		},
+	}
+}
+
+func fieldEnv(name, path string) corev1.EnvVar {
+	return corev1.EnvVar{
+		Name:      name,
+		ValueFrom: &corev1.EnvVarSource{FieldRef: &corev1.ObjectFieldSelector{FieldPath: path}},
+	}
+}
+
+func envOrPlaceholder(name string) string {
+	if v := os.Getenv(name); v != "" {
+		return v
+	}
+
+	return "CHANGE_ME"
+}
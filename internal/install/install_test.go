@@ -0,0 +1,114 @@
+package install
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	batchv1 "k8s.io/api/batch/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"sigs.k8s.io/yaml"
+)
+
+func Test_Render(t *testing.T) {
+	t.Setenv("MONGODB_USERNAME", "")
+	t.Setenv("MONGODB_PASSWORD", "")
+	t.Setenv("BACKUP_TYPE", "hourly")
+
+	conf := config.Config{
+		LauncherMode:         "backup",
+		BackupMode:           "dump",
+		BackupType:           "hourly",
+		NodePoolPreflight:    true,
+		InstallNamespace:     "database",
+		InstallLauncherImage: "launcher:v1",
+		InstallSchedule:      "0 * * * *",
+	}
+
+	docs := render(t, conf)
+
+	assert.Contains(t, docs, "ServiceAccount/"+service.JobServiceAccount)
+	assert.NotContains(t, docs, "ConfigMap/"+service.JobConfigMap, "expected the ConfigMap to be left out by default")
+	assert.NotContains(t, docs, "Secret/"+service.MongoDBSecret, "expected the Secret to be left out by default")
+	assert.Contains(t, docs, "ServiceAccount/mongodb-backup-launcher")
+	assert.Contains(t, docs, "RoleBinding/mongodb-backup-launcher")
+	assert.Contains(t, docs, "ClusterRoleBinding/mongodb-backup-launcher-database")
+
+	var role rbacv1.Role
+	require.NoError(t, yaml.Unmarshal([]byte(docs["Role/mongodb-backup-launcher"]), &role))
+	assert.Equal(t, "database", role.Namespace)
+	assert.Contains(t, role.Rules, rbacv1.PolicyRule{APIGroups: []string{"batch"}, Resources: []string{"jobs"}, Verbs: []string{"create"}})
+
+	var clusterRole rbacv1.ClusterRole
+	require.NoError(t, yaml.Unmarshal([]byte(docs["ClusterRole/mongodb-backup-launcher-database"]), &clusterRole))
+	assert.Contains(t, clusterRole.Rules, rbacv1.PolicyRule{APIGroups: []string{"karpenter.sh"}, Resources: []string{"nodepools"}, Verbs: []string{"get"}})
+
+	var cronJob batchv1.CronJob
+	require.NoError(t, yaml.Unmarshal([]byte(docs["CronJob/mongodb-backup-launcher-hourly"]), &cronJob))
+	assert.Equal(t, "0 * * * *", cronJob.Spec.Schedule)
+	assert.Equal(t, batchv1.ForbidConcurrent, cronJob.Spec.ConcurrencyPolicy)
+
+	pod := cronJob.Spec.JobTemplate.Spec.Template.Spec
+	assert.Equal(t, "mongodb-backup-launcher", pod.ServiceAccountName)
+	assert.Equal(t, "launcher:v1", pod.Containers[0].Image)
+
+	env := map[string]string{}
+	for _, e := range pod.Containers[0].Env {
+		switch {
+		case e.ValueFrom != nil && e.ValueFrom.SecretKeyRef != nil:
+			env[e.Name] = "secret:" + e.ValueFrom.SecretKeyRef.Name + "/" + e.ValueFrom.SecretKeyRef.Key
+		case e.ValueFrom != nil && e.ValueFrom.FieldRef != nil:
+			env[e.Name] = "field:" + e.ValueFrom.FieldRef.FieldPath
+		default:
+			env[e.Name] = e.Value
+		}
+	}
+	assert.Equal(t, "secret:"+service.MongoDBSecret+"/"+service.MongoDBSecretUsernameKey, env["MONGODB_USERNAME"])
+	assert.Equal(t, "field:metadata.namespace", env["POD_NAMESPACE"])
+	assert.Equal(t, "hourly", env["BACKUP_TYPE"])
+}
+
+func Test_RenderSecrets(t *testing.T) {
+	t.Setenv("MONGODB_USERNAME", "")
+	t.Setenv("MONGODB_PASSWORD", "")
+
+	conf := config.Config{
+		LauncherMode:         "backup",
+		BackupMode:           "dump",
+		BackupType:           "hourly",
+		InstallNamespace:     "database",
+		InstallLauncherImage: "launcher:v1",
+		InstallSchedule:      "0 * * * *",
+		InstallSecrets:       true,
+	}
+
+	docs := render(t, conf)
+
+	assert.Contains(t, docs, "ConfigMap/"+service.JobConfigMap)
+	assert.Contains(t, docs, "Secret/"+service.MongoDBSecret)
+	assert.Contains(t, docs["Secret/"+service.MongoDBSecret], "CHANGE_ME")
+}
+
+// render returns the rendered manifests keyed by <kind>/<name>.
+func render(t *testing.T, conf config.Config) map[string]string {
+	var out bytes.Buffer
+	require.NoError(t, Render(conf, &out))
+
+	docs := map[string]string{}
+	for _, doc := range strings.Split(out.String(), "---\n")[1:] {
+		var meta struct {
+			metav1.TypeMeta   `json:",inline"`
+			metav1.ObjectMeta `json:"metadata"`
+		}
+		require.NoError(t, yaml.Unmarshal([]byte(doc), &meta))
+		docs[meta.Kind+"/"+meta.Name] = doc
+	}
+
+	return docs
+}
@@ -0,0 +1,389 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+	"github.com/robfig/cron/v3"
+	corev1 "k8s.io/api/core/v1"
+	k8serrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/leaderelection"
+	"k8s.io/client-go/tools/leaderelection/resourcelock"
+)
+
+const (
+	leaseDuration = 15 * time.Second
+	renewDeadline = 10 * time.Second
+	retryPeriod   = 2 * time.Second
+)
+
+// shutdownTimeout bounds how long running launches are waited for on shutdown. Overridden in tests.
+var shutdownTimeout = 30 * time.Second
+
+type schedule struct {
+	backupType string
+	spec       cron.Schedule
+}
+
+// Scheduler evaluates cron schedules for several backup types in one process. Only the replica holding the Lease launches backups.
+type Scheduler struct {
+	conf      config.Config
+	schedules []schedule
+	now       func() time.Time
+	launch    func(ctx context.Context, backupType string) error
+
+	// Backup types with a launch still going, so a slow launch of one doesn't hold up the others or overlap with itself
+	mu       sync.Mutex
+	running  map[string]bool
+	launches sync.WaitGroup
+
+	ready   atomic.Bool
+	healthz *leaderelection.HealthzAdaptor
+}
+
+func NewScheduler(conf config.Config) (*Scheduler, error) {
+	s := &Scheduler{
+		conf:    conf,
+		now:     time.Now,
+		healthz: leaderelection.NewLeaderHealthzAdaptor(renewDeadline),
+		running: make(map[string]bool),
+	}
+	s.launch = s.runService
+
+	for _, sc := range conf.Schedules {
+		spec, err := cron.ParseStandard(sc.Cron)
+		if err != nil {
+			return nil, fmt.Errorf("parsing cron expression for %s: %w", sc.BackupType, err)
+		}
+		s.schedules = append(s.schedules, schedule{backupType: sc.BackupType, spec: spec})
+	}
+
+	return s, nil
+}
+
+// runService launches a single backup in the same way as the CronJob mode. ctx is the leader's, so nothing new is launched once
+// leadership has been lost. A launch which has already started runs to completion, as its slot is recorded and it won't be retried.
+func (s *Scheduler) runService(ctx context.Context, backupType string) error {
+	if err := ctx.Err(); err != nil {
+		return fmt.Errorf("no longer leading, so not launching: %w", err)
+	}
+
+	conf := s.conf
+	conf.LauncherMode = "backup"
+	conf.BackupType = backupType
+
+	svc, err := service.NewService(conf)
+	if err != nil {
+		return fmt.Errorf("creating service: %w", err)
+	}
+
+	return svc.Run()
+}
+
+// Run serves the health endpoints and takes part in leader election until the context is cancelled.
+func (s *Scheduler) Run(ctx context.Context) error {
+	server := &http.Server{Addr: s.conf.HealthAddr, Handler: s.healthHandler()}
+	go func() {
+		if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+			slog.Error("serving health endpoints", "error", err.Error())
+		}
+	}()
+	defer func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+
+	s.ready.Store(true)
+	slog.Info("Starting scheduler", "identity", s.conf.Hostname, "lease", s.conf.LeaseName, "namespace", s.conf.PodNamespace)
+
+	// Run returns whenever leadership is lost, so stand for election again until we are shut down. An elector can't be reused
+	// once it has stopped, so each attempt gets a new one
+	for ctx.Err() == nil {
+		elector, err := s.newElector()
+		if err != nil {
+			return err
+		}
+		elector.Run(ctx)
+	}
+
+	slog.Info("Stopping scheduler. Waiting for running launches to finish", "timeout", shutdownTimeout)
+
+	done := make(chan struct{})
+	go func() {
+		s.launches.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-time.After(shutdownTimeout):
+		return fmt.Errorf("timed out waiting for running launches to finish")
+	}
+}
+
+func (s *Scheduler) newElector() (*leaderelection.LeaderElector, error) {
+	lock := &resourcelock.LeaseLock{
+		LeaseMeta: metav1.ObjectMeta{
+			Name:      s.conf.LeaseName,
+			Namespace: s.conf.PodNamespace,
+		},
+		Client: s.conf.K8sClient.CoordinationV1(),
+		LockConfig: resourcelock.ResourceLockConfig{
+			Identity: s.conf.Hostname,
+		},
+	}
+
+	elector, err := leaderelection.NewLeaderElector(leaderelection.LeaderElectionConfig{
+		Lock:            lock,
+		LeaseDuration:   leaseDuration,
+		RenewDeadline:   renewDeadline,
+		RetryPeriod:     retryPeriod,
+		ReleaseOnCancel: true,
+		WatchDog:        s.healthz,
+		Callbacks: leaderelection.LeaderCallbacks{
+			OnStartedLeading: s.lead,
+			OnStoppedLeading: func() {
+				slog.Info("Stopped leading", "identity", s.conf.Hostname)
+			},
+			OnNewLeader: func(identity string) {
+				slog.Info("Current leader", "identity", identity)
+			},
+		},
+	})
+	if err != nil {
+		return nil, fmt.Errorf("creating leader elector: %w", err)
+	}
+
+	return elector, nil
+}
+
+func (s *Scheduler) healthHandler() http.Handler {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		if err := s.healthz.Check(r); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		if !s.ready.Load() {
+			http.Error(w, "not ready", http.StatusServiceUnavailable)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	})
+
+	return mux
+}
+
+// lead evaluates the schedules on every tick for as long as we hold the Lease.
+func (s *Scheduler) lead(ctx context.Context) {
+	slog.Info("Started leading", "identity", s.conf.Hostname)
+
+	ticker := time.NewTicker(s.conf.SchedulerTick)
+	defer ticker.Stop()
+
+	for {
+		if err := s.tick(ctx); err != nil {
+			slog.Error("evaluating schedules", "error", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// tick launches every schedule which is due, and records the slots it has dealt with so a new leader carries on where we left off.
+// The slots are recorded before launching, so a launch which outlives our leadership is never repeated by the next leader.
+func (s *Scheduler) tick(ctx context.Context) error {
+	state, err := s.loadState(ctx)
+	if err != nil {
+		return err
+	}
+
+	now := s.now().In(s.conf.ScheduleLocation)
+	changed := false
+	var due []string
+
+	for _, sc := range s.schedules {
+		last, found := state[sc.backupType]
+		if !found {
+			// First time we have seen this schedule. Start from now rather than catching up on its entire history
+			state[sc.backupType] = now
+			changed = true
+			continue
+		}
+
+		d := decide(sc.spec, last.In(s.conf.ScheduleLocation), now, s.conf.StartingDeadline, s.conf.CatchUpPolicy)
+		if d.slot.IsZero() {
+			continue
+		}
+
+		if d.missed > 0 {
+			slog.Warn("Missed scheduled runs", "backupType", sc.backupType, "missed", d.missed, "policy", s.conf.CatchUpPolicy)
+		}
+
+		state[sc.backupType] = d.slot
+		changed = true
+
+		if !d.run {
+			slog.Warn("Skipping run as it is past the starting deadline", "backupType", sc.backupType, "slot", d.slot, "deadline", s.conf.StartingDeadline)
+			continue
+		}
+
+		slog.Info("Launching scheduled backup", "backupType", sc.backupType, "slot", d.slot)
+		due = append(due, sc.backupType)
+	}
+
+	if !changed {
+		return nil
+	}
+
+	if err := s.saveState(ctx, state); err != nil {
+		return fmt.Errorf("recording slots before launching: %w", err)
+	}
+
+	for _, backupType := range due {
+		s.startLaunch(ctx, backupType)
+	}
+
+	return nil
+}
+
+// startLaunch launches the backup type in the background, unless its previous launch is still going.
+func (s *Scheduler) startLaunch(ctx context.Context, backupType string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.running[backupType] {
+		slog.Warn("Skipping run as the previous one is still launching", "backupType", backupType)
+		return
+	}
+	s.running[backupType] = true
+	s.launches.Add(1)
+
+	go func() {
+		defer func() {
+			s.mu.Lock()
+			delete(s.running, backupType)
+			s.mu.Unlock()
+			s.launches.Done()
+		}()
+
+		err := s.launch(ctx, backupType)
+		if errors.Is(err, service.ErrSkipped) {
+			slog.Info("Scheduled backup skipped", "backupType", backupType, "reason", err.Error())
+		} else if err != nil {
+			slog.Error("launching scheduled backup", "backupType", backupType, "error", err.Error())
+		}
+	}()
+}
+
+type decision struct {
+	// The most recent slot which is due, or zero if nothing is due
+	slot time.Time
+	// Whether to launch for that slot
+	run bool
+	// How many earlier slots were missed entirely
+	missed int
+}
+
+func decide(spec cron.Schedule, last, now time.Time, deadline time.Duration, policy string) decision {
+	slot := spec.Next(last)
+	if slot.After(now) {
+		return decision{}
+	}
+
+	var missed int
+	for next := spec.Next(slot); !next.After(now); next = spec.Next(next) {
+		slot = next
+		missed++
+	}
+
+	onTime := now.Sub(slot) <= deadline
+	if !onTime {
+		missed++
+	}
+
+	return decision{
+		slot:   slot,
+		run:    onTime || (policy == "once" && missed > 0),
+		missed: missed,
+	}
+}
+
+func (s *Scheduler) loadState(ctx context.Context) (map[string]time.Time, error) {
+	state := make(map[string]time.Time)
+
+	cm, err := s.conf.K8sClient.CoreV1().ConfigMaps(s.conf.PodNamespace).Get(ctx, s.conf.SchedulerStateConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("getting scheduler state: %w", err)
+	}
+
+	for backupType, v := range cm.Data {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			slog.Warn("Ignoring unparseable scheduler state", "backupType", backupType, "value", v)
+			continue
+		}
+		state[backupType] = t
+	}
+
+	return state, nil
+}
+
+func (s *Scheduler) saveState(ctx context.Context, state map[string]time.Time) error {
+	data := make(map[string]string)
+	for backupType, t := range state {
+		data[backupType] = t.UTC().Format(time.RFC3339)
+	}
+
+	configMaps := s.conf.K8sClient.CoreV1().ConfigMaps(s.conf.PodNamespace)
+
+	cm, err := configMaps.Get(ctx, s.conf.SchedulerStateConfigMap, metav1.GetOptions{})
+	if k8serrors.IsNotFound(err) {
+		_, err = configMaps.Create(ctx, &corev1.ConfigMap{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      s.conf.SchedulerStateConfigMap,
+				Namespace: s.conf.PodNamespace,
+				Labels:    map[string]string{"app": "mongodb-backup-launcher"},
+			},
+			Data: data,
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating scheduler state: %w", err)
+		}
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting scheduler state: %w", err)
+	}
+
+	cm.Data = data
+	if _, err = configMaps.Update(ctx, cm, metav1.UpdateOptions{}); err != nil {
+		return fmt.Errorf("updating scheduler state: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,238 @@
+package scheduler
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_decide(t *testing.T) {
+	hourly, err := NewScheduler(config.Config{Schedules: []config.BackupSchedule{{BackupType: "hourly", Cron: "0 * * * *"}}})
+	assert.NoError(t, err)
+	spec := hourly.schedules[0].spec
+
+	base := time.Date(2025, 1, 1, 10, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name     string
+		last     time.Time
+		now      time.Time
+		policy   string
+		expected decision
+	}{
+		{name: "NotDue", last: base, now: base.Add(30 * time.Minute), policy: "once", expected: decision{}},
+		{name: "OnTime", last: base, now: base.Add(time.Hour + time.Minute), policy: "skip", expected: decision{slot: base.Add(time.Hour), run: true}},
+		{name: "LateSkip", last: base, now: base.Add(time.Hour + 20*time.Minute), policy: "skip", expected: decision{slot: base.Add(time.Hour), run: false, missed: 1}},
+		{name: "LateOnce", last: base, now: base.Add(time.Hour + 20*time.Minute), policy: "once", expected: decision{slot: base.Add(time.Hour), run: true, missed: 1}},
+		{name: "SeveralMissedOnce", last: base, now: base.Add(4*time.Hour + 20*time.Minute), policy: "once", expected: decision{slot: base.Add(4 * time.Hour), run: true, missed: 4}},
+		{name: "SeveralMissedButLatestOnTime", last: base, now: base.Add(4*time.Hour + time.Minute), policy: "skip", expected: decision{slot: base.Add(4 * time.Hour), run: true, missed: 3}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			d := decide(spec, tc.last, tc.now, 5*time.Minute, tc.policy)
+			assert.Equal(t, tc.expected, d)
+		})
+	}
+}
+
+func newTestScheduler(t *testing.T, k8sClient *fake.Clientset, now time.Time, launched *[]string) *Scheduler {
+	s, err := NewScheduler(config.Config{
+		K8sClient: k8sClient,
+		Schedules: []config.BackupSchedule{
+			{BackupType: "hourly", Cron: "0 * * * *"},
+			{BackupType: "daily", Cron: "30 2 * * *"},
+		},
+		ScheduleLocation:        time.UTC,
+		CatchUpPolicy:           "once",
+		StartingDeadline:        5 * time.Minute,
+		SchedulerStateConfigMap: "scheduler-state",
+		PodNamespace:            "backups",
+	})
+	assert.NoError(t, err)
+
+	// Launches run in the background
+	var mu sync.Mutex
+	s.now = func() time.Time { return now }
+	s.launch = func(_ context.Context, backupType string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		*launched = append(*launched, backupType)
+		return nil
+	}
+
+	return s
+}
+
+func Test_tick(t *testing.T) {
+	k8sClient := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "scheduler-state", Namespace: "backups"},
+		Data: map[string]string{
+			"hourly": "2025-01-01T01:00:00Z",
+			"daily":  "2025-01-01T00:00:00Z",
+		},
+	})
+
+	var launched []string
+	s := newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 31, 0, 0, time.UTC), &launched)
+
+	assert.NoError(t, s.tick(context.Background()))
+	s.launches.Wait()
+	assert.ElementsMatch(t, []string{"hourly", "daily"}, launched)
+
+	cm, err := k8sClient.CoreV1().ConfigMaps("backups").Get(context.Background(), "scheduler-state", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2025-01-01T02:00:00Z", cm.Data["hourly"])
+	assert.Equal(t, "2025-01-01T02:30:00Z", cm.Data["daily"])
+
+	// The same slots must not be launched twice, e.g. by a new leader
+	launched = nil
+	s = newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 45, 0, 0, time.UTC), &launched)
+	assert.NoError(t, s.tick(context.Background()))
+	s.launches.Wait()
+	assert.Empty(t, launched)
+}
+
+func Test_tickFirstRun(t *testing.T) {
+	k8sClient := fake.NewClientset()
+
+	var launched []string
+	s := newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 31, 0, 0, time.UTC), &launched)
+
+	assert.NoError(t, s.tick(context.Background()))
+	s.launches.Wait()
+	assert.Empty(t, launched, "expected no catch up on the very first run")
+
+	cm, err := k8sClient.CoreV1().ConfigMaps("backups").Get(context.Background(), "scheduler-state", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2025-01-01T02:31:00Z", cm.Data["hourly"])
+}
+
+func Test_tickStateNotSaved(t *testing.T) {
+	k8sClient := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "scheduler-state", Namespace: "backups"},
+		Data:       map[string]string{"hourly": "2025-01-01T01:00:00Z"},
+	})
+	k8sClient.PrependReactor("update", "configmaps", func(k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, errors.New("etcd unavailable")
+	})
+
+	var launched []string
+	s := newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 1, 0, 0, time.UTC), &launched)
+
+	// Nothing is launched if the slot can't be recorded, as the next leader would launch it again
+	assert.ErrorContains(t, s.tick(context.Background()), "recording slots before launching")
+	s.launches.Wait()
+	assert.Empty(t, launched)
+}
+
+func Test_tickStillLaunching(t *testing.T) {
+	k8sClient := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "scheduler-state", Namespace: "backups"},
+		Data: map[string]string{
+			"hourly": "2025-01-01T01:00:00Z",
+			"daily":  "2025-01-01T00:00:00Z",
+		},
+	})
+
+	var launched []string
+	s := newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 31, 0, 0, time.UTC), &launched)
+
+	// The previous hourly launch is still going. Daily is launched without waiting for it, and hourly's slot is still used up
+	s.running["hourly"] = true
+	assert.NoError(t, s.tick(context.Background()))
+	s.launches.Wait()
+	assert.Equal(t, []string{"daily"}, launched)
+
+	cm, err := k8sClient.CoreV1().ConfigMaps("backups").Get(context.Background(), "scheduler-state", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "2025-01-01T02:00:00Z", cm.Data["hourly"])
+}
+
+func Test_runShutdown(t *testing.T) {
+	shutdownTimeout = 100 * time.Millisecond
+
+	k8sClient := fake.NewClientset(&corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "scheduler-state", Namespace: "backups"},
+		Data:       map[string]string{"hourly": "2025-01-01T01:00:00Z"},
+	})
+
+	var launched []string
+	s := newTestScheduler(t, k8sClient, time.Date(2025, 1, 1, 2, 1, 0, 0, time.UTC), &launched)
+	s.conf.Hostname = "scheduler-0"
+	s.conf.LeaseName = "mongodb-backup-launcher"
+	s.conf.HealthAddr = "127.0.0.1:0"
+	s.conf.SchedulerTick = time.Hour
+
+	// The launch only notices leadership has gone through its context, and then never finishes
+	started, stopped, release := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	t.Cleanup(func() { close(release) })
+	s.launch = func(ctx context.Context, _ string) error {
+		close(started)
+		<-ctx.Done()
+		close(stopped)
+		<-release
+		return nil
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+
+	select {
+	case <-started:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the leader to launch the due schedule")
+	}
+
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("expected the launch to be given the leader's context")
+	}
+	assert.ErrorContains(t, <-done, "timed out waiting for running launches to finish")
+}
+
+func Test_runServiceNotLeading(t *testing.T) {
+	s, err := NewScheduler(config.Config{})
+	assert.NoError(t, err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	assert.ErrorContains(t, s.runService(ctx, "hourly"), "no longer leading")
+}
+
+func Test_healthHandler(t *testing.T) {
+	s, err := NewScheduler(config.Config{})
+	assert.NoError(t, err)
+
+	handler := s.healthHandler()
+
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusServiceUnavailable, rec.Code)
+
+	s.ready.Store(true)
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	assert.Equal(t, http.StatusOK, rec.Code)
+}
@@ -0,0 +1,265 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// disruptionTaintKeys are applied by Karpenter to nodes it is about to drain and terminate. karpenter.sh/disruption is the pre-v1 key.
+var disruptionTaintKeys = []string{"karpenter.sh/disrupted", "karpenter.sh/disruption"}
+
+// candidate is a secondary which a backup could be taken from, along with the consistency point it would represent and where it is running.
+type candidate struct {
+	host string
+	cp   consistencyPoint
+
+	// Set by resolveCandidate. node is nil if RBAC doesn't allow reading nodes, and both are nil for members outside the cluster
+	pod          *corev1.Pod
+	node         *corev1.Node
+	az           string
+	zoneResolver string
+	namespace    string
+}
+
+// resolveCandidate finds where the candidate is running, and rejects it if its pod or node is unhealthy or about to go away.
+func (s *Service) resolveCandidate(c *candidate) error {
+	p, err := s.memberPlacement(c.host)
+	if err != nil {
+		return fmt.Errorf("finding which availabilty zone to target: %w", err)
+	}
+
+	pod, node := p.pod, p.node
+	c.pod, c.node, c.az, c.zoneResolver, c.namespace = pod, node, p.az, p.zoneResolver, s.placementNamespace(pod)
+
+	// Members outside the cluster have no pod or node to check
+	if pod == nil {
+		return nil
+	}
+	if err = podEligible(pod); err != nil {
+		return fmt.Errorf("pod %s is not eligible: %w", pod.Name, err)
+	}
+
+	// Without access to nodes only the pod can be checked
+	if node == nil {
+		return nil
+	}
+	if err = nodeEligible(node); err != nil {
+		return fmt.Errorf("node %s is not eligible: %w", node.Name, err)
+	}
+
+	return nil
+}
+
+func podEligible(pod *corev1.Pod) error {
+	if pod.DeletionTimestamp != nil {
+		return fmt.Errorf("terminating")
+	}
+
+	for _, c := range pod.Status.Conditions {
+		if c.Type == corev1.PodReady {
+			if c.Status != corev1.ConditionTrue {
+				return fmt.Errorf("not Ready")
+			}
+			return nil
+		}
+	}
+
+	return fmt.Errorf("not Ready")
+}
+
+// nodeEligible rejects nodes which are going away or in trouble, as a dump against them could run for hours before being cut short.
+func nodeEligible(node *corev1.Node) error {
+	if node.DeletionTimestamp != nil {
+		return fmt.Errorf("being deleted")
+	}
+	if node.Spec.Unschedulable {
+		return fmt.Errorf("cordoned")
+	}
+
+	for _, t := range node.Spec.Taints {
+		if slices.Contains(disruptionTaintKeys, t.Key) {
+			return fmt.Errorf("tainted for disruption (%s)", t.Key)
+		}
+	}
+
+	ready := false
+	for _, c := range node.Status.Conditions {
+		switch c.Type {
+		case corev1.NodeReady:
+			ready = c.Status == corev1.ConditionTrue
+		case corev1.NodeMemoryPressure, corev1.NodeDiskPressure, corev1.NodePIDPressure, corev1.NodeNetworkUnavailable:
+			if c.Status == corev1.ConditionTrue {
+				return fmt.Errorf("has condition %s", c.Type)
+			}
+		}
+	}
+	if !ready {
+		return fmt.Errorf("NotReady")
+	}
+
+	return nil
+}
+
+// launchBackupJob tries each ranked candidate in turn until a backup Job is created against one. A candidate is passed over if its AZ
+// cannot be resolved or its Job cannot be created, and the reasons for every candidate are returned if none succeed.
+func (s *Service) launchBackupJob() (Result, error) {
+	var result Result
+
+	candidates, err := s.replicaCandidates()
+	if err != nil {
+		return result, fmt.Errorf("finding which secondary MongoDB replica to target: %w", err)
+	}
+
+	if err = s.checkPauseAnnotation(candidateHosts(candidates)...); err != nil {
+		return result, err
+	}
+
+	// Before sampling the members' load, so a run which a recent backup already covers doesn't connect to every secondary. Jobs
+	// are created in the members' namespace, or ours for members outside the cluster
+	covering, err := s.checkFreshness(s.memberNamespace(candidates[0].host), candidates[0].cp.ReplicaSet, time.Now())
+	if covering != nil {
+		result.CoveredBy = covering.Namespace + "/" + covering.Name
+	}
+	if err != nil {
+		return result, err
+	}
+
+	candidates, err = s.rankCandidatesByLoad(candidates)
+	if err != nil {
+		return result, fmt.Errorf("finding which secondary MongoDB replica to target: %w", err)
+	}
+
+	var failures []string
+	var triedAZs []string
+
+	for i := 0; i < len(candidates); i++ {
+		c := candidates[i]
+
+		// After a failover, members already rejected or failed over from keep the state, failure and event they were given then
+		if len(triedAZs) > 0 && slices.ContainsFunc(s.candidates, func(cs CandidateState) bool { return cs.Member == c.host }) {
+			continue
+		}
+
+		if err = s.resolveCandidate(&c); err != nil {
+			slog.Warn("Unable to use a candidate. Trying the next one", "host", c.host, "error", err.Error())
+			s.event(nil, corev1.EventTypeWarning, reasonMemberRejected, "member=%s reason=%q", c.host, err.Error())
+			s.recordCandidate(CandidateState{Member: c.host, State: CandidateRejected, AZ: c.az, Reason: err.Error()})
+			failures = append(failures, fmt.Sprintf("%s: %s", c.host, err))
+			continue
+		}
+
+		// Only set after the watchdog finds the backup pod unschedulable, so only ever skips AZs we have failed over from
+		if slices.Contains(triedAZs, c.az) {
+			s.recordCandidate(CandidateState{Member: c.host, State: CandidateRejected, AZ: c.az, Reason: "in an AZ already failed over from"})
+			continue
+		}
+
+		s.event(nil, corev1.EventTypeNormal, reasonAZResolved, "member=%s az=%s resolver=%s", c.host, c.az, c.zoneResolver)
+
+		result = Result{Member: c.host, AZ: c.az, Namespace: c.namespace}
+
+		if err = s.checkNodePool(c.az); err != nil {
+			slog.Warn("The NodePool cannot schedule a job for a candidate. Trying the next one", "host", c.host, "az", c.az, "error", err.Error())
+			s.event(nil, corev1.EventTypeWarning, reasonMemberRejected, "member=%s az=%s reason=%q", c.host, c.az, "NodePool preflight: "+err.Error())
+			s.recordCandidate(CandidateState{Member: c.host, State: CandidateRejected, AZ: c.az, Reason: "NodePool preflight: " + err.Error()})
+			failures = append(failures, fmt.Sprintf("%s: checking the NodePool can schedule the job: %s", c.host, err))
+			continue
+		}
+
+		var hashes map[string]databaseHash
+		if s.conf.VerifyBackups {
+			hashes, err = s.captureDBHash(c.host)
+			if err != nil {
+				return result, fmt.Errorf("capturing dbHash for verification: %w", err)
+			}
+		}
+
+		job, err := s.createJob(c.host, c.az, c.namespace, c.cp)
+		if err != nil {
+			slog.Warn("Unable to create a job for a candidate. Trying the next one", "host", c.host, "error", err.Error())
+			s.event(nil, corev1.EventTypeWarning, reasonJobCreateFailed, "member=%s az=%s error=%q", c.host, c.az, err.Error())
+			s.recordCandidate(CandidateState{Member: c.host, State: CandidateRejected, AZ: c.az, Reason: "creating job: " + err.Error()})
+			failures = append(failures, fmt.Sprintf("%s: creating job: %s", c.host, err))
+			continue
+		}
+		result.JobName = job.Name
+		result.JobUID = string(job.UID)
+
+		s.event(job, corev1.EventTypeNormal, reasonMemberSelected, "member=%s az=%s rank=%d", c.host, c.az, i+1)
+		s.event(job, corev1.EventTypeNormal, reasonJobCreated, "job=%s namespace=%s member=%s az=%s", job.Name, job.Namespace, c.host, c.az)
+		s.recordCandidate(CandidateState{Member: c.host, State: CandidateSelected, AZ: c.az, ZoneResolver: c.zoneResolver})
+
+		if s.conf.UnschedulableTimeout > 0 {
+			unschedulable, err := s.jobUnschedulable(job)
+			if err != nil {
+				return result, fmt.Errorf("watching the backup pod is scheduled: %w", err)
+			}
+
+			if unschedulable {
+				s.event(job, corev1.EventTypeWarning, reasonFailedOver, "job=%s member=%s az=%s reason=%q", job.Name, c.host, c.az, "backup pod unschedulable")
+				s.recordCandidate(CandidateState{Member: c.host, State: CandidateFailedOver, AZ: c.az, Reason: "backup pod unschedulable"})
+
+				if err = s.deleteJob(job); err != nil {
+					return result, err
+				}
+				triedAZs = append(triedAZs, c.az)
+				failures = append(failures, fmt.Sprintf("%s: backup pod unschedulable in %s", c.host, c.az))
+
+				candidates, err = s.reloadCandidates()
+				if err != nil {
+					return result, fmt.Errorf("failing over to another AZ: %w", err)
+				}
+				i = -1
+
+				slog.Warn("Failing over the backup to a secondary in another AZ. This may incur cross-AZ data transfer costs", "triedAZs", strings.Join(triedAZs, ","))
+				continue
+			}
+		}
+
+		// Members already tried before a failover keep the state they were given then
+		for _, other := range candidates[i+1:] {
+			if !slices.ContainsFunc(s.candidates, func(cs CandidateState) bool { return cs.Member == other.host }) {
+				s.recordCandidate(CandidateState{Member: other.host, State: CandidateNotTried})
+			}
+		}
+
+		s.holdSource(c, job)
+
+		if s.conf.VerifyBackups {
+			return result, s.verifyBackup(job, c.host, c.az, hashes)
+		}
+
+		return result, nil
+	}
+
+	return result, fmt.Errorf("no candidate secondary could be used: %s", strings.Join(failures, "; "))
+}
+
+// reloadCandidates starts a failover again from a fresh replica set status, as the consistency point has moved on while we waited.
+// It goes through the same pause and load checks as the first pass.
+func (s *Service) reloadCandidates() ([]candidate, error) {
+	candidates, err := s.replicaCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	if err = s.checkPauseAnnotation(candidateHosts(candidates)...); err != nil {
+		return nil, err
+	}
+
+	return s.rankCandidatesByLoad(candidates)
+}
+
+func candidateHosts(candidates []candidate) []string {
+	hosts := make([]string, 0, len(candidates))
+	for _, c := range candidates {
+		hosts = append(hosts, c.host)
+	}
+
+	return hosts
+}
@@ -0,0 +1,169 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// healthyPod is a Ready MongoDB pod, so it passes the candidate eligibility checks.
+func healthyPod(name, nodeName string) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: "database"},
+		Spec:       v1.PodSpec{NodeName: nodeName},
+		Status:     v1.PodStatus{Conditions: []v1.PodCondition{{Type: v1.PodReady, Status: v1.ConditionTrue}}},
+	}
+}
+
+// healthyNode is a Ready node in the AZ, or without a zone label if az is empty.
+func healthyNode(name, az string) *v1.Node {
+	node := &v1.Node{
+		ObjectMeta: metav1.ObjectMeta{Name: name},
+		Status:     v1.NodeStatus{Conditions: []v1.NodeCondition{{Type: v1.NodeReady, Status: v1.ConditionTrue}}},
+	}
+	if az != "" {
+		node.Labels = map[string]string{azWellKnownLabel: az}
+	}
+
+	return node
+}
+
+func Test_mongoDBReadReplicaCandidatesRanking(t *testing.T) {
+	s := Service{
+		conf: config.Config{
+			MongoDBClient: newMockReplicaSet([]member{
+				{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 100, I: 1}}},
+				{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "PRIMARY", Optime: optime{TS: bson.Timestamp{T: 200, I: 1}}},
+				{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 190, I: 1}}},
+				{Name: "mongodb-3.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 100, I: 1}}},
+			}),
+		},
+	}
+
+	candidates, err := s.mongoDBReadReplicaCandidates()
+	assert.NoError(t, err)
+
+	var hosts []string
+	for _, c := range candidates {
+		hosts = append(hosts, c.host)
+	}
+	assert.Equal(t, []string{
+		"mongodb-2.mongodb.database.svc.cluster.local",
+		"mongodb-0.mongodb.database.svc.cluster.local",
+		"mongodb-3.mongodb.database.svc.cluster.local",
+	}, hosts, "expected the least lagged member first, then replica set order")
+}
+
+func Test_launchBackupJobFallback(t *testing.T) {
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+
+	// mongodb-1 is on a node without a zone label, and mongodb-2's pod has been rescheduled onto a node which no longer exists
+	tests := []struct {
+		name     string
+		node2    string
+		expected string
+	}{
+		{name: "FallsBackToNextCandidate", node2: "node2", expected: "mongodb-2.mongodb.database.svc.cluster.local"},
+		{name: "NoCandidateResolves", node2: "missing-node"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := withGeneratedNames(fake.NewClientset(
+				healthyPod("mongodb-1", "no-az-label"),
+				healthyPod("mongodb-2", tc.node2),
+				healthyNode("no-az-label", ""),
+				healthyNode("node2", "eu-west-1b"),
+			))
+
+			s := Service{
+				conf: config.Config{
+					MongoDBClient: newMockReplicaSet(members),
+					K8sClient:     k8sClient,
+					BackupType:    "daily",
+				},
+			}
+
+			result, err := s.Launch()
+
+			jobs, listErr := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+			assert.NoError(t, listErr)
+
+			if tc.expected == "" {
+				assert.ErrorContains(t, err, "mongodb-1.mongodb.database.svc.cluster.local: finding which availabilty zone to target: unable to find the AZ of member mongodb-1.mongodb.database.svc.cluster.local")
+				assert.ErrorContains(t, err, "mongodb-2.mongodb.database.svc.cluster.local: finding which availabilty zone to target: unable to find node missing-node")
+				assert.Empty(t, jobs.Items)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, result.Member)
+			assert.Equal(t, "eu-west-1b", result.AZ)
+			assert.Len(t, jobs.Items, 1)
+		})
+	}
+}
+
+func Test_resolveCandidateEligibility(t *testing.T) {
+	now := metav1.Now()
+
+	tests := []struct {
+		name        string
+		pod         func(*v1.Pod)
+		node        func(*v1.Node)
+		expectedErr string
+	}{
+		{name: "Healthy"},
+		{name: "PodNotReady", pod: func(p *v1.Pod) { p.Status.Conditions[0].Status = v1.ConditionFalse }, expectedErr: "pod mongodb-1 is not eligible: not Ready"},
+		{name: "PodWithoutConditions", pod: func(p *v1.Pod) { p.Status.Conditions = nil }, expectedErr: "pod mongodb-1 is not eligible: not Ready"},
+		{name: "PodTerminating", pod: func(p *v1.Pod) { p.DeletionTimestamp = &now }, expectedErr: "pod mongodb-1 is not eligible: terminating"},
+		{name: "NodeNotReady", node: func(n *v1.Node) { n.Status.Conditions[0].Status = v1.ConditionUnknown }, expectedErr: "node node1 is not eligible: NotReady"},
+		{name: "NodeCordoned", node: func(n *v1.Node) { n.Spec.Unschedulable = true }, expectedErr: "node node1 is not eligible: cordoned"},
+		{name: "NodeDiskPressure", node: func(n *v1.Node) {
+			n.Status.Conditions = append(n.Status.Conditions, v1.NodeCondition{Type: v1.NodeDiskPressure, Status: v1.ConditionTrue})
+		}, expectedErr: "node node1 is not eligible: has condition DiskPressure"},
+		{name: "NodeDisrupted", node: func(n *v1.Node) {
+			n.Spec.Taints = []v1.Taint{{Key: "karpenter.sh/disrupted", Effect: v1.TaintEffectNoSchedule}}
+		}, expectedErr: "node node1 is not eligible: tainted for disruption (karpenter.sh/disrupted)"},
+		{name: "UnrelatedTaint", node: func(n *v1.Node) {
+			n.Spec.Taints = []v1.Taint{{Key: "mongodb", Value: "true", Effect: v1.TaintEffectNoSchedule}}
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := healthyPod("mongodb-1", "node1")
+			if tc.pod != nil {
+				tc.pod(pod)
+			}
+			node := healthyNode("node1", "eu-west-1a")
+			if tc.node != nil {
+				tc.node(node)
+			}
+
+			s := Service{conf: config.Config{K8sClient: fake.NewClientset(pod, node)}}
+
+			c := candidate{host: "mongodb-1.mongodb.database.svc.cluster.local"}
+			err := s.resolveCandidate(&c)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, "eu-west-1a", c.az)
+			assert.Equal(t, "node1", c.node.Name)
+		})
+	}
+}
@@ -0,0 +1,107 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"sync"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+)
+
+// eventComponent is the source recorded on every Event the launcher emits.
+const eventComponent = "mongodb-backup-launcher"
+
+// Event reasons, so `kubectl get events --field-selector reason=<reason>` finds one kind of decision.
+const (
+	reasonMemberRejected  = "MemberRejected"
+	reasonAZResolved      = "AZResolved"
+	reasonMemberSelected  = "MemberSelected"
+	reasonJobCreated      = "JobCreated"
+	reasonJobCreateFailed = "JobCreateFailed"
+	reasonFailedOver      = "FailedOver"
+	reasonLaunchFailed    = "LaunchFailed"
+	reasonLaunchSkipped   = "LaunchSkipped"
+	reasonLaunchDeferred  = "LaunchDeferred"
+	reasonUnlockFailed    = "FsyncUnlockFailed"
+)
+
+// eventFlushTimeout bounds how long a launch waits for its Events to be written before returning.
+const eventFlushTimeout = 5 * time.Second
+
+// startEvents creates an EventRecorder for a single launch, returning a func which waits for every recorded Event to be written and
+// then stops it. Events are written as they are recorded, rather than batched, so a one-shot launcher doesn't exit before they are sent.
+func (s *Service) startEvents() func() {
+	if s.recorder != nil || !s.conf.LaunchEvents || s.conf.PodName == "" {
+		return func() {}
+	}
+
+	sink := &typedcorev1.EventSinkImpl{Interface: s.conf.K8sClient.CoreV1().Events("")}
+	pending := &sync.WaitGroup{}
+
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartEventWatcher(func(e *corev1.Event) {
+		defer pending.Done()
+
+		if _, err := sink.Create(e); err != nil {
+			slog.Warn("Unable to record event", "reason", e.Reason, "object", e.InvolvedObject.Name, "error", err.Error())
+		}
+	})
+
+	s.recorder = &pendingRecorder{
+		EventRecorder: broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent}),
+		pending:       pending,
+	}
+
+	return func() {
+		done := make(chan struct{})
+		go func() {
+			pending.Wait()
+			close(done)
+		}()
+
+		select {
+		case <-done:
+		case <-time.After(eventFlushTimeout):
+			slog.Warn("Timed out waiting for events to be recorded")
+		}
+
+		broadcaster.Shutdown()
+		s.recorder = nil
+	}
+}
+
+// pendingRecorder counts the Events recorded but not yet written, so they can be waited for.
+type pendingRecorder struct {
+	record.EventRecorder
+	pending *sync.WaitGroup
+}
+
+func (r *pendingRecorder) Eventf(object runtime.Object, eventType, reason, messageFmt string, args ...interface{}) {
+	r.pending.Add(1)
+	r.EventRecorder.Eventf(object, eventType, reason, messageFmt, args...)
+}
+
+// launcherRef refers to the launcher's own Pod, which every Event is recorded against.
+func (s *Service) launcherRef() *corev1.ObjectReference {
+	return &corev1.ObjectReference{APIVersion: "v1", Kind: "Pod", Namespace: s.conf.PodNamespace, Name: s.conf.PodName}
+}
+
+// event records an Event on the launcher's Pod and, once it exists, the backup Job. Messages are space separated key=value pairs.
+func (s *Service) event(job *batchv1.Job, eventType, reason, messageFmt string, args ...interface{}) {
+	if s.recorder == nil {
+		return
+	}
+
+	message := fmt.Sprintf(messageFmt, args...)
+
+	s.recorder.Eventf(s.launcherRef(), eventType, reason, "%s", message)
+	if job != nil {
+		s.recorder.Eventf(job, eventType, reason, "%s", message)
+	}
+}
@@ -0,0 +1,105 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/tools/record"
+)
+
+func Test_launchEvents(t *testing.T) {
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-3.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+
+	k8sClient := withGeneratedNames(fake.NewClientset(
+		healthyPod("mongodb-1", "no-az-label"),
+		healthyPod("mongodb-2", "node2"),
+		healthyNode("no-az-label", ""),
+		healthyNode("node2", "eu-west-1b"),
+	))
+	recorder := record.NewFakeRecorder(20)
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient:  newMockReplicaSet(members),
+			K8sClient:      k8sClient,
+			BackupType:     "daily",
+			ExcludeReplica: "mongodb-3.mongodb.database.svc.cluster.local",
+		},
+		recorder: recorder,
+	}
+
+	result, err := s.Launch()
+	assert.NoError(t, err)
+	close(recorder.Events)
+
+	var events []string
+	for e := range recorder.Events {
+		events = append(events, e)
+	}
+
+	// Events after the Job is created are recorded against both the launcher Pod and the Job
+	assert.Equal(t, []string{
+		`Normal MemberRejected member=mongodb-3.mongodb.database.svc.cluster.local reason="excluded by EXCLUDE_REPLICA"`,
+		`Warning MemberRejected member=mongodb-1.mongodb.database.svc.cluster.local reason="finding which availabilty zone to target: unable to find the AZ of member mongodb-1.mongodb.database.svc.cluster.local. Tried the 'topology.kubernetes.io/zone' label on node no-az-label, 'topology.kubernetes.io/zone' label on pod mongodb-1, ZONE_MAP"`,
+		`Normal AZResolved member=mongodb-2.mongodb.database.svc.cluster.local az=eu-west-1b resolver=node-label`,
+		`Normal MemberSelected member=mongodb-2.mongodb.database.svc.cluster.local az=eu-west-1b rank=2`,
+		`Normal MemberSelected member=mongodb-2.mongodb.database.svc.cluster.local az=eu-west-1b rank=2`,
+		`Normal JobCreated job=` + result.JobName + ` namespace=database member=mongodb-2.mongodb.database.svc.cluster.local az=eu-west-1b`,
+		`Normal JobCreated job=` + result.JobName + ` namespace=database member=mongodb-2.mongodb.database.svc.cluster.local az=eu-west-1b`,
+	}, events)
+}
+
+func Test_launchEventsFailure(t *testing.T) {
+	recorder := record.NewFakeRecorder(5)
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient: newMockReplicaSet([]member{{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"}}),
+			K8sClient:     fake.NewClientset(),
+		},
+		recorder: recorder,
+	}
+
+	_, err := s.Launch()
+	assert.Error(t, err)
+	assert.Contains(t, <-recorder.Events, "Warning LaunchFailed member= error=")
+}
+
+func Test_startEvents(t *testing.T) {
+	k8sClient := fake.NewClientset()
+
+	s := Service{
+		conf: config.Config{
+			K8sClient:    k8sClient,
+			LaunchEvents: true,
+			PodName:      "launcher-abc",
+			PodNamespace: "backups",
+		},
+	}
+
+	stop := s.startEvents()
+	s.event(nil, v1.EventTypeNormal, reasonMemberSelected, "member=%s", "mongodb-1")
+	stop()
+
+	// Every Event is written by the time the launch returns
+	events, err := k8sClient.CoreV1().Events("backups").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	if assert.Len(t, events.Items, 1) {
+		assert.Equal(t, reasonMemberSelected, events.Items[0].Reason)
+		assert.Equal(t, "member=mongodb-1", events.Items[0].Message)
+		assert.Equal(t, "launcher-abc", events.Items[0].InvolvedObject.Name)
+		assert.Equal(t, eventComponent, events.Items[0].Source.Component)
+	}
+	assert.Nil(t, s.recorder)
+}
@@ -0,0 +1,86 @@
+package service
+
+import (
+	"context"
+	"log/slog"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// freezeMember stops the member standing for election while it is being backed up, so a dump never ends up loading a newly elected primary.
+// The freeze is renewed at half its duration, so it expires on its own if the launcher dies. The returned function stops renewing and,
+// if release is true, unfreezes the member.
+func (s *Service) freezeMember(host string) func(release bool) {
+	if s.conf.MemberFreezeDuration == 0 {
+		return func(bool) {}
+	}
+
+	member, err := s.conf.MongoDBMemberConnector.ConnectToMember(context.Background(), host)
+	if err != nil {
+		slog.Warn("Unable to connect to the member to freeze it against elections", "host", host, "error", err.Error())
+		return func(bool) {}
+	}
+
+	disconnect := func() {
+		if err := member.Disconnect(context.Background()); err != nil {
+			slog.Warn("disconnecting from member", "host", host, "error", err.Error())
+		}
+	}
+
+	seconds := int(s.conf.MemberFreezeDuration.Seconds())
+	if err = replSetFreeze(member, seconds); err != nil {
+		slog.Warn("Unable to freeze the member against elections", "host", host, "error", err.Error())
+		disconnect()
+		return func(bool) {}
+	}
+	slog.Info("Froze the member against elections until the backup finishes", "host", host, "seconds", seconds)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+
+		ticker := time.NewTicker(s.conf.MemberFreezeDuration / 2)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if err := replSetFreeze(member, seconds); err != nil {
+					slog.Warn("Unable to renew the member's freeze against elections", "host", host, "error", err.Error())
+					continue
+				}
+				slog.Debug("Renewed the member's freeze against elections", "host", host, "seconds", seconds)
+			}
+		}
+	}()
+
+	return func(release bool) {
+		close(stop)
+		<-done
+		defer disconnect()
+
+		if !release {
+			return
+		}
+
+		if err := replSetFreeze(member, 0); err != nil {
+			slog.Warn("Unable to unfreeze the member. It will unfreeze once the freeze expires", "host", host, "error", err.Error())
+			return
+		}
+		slog.Info("Unfroze the member", "host", host)
+	}
+}
+
+// replSetFreeze with 0 seconds unfreezes the member. https://www.mongodb.com/docs/manual/reference/command/replSetFreeze/
+func replSetFreeze(member config.MongoDBClient, seconds int) error {
+	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
+	defer cancel()
+
+	return runMemberCommand(ctx, member, bson.D{{Key: "replSetFreeze", Value: seconds}})
+}
@@ -0,0 +1,82 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+func Test_holdSourceFreeze(t *testing.T) {
+	jobPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name            string
+		jobRuns         time.Duration
+		expectedRelease bool
+	}{
+		// Long enough for the freeze to be renewed at half its duration
+		{name: "RenewedAndReleased", jobRuns: 1200 * time.Millisecond, expectedRelease: true},
+		{name: "LeftToExpire", jobRuns: time.Hour, expectedRelease: false},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "targeted-mongodb-backups-00001", Namespace: "database"}}
+			k8sClient := fake.NewClientset(job)
+
+			started := time.Now()
+			k8sClient.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				j := job.DeepCopy()
+				if time.Since(started) > tc.jobRuns {
+					j.Status.Conditions = []batchv1.JobCondition{{Type: batchv1.JobComplete, Status: v1.ConditionTrue}}
+				}
+				return true, j, nil
+			})
+
+			member := newMockMember()
+			connector := new(mockMemberConnector)
+			connector.On("ConnectToMember", mock.Anything, "mongodb-1.mongodb.database.svc.cluster.local").Return(member, nil)
+
+			s := Service{conf: config.Config{
+				K8sClient:              k8sClient,
+				MongoDBMemberConnector: connector,
+				MemberFreezeDuration:   2 * time.Second,
+				JobWaitTimeout:         1500 * time.Millisecond,
+			}}
+
+			s.holdSource(candidate{host: "mongodb-1.mongodb.database.svc.cluster.local"}, job)
+
+			var freezes, releases int
+			for _, call := range member.Calls {
+				if call.Method != "RunCommand" {
+					continue
+				}
+				switch call.Arguments.Get(1).(bson.D)[0].Value {
+				case 2:
+					freezes++
+				case 0:
+					releases++
+				}
+			}
+
+			assert.GreaterOrEqual(t, freezes, 2, "expected the freeze to be applied and renewed")
+			if tc.expectedRelease {
+				assert.Equal(t, 1, releases, "expected the member to be unfrozen once the job finished")
+			} else {
+				assert.Zero(t, releases, "expected the freeze to be left to expire while the job may still be running")
+			}
+			member.AssertCalled(t, "Disconnect", mock.Anything)
+		})
+	}
+}
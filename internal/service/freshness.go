@@ -0,0 +1,75 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// backupTiers orders the backup types, so a backup covers any run of its own or a lower tier.
+var backupTiers = map[string]int{
+	"hourly": 1,
+	"daily":  2,
+}
+
+// checkFreshness skips the launch if a backup Job of an equal or higher tier, for the same replica set, succeeded within
+// FRESHNESS_WINDOW. The covering Job is returned so the skip can refer to it.
+func (s *Service) checkFreshness(namespace, replicaSet string, now time.Time) (*batchv1.Job, error) {
+	if s.conf.FreshnessWindow <= 0 {
+		return nil, nil
+	}
+
+	selector := labels.SelectorFromSet(map[string]string{"app": "mongodb-backups"})
+	jobs, err := s.conf.K8sClient.BatchV1().Jobs(namespace).List(context.Background(), metav1.ListOptions{LabelSelector: selector.String()})
+	if err != nil {
+		return nil, fmt.Errorf("listing backup jobs to check freshness: %w", err)
+	}
+
+	covering := coveringJob(jobs.Items, s.conf.BackupType, replicaSet, now.Add(-s.conf.FreshnessWindow))
+	if covering == nil {
+		slog.Debug("No recent backup covers this run", "backupType", s.conf.BackupType, "window", s.conf.FreshnessWindow)
+		return nil, nil
+	}
+
+	return covering, fmt.Errorf("%w: covered by %s backup job %s/%s which completed at %s, within FRESHNESS_WINDOW %s", ErrSkipped,
+		covering.Labels["backup-type"], covering.Namespace, covering.Name, covering.Status.CompletionTime.UTC().Format(time.RFC3339), s.conf.FreshnessWindow)
+}
+
+// coveringJob returns the most recently completed Job which succeeded since the cutoff, is of an equal or higher tier than
+// backupType, and was taken from the replica set. Jobs whose verification failed don't count.
+func coveringJob(jobs []batchv1.Job, backupType, replicaSet string, cutoff time.Time) *batchv1.Job {
+	tier, found := backupTiers[backupType]
+	if !found {
+		return nil
+	}
+
+	var covering *batchv1.Job
+	for i := range jobs {
+		job := &jobs[i]
+
+		if jobTier, found := backupTiers[job.Labels["backup-type"]]; !found || jobTier < tier {
+			continue
+		}
+		verification := job.Labels[verificationLabel]
+		if job.Annotations["mongodb-replica-set"] != replicaSet || verification == "failed" || verification == "unverified" {
+			continue
+		}
+		if _, succeeded := jobFinished(job); !succeeded || job.Status.CompletionTime == nil {
+			continue
+		}
+		if job.Status.CompletionTime.Time.Before(cutoff) {
+			continue
+		}
+
+		if covering == nil || job.Status.CompletionTime.After(covering.Status.CompletionTime.Time) {
+			covering = job
+		}
+	}
+
+	return covering
+}
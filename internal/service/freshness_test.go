@@ -0,0 +1,143 @@
+package service
+
+import (
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+// finishedBackupJob is a backup Job for the rs0 replica set which finished at completed.
+func finishedBackupJob(name, backupType string, completed time.Time, succeeded bool) *batchv1.Job {
+	condition := batchv1.JobComplete
+	if !succeeded {
+		condition = batchv1.JobFailed
+	}
+
+	return &batchv1.Job{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        name,
+			Namespace:   "database",
+			Labels:      map[string]string{"app": "mongodb-backups", "backup-type": backupType},
+			Annotations: map[string]string{"mongodb-replica-set": "rs0"},
+		},
+		Status: batchv1.JobStatus{
+			Conditions:     []batchv1.JobCondition{{Type: condition, Status: v1.ConditionTrue}},
+			CompletionTime: &metav1.Time{Time: completed},
+		},
+	}
+}
+
+func Test_coveringJob(t *testing.T) {
+	now := time.Date(2025, 5, 1, 12, 0, 0, 0, time.UTC)
+	cutoff := now.Add(-time.Hour)
+
+	otherReplicaSet := finishedBackupJob("other-rs", "daily", now.Add(-time.Minute), true)
+	otherReplicaSet.Annotations["mongodb-replica-set"] = "rs1"
+	verificationFailed := finishedBackupJob("verification-failed", "daily", now.Add(-time.Minute), true)
+	verificationFailed.Labels[verificationLabel] = "failed"
+	unverified := finishedBackupJob("unverified", "daily", now.Add(-time.Minute), true)
+	unverified.Labels[verificationLabel] = "unverified"
+
+	tests := []struct {
+		name       string
+		backupType string
+		jobs       []*batchv1.Job
+		expected   string
+	}{
+		{name: "NoJobs", backupType: "hourly"},
+		{name: "DailyCoversHourly", backupType: "hourly", jobs: []*batchv1.Job{finishedBackupJob("daily", "daily", now.Add(-10*time.Minute), true)}, expected: "daily"},
+		{name: "HourlyCoversHourly", backupType: "hourly", jobs: []*batchv1.Job{finishedBackupJob("hourly", "hourly", now.Add(-10*time.Minute), true)}, expected: "hourly"},
+		{name: "HourlyDoesNotCoverDaily", backupType: "daily", jobs: []*batchv1.Job{finishedBackupJob("hourly", "hourly", now.Add(-10*time.Minute), true)}},
+		{name: "OutsideWindow", backupType: "hourly", jobs: []*batchv1.Job{finishedBackupJob("daily", "daily", now.Add(-61*time.Minute), true)}},
+		{name: "Failed", backupType: "hourly", jobs: []*batchv1.Job{finishedBackupJob("daily", "daily", now.Add(-10*time.Minute), false)}},
+		{name: "OtherReplicaSet", backupType: "hourly", jobs: []*batchv1.Job{otherReplicaSet}},
+		{name: "VerificationFailed", backupType: "hourly", jobs: []*batchv1.Job{verificationFailed}},
+		{name: "Unverified", backupType: "hourly", jobs: []*batchv1.Job{unverified}},
+		{name: "MostRecent", backupType: "hourly", jobs: []*batchv1.Job{
+			finishedBackupJob("older", "hourly", now.Add(-50*time.Minute), true),
+			finishedBackupJob("newer", "daily", now.Add(-5*time.Minute), true),
+		}, expected: "newer"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var jobs []batchv1.Job
+			for _, j := range tc.jobs {
+				jobs = append(jobs, *j)
+			}
+
+			covering := coveringJob(jobs, tc.backupType, "rs0", cutoff)
+			if tc.expected == "" {
+				assert.Nil(t, covering)
+				return
+			}
+			if assert.NotNil(t, covering) {
+				assert.Equal(t, tc.expected, covering.Name)
+			}
+		})
+	}
+}
+
+func Test_launchSkippedWhenFresh(t *testing.T) {
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+	completed := time.Now().Add(-10 * time.Minute)
+
+	// The mock replica set has no name, so neither does the covering job
+	daily := finishedBackupJob("targeted-mongodb-backups-daily", "daily", completed, true)
+	daily.Annotations["mongodb-replica-set"] = ""
+
+	// The launcher runs outside the members' namespace, which is where the backup Jobs are. The member connector has no expectations, so sampling the members' load would fail the test
+	connector := new(mockMemberConnector)
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient:          newMockReplicaSet(members),
+			MongoDBMemberConnector: connector,
+			K8sClient:              fake.NewClientset(healthyPod("mongodb-1", "node1"), healthyNode("node1", "eu-west-1a"), daily),
+			BackupType:             "hourly",
+			PodNamespace:           "backups",
+			FreshnessWindow:        time.Hour,
+			LoadAware:              true,
+		},
+	}
+
+	result, err := s.Launch()
+	assert.ErrorIs(t, err, ErrSkipped)
+	assert.ErrorContains(t, err, "covered by daily backup job database/targeted-mongodb-backups-daily")
+	assert.Equal(t, "database/targeted-mongodb-backups-daily", result.CoveredBy)
+	assert.Empty(t, result.JobName)
+	connector.AssertNotCalled(t, "ConnectToMember", mock.Anything, mock.Anything)
+}
+
+func Test_createJobFreshnessTTL(t *testing.T) {
+	tests := []struct {
+		name     string
+		window   time.Duration
+		expected int32
+	}{
+		{name: "Default", expected: 900},
+		{name: "ShortWindow", window: 10 * time.Minute, expected: 900},
+		{name: "LongWindow", window: 2 * time.Hour, expected: 7200},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s := Service{conf: config.Config{K8sClient: fake.NewClientset(), BackupType: "daily", FreshnessWindow: tc.window}}
+
+			job, err := s.createJob("mongodb-1.mongodb.database.svc.cluster.local", "eu-west-1a", "database", consistencyPoint{})
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expected, *job.Spec.TTLSecondsAfterFinished)
+		})
+	}
+}
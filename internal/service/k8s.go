@@ -1,11 +1,15 @@
 package service
 
 import (
-	"context"
 	"fmt"
 	"log/slog"
+	"maps"
+	"slices"
+	"strconv"
 	"strings"
+	"time"
 
+	"go.opentelemetry.io/otel/attribute"
 	batchv1 "k8s.io/api/batch/v1"
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/api/errors"
@@ -14,62 +18,273 @@ import (
 	"k8s.io/utils/pointer"
 )
 
-const azWellKnownLabel = "topology.kubernetes.io/zone"
+// Objects every backup and restore Job references, which must exist in the MongoDB namespace. render-install creates them with these names.
+const (
+	JobServiceAccount        = "backups"
+	JobConfigMap             = "backups"
+	MongoDBSecret            = "mongodb"
+	MongoDBSecretUsernameKey = "username"
+	MongoDBSecretPasswordKey = "password"
+)
 
-func (s *Service) availabilityZoneToTarget(replicaHostPath string) (string, string, error) {
+const (
+	azWellKnownLabel = "topology.kubernetes.io/zone"
+
+	// Taint on the dedicated backups NodePool, which the backup Jobs tolerate
+	backupTaintKey = "mongodb-backups"
+
+	defaultNodePool = "backups"
+)
+
+// memberPodName splits a K8s headless service hostname (<pod>.<service>.<namespace>...) into the pod name and namespace.
+func memberPodName(replicaHostPath string) (string, string, error) {
 	parts := strings.Split(replicaHostPath, ".")
 	if len(parts) < 3 {
 		return "", "", fmt.Errorf("expects the replica host name to be a K8s headless service and have at least 3 domain parts")
 	}
-	podName := parts[0]
-	namespace := parts[2]
+
+	return parts[0], parts[2], nil
+}
+
+// replicaPod finds the pod behind a replica set member, based on its K8s headless service hostname.
+func (s *Service) replicaPod(replicaHostPath string) (*corev1.Pod, error) {
+	podName, namespace, err := memberPodName(replicaHostPath)
+	if err != nil {
+		return nil, err
+	}
 
 	slog.Debug("Finding pod in namespace", "pod", podName, "namespace", namespace)
 
-	// Find the pod and node it is running on
-	pod, err := s.conf.K8sClient.CoreV1().Pods(namespace).Get(context.Background(), podName, metav1.GetOptions{})
+	ctx, span := s.startSpan("k8s.pod.get", attrMember.String(replicaHostPath), attrNamespace.String(namespace))
+	pod, err := s.conf.K8sClient.CoreV1().Pods(namespace).Get(ctx, podName, metav1.GetOptions{})
+	endSpan(span, err)
 	if errors.IsNotFound(err) {
-		return "", "", fmt.Errorf("unable to find pod %s in namespace %s based on hostname %s: %w", podName, namespace, replicaHostPath, err)
+		return nil, fmt.Errorf("unable to find pod %s in namespace %s based on hostname %s: %w", podName, namespace, replicaHostPath, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding pod: %w", err)
 	}
+
+	return pod, nil
+}
+
+func (s *Service) availabilityZoneToTarget(replicaHostPath string) (string, string, error) {
+	p, err := s.memberPlacement(replicaHostPath)
 	if err != nil {
-		return "", "", fmt.Errorf("finding pod: %w", err)
+		return "", "", err
 	}
+	namespace := s.placementNamespace(p.pod)
+
+	slog.Debug("Target AZ", "az", p.az, "resolver", p.zoneResolver)
+	slog.Debug("Target namespace", "namespace", namespace)
+
+	return p.az, namespace, nil
+}
+
+// placement is where a member is running. pod is nil for members outside the cluster, and node is nil for those and when RBAC
+// doesn't allow reading nodes. zoneResolver names the resolver which found the AZ.
+type placement struct {
+	pod          *corev1.Pod
+	node         *corev1.Node
+	az           string
+	zoneResolver string
+}
+
+// memberPlacement finds the pod behind a replica set member, the node it is running on and its AZ.
+// Members outside the cluster have no pod, so only the resolvers which don't need one can place them.
+func (s *Service) memberPlacement(replicaHostPath string) (placement, error) {
+	// Hosts which aren't headless service hostnames can't have a pod, so aren't looked up
+	if !clusterHostname(replicaHostPath) {
+		az, resolver, source, tried := s.resolveZone(ZoneQuery{Host: replicaHostPath})
+		if az == "" {
+			return placement{}, fmt.Errorf("unable to find the AZ of member %s, which is outside the cluster. Tried the %s", replicaHostPath, strings.Join(tried, ", "))
+		}
+		slog.Debug("Member is outside the cluster. Placed it from a zone resolver which doesn't need a pod", "host", replicaHostPath, "az", az, "resolver", resolver, "source", source)
 
-	nodeName := pod.Spec.NodeName
-	slog.Debug("Pod is running on node", "pod", podName, "node", nodeName)
+		return placement{az: az, zoneResolver: resolver}, nil
+	}
 
-	// Find the node and which AZ it is in
-	node, err := s.conf.K8sClient.CoreV1().Nodes().Get(context.Background(), nodeName, metav1.GetOptions{})
+	// Find the pod and node it is running on. A member in another cluster has a headless service hostname but no pod here
+	pod, err := s.replicaPod(replicaHostPath)
 	if errors.IsNotFound(err) {
-		return "", "", fmt.Errorf("unable to find node %s: %w", nodeName, err)
+		az, resolver, source, _ := s.resolveZone(ZoneQuery{Host: replicaHostPath})
+		if az == "" {
+			return placement{}, err
+		}
+		slog.Debug("Member has no pod. Placing it from a zone resolver which doesn't need one", "host", replicaHostPath, "az", az, "resolver", resolver, "source", source)
+
+		return placement{az: az, zoneResolver: resolver}, nil
+	}
+	if err != nil {
+		return placement{}, err
 	}
+	slog.Debug("Pod is running on node", "pod", pod.Name, "node", pod.Spec.NodeName)
+
+	node, err := s.memberNode(pod)
 	if err != nil {
-		return "", "", fmt.Errorf("finding node: %w", err)
+		return placement{}, err
 	}
 
-	az, found := node.Labels[azWellKnownLabel]
-	if !found {
-		return "", "", fmt.Errorf("unable to find AZ well known label '%s' on node %s", azWellKnownLabel, nodeName)
+	az, resolver, source, tried := s.resolveZone(ZoneQuery{Host: replicaHostPath, Pod: pod, Node: node})
+	if az == "" {
+		return placement{}, fmt.Errorf("unable to find the AZ of member %s. Tried the %s", replicaHostPath, strings.Join(tried, ", "))
 	}
+	slog.Debug("Found member AZ", "host", replicaHostPath, "az", az, "resolver", resolver, "source", source)
 
-	slog.Debug("Target AZ", "az", az)
-	slog.Debug("Target namespace", "namespace", namespace)
+	return placement{pod: pod, node: node, az: az, zoneResolver: resolver}, nil
+}
+
+// placementNamespace is the namespace to create a member's Jobs in: its pod's, or the launcher's own for members outside the cluster.
+func (s *Service) placementNamespace(pod *corev1.Pod) string {
+	if pod == nil {
+		return s.conf.PodNamespace
+	}
+
+	return pod.Namespace
+}
+
+// memberNode gets the node the pod is running on. Reading nodes needs a ClusterRole, so if RBAC forbids it nil is returned and
+// the AZ comes from the other zone resolvers instead.
+func (s *Service) memberNode(pod *corev1.Pod) (*corev1.Node, error) {
+	if s.nodesForbidden {
+		return nil, nil
+	}
+
+	ctx, span := s.startSpan("k8s.node.get", attribute.String("k8s.node.name", pod.Spec.NodeName))
+	node, err := s.conf.K8sClient.CoreV1().Nodes().Get(ctx, pod.Spec.NodeName, metav1.GetOptions{})
+	endSpan(span, err)
+	if errors.IsForbidden(err) {
+		slog.Info("Not allowed to read nodes. Finding AZs with the other zone resolvers instead")
+		s.nodesForbidden = true
+		return nil, nil
+	}
+	if errors.IsNotFound(err) {
+		return nil, fmt.Errorf("unable to find node %s: %w", pod.Spec.NodeName, err)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("finding node: %w", err)
+	}
+
+	return node, nil
+}
 
-	return az, namespace, nil
+func (s *Service) nodePoolName() string {
+	if s.conf.NodePool != "" {
+		return s.conf.NodePool
+	}
+
+	return defaultNodePool
 }
 
-func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, error) {
-	job, err := s.conf.K8sClient.BatchV1().Jobs(namespace).Create(context.Background(), &batchv1.Job{
+// backupLabels are applied to every backup object the launcher creates, so they can be selected together.
+func (s *Service) backupLabels() map[string]string {
+	return map[string]string{
+		"backup-type": s.conf.BackupType,
+		"app":         "mongodb-backups",
+	}
+}
+
+// consistencyAnnotations describes the point in time the backup represents, so it can be read back off the Job during a restore.
+func consistencyAnnotations(cp consistencyPoint) map[string]string {
+	annotations := map[string]string{
+		"mongodb-replica-set":        cp.ReplicaSet,
+		"mongodb-term":               strconv.FormatInt(cp.Term, 10),
+		"mongodb-member-optime":      cp.MemberOptime.String(),
+		"mongodb-member-optime-date": cp.MemberOptimeDate.UTC().Format(time.RFC3339),
+	}
+	if cp.PrimaryFound {
+		annotations["mongodb-primary-optime"] = cp.PrimaryOptime.String()
+	}
+
+	return annotations
+}
+
+// consistencyEnv passes the same information to the backup container so the dump script can embed it in the artifact metadata.
+func consistencyEnv(cp consistencyPoint) []corev1.EnvVar {
+	env := []corev1.EnvVar{
+		{Name: "MONGO_REPLICA_SET", Value: cp.ReplicaSet},
+		{Name: "MONGO_TERM", Value: strconv.FormatInt(cp.Term, 10)},
+		{Name: "MONGO_MEMBER_OPTIME", Value: cp.MemberOptime.String()},
+		{Name: "MONGO_MEMBER_OPTIME_DATE", Value: cp.MemberOptimeDate.UTC().Format(time.RFC3339)},
+	}
+	if cp.PrimaryFound {
+		env = append(env, corev1.EnvVar{Name: "MONGO_PRIMARY_OPTIME", Value: cp.PrimaryOptime.String()})
+	}
+
+	return env
+}
+
+// JobOverrides replaces parts of every Job the Service creates, for callers such as the controller which launch on behalf of several
+// replica sets with their own settings. Zero values keep the defaults.
+type JobOverrides struct {
+	ServiceAccountName string
+
+	// Secret holding the MongoDB credentials, and the keys of the username and password in it
+	CredentialsSecret string
+	UsernameKey       string
+	PasswordKey       string
+
+	Resources   *corev1.ResourceRequirements
+	Env         []corev1.EnvVar
+	Tolerations []corev1.Toleration
+}
+
+// WithJobOverrides replaces parts of the Jobs the Service creates.
+func WithJobOverrides(overrides JobOverrides) Option {
+	return func(s *Service) {
+		s.jobOverrides = overrides
+	}
+}
+
+// applyJobOverrides applies the caller's JobOverrides to a Job built by newJob.
+func (s *Service) applyJobOverrides(job *batchv1.Job) {
+	o := s.jobOverrides
+	podSpec := &job.Spec.Template.Spec
+	container := &podSpec.Containers[0]
+
+	if o.ServiceAccountName != "" {
+		podSpec.ServiceAccountName = o.ServiceAccountName
+	}
+	if o.Resources != nil {
+		container.Resources = *o.Resources.DeepCopy()
+	}
+	podSpec.Tolerations = append(podSpec.Tolerations, o.Tolerations...)
+
+	for i := range container.Env {
+		ref := container.Env[i].ValueFrom
+		if ref == nil || ref.SecretKeyRef == nil || ref.SecretKeyRef.Name != MongoDBSecret {
+			continue
+		}
+		if o.CredentialsSecret != "" {
+			ref.SecretKeyRef.Name = o.CredentialsSecret
+		}
+		if ref.SecretKeyRef.Key == MongoDBSecretUsernameKey && o.UsernameKey != "" {
+			ref.SecretKeyRef.Key = o.UsernameKey
+		} else if ref.SecretKeyRef.Key == MongoDBSecretPasswordKey && o.PasswordKey != "" {
+			ref.SecretKeyRef.Key = o.PasswordKey
+		}
+	}
+
+	// Placed first, so the launcher's own variables of the same name, such as MONGO_HOSTLIST, take precedence
+	container.Env = append(slices.Clone(o.Env), container.Env...)
+}
+
+// newJob builds a Job pinned to the AZ, on the dedicated backups NodePool, with the MongoDB credentials and backups ConfigMap mounted.
+// Both backup and restore Jobs are built from it so they share the same scheduling and Secret conventions.
+func (s *Service) newJob(generateName, namespace, az string, labels, annotations map[string]string, command []string, env []corev1.EnvVar) *batchv1.Job {
+	annotations = maps.Clone(annotations)
+	if annotations == nil {
+		annotations = make(map[string]string)
+	}
+	annotations["created-by"] = s.conf.Hostname
+	env = append(env, s.traceEnv()...)
+
+	job := &batchv1.Job{
 		ObjectMeta: metav1.ObjectMeta{
-			GenerateName: "targeted-mongodb-backups-",
+			GenerateName: generateName,
 			Namespace:    namespace,
-			Annotations: map[string]string{
-				"created-by": s.conf.Hostname,
-			},
-			Labels: map[string]string{
-				"backup-type": s.conf.BackupType,
-				"app":         "mongodb-backups",
-			},
+			Annotations:  annotations,
+			Labels:       labels,
 		},
 		Spec: batchv1.JobSpec{
 			TTLSecondsAfterFinished: pointer.Int32(900),
@@ -79,19 +294,16 @@ func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, er
 					Annotations: map[string]string{
 						"karpenter.sh/do-not-disrupt": "true",
 					},
-					Labels: map[string]string{
-						"backup-type": s.conf.BackupType,
-						"app":         "mongodb-backups",
-					},
+					Labels: labels,
 				},
 
 				Spec: corev1.PodSpec{
 					RestartPolicy:      corev1.RestartPolicyNever,
-					ServiceAccountName: "backups",
+					ServiceAccountName: JobServiceAccount,
 
 					Tolerations: []corev1.Toleration{
 						{
-							Key:      "mongodb-backups",
+							Key:      backupTaintKey,
 							Operator: corev1.TolerationOpEqual,
 							Value:    "true",
 							Effect:   corev1.TaintEffectNoSchedule,
@@ -112,7 +324,7 @@ func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, er
 											{
 												Key:      "karpenter.sh/nodepool",
 												Operator: corev1.NodeSelectorOpIn,
-												Values:   []string{"backups"},
+												Values:   []string{s.nodePoolName()},
 											},
 										},
 									},
@@ -125,21 +337,21 @@ func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, er
 						{
 							Name:    "app",
 							Image:   s.conf.DockerImageURI,
-							Command: []string{"/usr/local/bin/mongodump_k8s.sh", s.conf.BackupType},
+							Command: command,
 
 							EnvFrom: []corev1.EnvFromSource{
 								{ConfigMapRef: &corev1.ConfigMapEnvSource{
-									LocalObjectReference: corev1.LocalObjectReference{Name: "backups"},
+									LocalObjectReference: corev1.LocalObjectReference{Name: JobConfigMap},
 								}},
 							},
 
-							Env: []corev1.EnvVar{
+							Env: append([]corev1.EnvVar{
 								{
 									Name: "MONGO_INITDB_ROOT_USERNAME",
 									ValueFrom: &corev1.EnvVarSource{
 										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{Name: "mongodb"},
-											Key:                  "username",
+											LocalObjectReference: corev1.LocalObjectReference{Name: MongoDBSecret},
+											Key:                  MongoDBSecretUsernameKey,
 										},
 									},
 								},
@@ -147,16 +359,12 @@ func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, er
 									Name: "MONGO_INITDB_ROOT_PASSWORD",
 									ValueFrom: &corev1.EnvVarSource{
 										SecretKeyRef: &corev1.SecretKeySelector{
-											LocalObjectReference: corev1.LocalObjectReference{Name: "mongodb"},
-											Key:                  "password",
+											LocalObjectReference: corev1.LocalObjectReference{Name: MongoDBSecret},
+											Key:                  MongoDBSecretPasswordKey,
 										},
 									},
 								},
-								{
-									Name:  "MONGO_HOSTLIST",
-									Value: mongoDBHost,
-								},
-							},
+							}, env...),
 
 							Resources: corev1.ResourceRequirements{
 								Limits: corev1.ResourceList{
@@ -188,7 +396,41 @@ func (s *Service) createJob(mongoDBHost, az, namespace string) (*batchv1.Job, er
 				},
 			},
 		},
-	}, metav1.CreateOptions{})
+	}
+
+	s.applyJobOverrides(job)
+	s.applyProvenance(job)
+
+	return job
+}
+
+func (s *Service) createJob(mongoDBHost, az, namespace string, cp consistencyPoint) (*batchv1.Job, error) {
+	env := append([]corev1.EnvVar{
+		{
+			Name:  "MONGO_HOSTLIST",
+			Value: mongoDBHost,
+		},
+	}, consistencyEnv(cp)...)
+
+	job := s.newJob("targeted-mongodb-backups-", namespace, az, s.backupLabels(), consistencyAnnotations(cp),
+		[]string{"/usr/local/bin/mongodump_k8s.sh", s.conf.BackupType}, env)
+
+	// Finished backup Jobs must outlive the freshness window for later runs to see them, and the verification Job so its result
+	// can be labelled on them
+	keepFor := s.conf.FreshnessWindow
+	if s.conf.VerifyBackups {
+		keepFor = max(keepFor, s.conf.VerifyJobTimeout+verifyLabelGrace)
+	}
+	if ttl := int32(keepFor.Seconds()); ttl > *job.Spec.TTLSecondsAfterFinished {
+		job.Spec.TTLSecondsAfterFinished = pointer.Int32(ttl)
+	}
+
+	ctx, span := s.startSpan("k8s.job.create", attrMember.String(mongoDBHost), attrAZ.String(az), attrNamespace.String(namespace))
+	job, err := s.conf.K8sClient.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err == nil {
+		span.SetAttributes(attrJob.String(job.Name))
+	}
+	endSpan(span, err)
 	if err != nil {
 		return nil, fmt.Errorf("creating K8s jobs client: %w", err)
 	}
@@ -1,16 +1,43 @@
 package service
 
 import (
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/michaelprice232/mongodb-backup-launcher/config"
 
 	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
 	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	apimeta "k8s.io/apimachinery/pkg/api/meta"
+	"k8s.io/apimachinery/pkg/api/resource"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
 	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
 )
 
+// withGeneratedNames makes the fake clientset honour GenerateName, as the API server would.
+func withGeneratedNames(client *fake.Clientset) *fake.Clientset {
+	var count int
+	client.PrependReactor("create", "*", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		obj := action.(k8stesting.CreateAction).GetObject()
+		meta, err := apimeta.Accessor(obj)
+		if err != nil {
+			return false, nil, err
+		}
+		if meta.GetName() == "" && meta.GetGenerateName() != "" {
+			count++
+			meta.SetName(fmt.Sprintf("%s%05d", meta.GetGenerateName(), count))
+		}
+		return false, nil, nil
+	})
+
+	return client
+}
+
 func Test_createJob(t *testing.T) {
 	k8sClient := fake.NewClientset()
 
@@ -24,13 +51,35 @@ func Test_createJob(t *testing.T) {
 	mongoDBHost := "mongodb-0.mongodb.database.svc.cluster.local:27017"
 	az := "eu-west-1a"
 	namespace := "database"
+	cp := consistencyPoint{
+		ReplicaSet:       "rs0",
+		Term:             4,
+		MemberOptime:     optime{TS: bson.Timestamp{T: 1700000000, I: 3}, Term: 4},
+		MemberOptimeDate: time.Unix(1700000000, 0),
+		PrimaryOptime:    optime{TS: bson.Timestamp{T: 1700000001, I: 1}, Term: 4},
+		PrimaryFound:     true,
+	}
 
-	job, err := s.createJob(mongoDBHost, az, namespace)
+	job, err := s.createJob(mongoDBHost, az, namespace, cp)
 	assert.Nil(t, err)
 	assert.NotNil(t, job)
 	assert.Equal(t, job.Namespace, namespace)
 	assert.Contains(t, job.Spec.Template.Annotations, "karpenter.sh/do-not-disrupt")
 
+	assert.Equal(t, "rs0", job.Annotations["mongodb-replica-set"])
+	assert.Equal(t, "4", job.Annotations["mongodb-term"])
+	assert.Equal(t, "1700000000:3", job.Annotations["mongodb-member-optime"])
+	assert.Equal(t, "2023-11-14T22:13:20Z", job.Annotations["mongodb-member-optime-date"])
+	assert.Equal(t, "1700000001:1", job.Annotations["mongodb-primary-optime"])
+
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, "rs0", env["MONGO_REPLICA_SET"])
+	assert.Equal(t, "1700000000:3", env["MONGO_MEMBER_OPTIME"])
+	assert.Equal(t, "1700000001:1", env["MONGO_PRIMARY_OPTIME"])
+
 	expressions := job.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions
 	var foundAZAffinity bool
 	var foundNodePoolAffinity bool
@@ -132,3 +181,102 @@ func Test_availabilityZoneToTarget(t *testing.T) {
 	_, _, err = s.availabilityZoneToTarget("mongodb-1.mongodb")
 	assert.NotNilf(t, err, "expected an error as the parameter FQDN does not have enough parts")
 }
+
+func Test_memberPlacementZoneSources(t *testing.T) {
+	tests := []struct {
+		name           string
+		nodesForbidden bool
+		podLabels      map[string]string
+		podAnnotations map[string]string
+		zoneMap        []config.ZoneMapping
+		expectedAZ     string
+		expectedNode   bool
+	}{
+		{name: "NodeLabel", expectedAZ: "eu-west-1a", expectedNode: true},
+		{name: "NodeLabelWinsOverPod", podLabels: map[string]string{azWellKnownLabel: "eu-west-1c"}, expectedAZ: "eu-west-1a", expectedNode: true},
+		{name: "PodLabel", nodesForbidden: true, podLabels: map[string]string{azWellKnownLabel: "eu-west-1b"}, expectedAZ: "eu-west-1b"},
+		{name: "PodAnnotation", nodesForbidden: true, podAnnotations: map[string]string{"mongodb-backups/zone": "eu-west-1c"}, expectedAZ: "eu-west-1c"},
+		{name: "ZoneMapWithPort", nodesForbidden: true, zoneMap: []config.ZoneMapping{{Pattern: "mongodb-0.mongodb.database.svc.cluster.local:27017", AZ: "eu-west-1b"}}, expectedAZ: "eu-west-1b"},
+		{name: "ZoneMapWithoutPort", nodesForbidden: true, zoneMap: []config.ZoneMapping{{Pattern: "mongodb-0.mongodb.database.svc.cluster.local", AZ: "eu-west-1c"}}, expectedAZ: "eu-west-1c"},
+		{name: "NoSource", nodesForbidden: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := fake.NewClientset(
+				&v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "mongodb-0", Namespace: "database", Labels: tc.podLabels, Annotations: tc.podAnnotations},
+					Spec:       v1.PodSpec{NodeName: "node1"},
+				},
+				&v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{azWellKnownLabel: "eu-west-1a"}}},
+			)
+			if tc.nodesForbidden {
+				k8sClient.PrependReactor("get", "nodes", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewForbidden(v1.Resource("nodes"), "node1", fmt.Errorf("no ClusterRole"))
+				})
+			}
+
+			s := Service{conf: config.Config{
+				K8sClient:         k8sClient,
+				ZonePodAnnotation: "mongodb-backups/zone",
+				ZoneMap:           tc.zoneMap,
+			}}
+
+			p, err := s.memberPlacement("mongodb-0.mongodb.database.svc.cluster.local:27017")
+			if tc.expectedAZ == "" {
+				assert.ErrorContains(t, err, "unable to find the AZ of member")
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedAZ, p.az)
+			assert.Equal(t, "mongodb-0", p.pod.Name)
+			assert.Equal(t, tc.expectedNode, p.node != nil)
+			assert.Equal(t, tc.nodesForbidden, s.nodesForbidden, "expected a forbidden node read to be remembered")
+		})
+	}
+}
+
+func Test_newJobLeavesAnnotationsAlone(t *testing.T) {
+	s := Service{conf: config.Config{Hostname: "launcher-abc"}}
+
+	annotations := map[string]string{"mongodb-replica-set": "rs0"}
+	job := s.newJob("targeted-mongodb-backups-", "database", "eu-west-1a", map[string]string{}, annotations, nil, nil)
+
+	assert.Equal(t, map[string]string{"mongodb-replica-set": "rs0"}, annotations, "expected the caller's annotations not to be changed")
+	assert.Equal(t, "launcher-abc", job.Annotations["created-by"])
+	assert.Equal(t, int32(3), *job.Spec.BackoffLimit)
+}
+
+func Test_newJobOverrides(t *testing.T) {
+	resources := v1.ResourceRequirements{Requests: v1.ResourceList{v1.ResourceCPU: resource.MustParse("500m")}}
+	s, err := NewService(config.Config{Hostname: "launcher-abc"}, WithJobOverrides(JobOverrides{
+		ServiceAccountName: "orders-backups",
+		CredentialsSecret:  "orders-mongodb",
+		PasswordKey:        "backup-password",
+		Resources:          &resources,
+		Env:                []v1.EnvVar{{Name: "S3_BUCKET", Value: "orders-backups"}, {Name: "MONGO_HOSTLIST", Value: "ignored"}},
+		Tolerations:        []v1.Toleration{{Key: "orders", Operator: v1.TolerationOpExists}},
+	}))
+	assert.NoError(t, err)
+
+	job := s.newJob("targeted-mongodb-backups-", "database", "eu-west-1a", nil, nil, nil,
+		[]v1.EnvVar{{Name: "MONGO_HOSTLIST", Value: "mongodb-1.mongodb.database.svc.cluster.local"}})
+	podSpec := job.Spec.Template.Spec
+	container := podSpec.Containers[0]
+
+	assert.Equal(t, "orders-backups", podSpec.ServiceAccountName)
+	assert.Equal(t, resources, container.Resources)
+	assert.Len(t, podSpec.Tolerations, 2, "expected the backups NodePool taint to still be tolerated")
+
+	env := map[string]v1.EnvVar{}
+	for _, e := range container.Env {
+		env[e.Name] = e
+	}
+	assert.Equal(t, "orders-backups", env["S3_BUCKET"].Value)
+	assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", env["MONGO_HOSTLIST"].Value, "expected the launcher's own variable to win")
+	assert.Equal(t, v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "orders-mongodb"}, Key: "username"},
+		*env["MONGO_INITDB_ROOT_USERNAME"].ValueFrom.SecretKeyRef)
+	assert.Equal(t, v1.SecretKeySelector{LocalObjectReference: v1.LocalObjectReference{Name: "orders-mongodb"}, Key: "backup-password"},
+		*env["MONGO_INITDB_ROOT_PASSWORD"].ValueFrom.SecretKeyRef)
+}
@@ -0,0 +1,218 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"slices"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+)
+
+// serverStatus is the subset of serverStatus used to judge how busy a member is. Numbers are decoded as floats, as the server
+// returns a mix of int32, int64 and double.
+type serverStatus struct {
+	OK     float64 `bson:"ok"`
+	ErrMsg string  `bson:"errmsg"`
+
+	Opcounters struct {
+		Insert  float64 `bson:"insert"`
+		Query   float64 `bson:"query"`
+		Update  float64 `bson:"update"`
+		Delete  float64 `bson:"delete"`
+		Getmore float64 `bson:"getmore"`
+		Command float64 `bson:"command"`
+	} `bson:"opcounters"`
+
+	Connections struct {
+		Active float64 `bson:"active"`
+	} `bson:"connections"`
+
+	WiredTiger struct {
+		Cache struct {
+			Used  float64 `bson:"bytes currently in the cache"`
+			Dirty float64 `bson:"tracked dirty bytes in the cache"`
+			Max   float64 `bson:"maximum bytes configured"`
+		} `bson:"cache"`
+	} `bson:"wiredTiger"`
+
+	GlobalLock struct {
+		CurrentQueue struct {
+			Total float64 `bson:"total"`
+		} `bson:"currentQueue"`
+	} `bson:"globalLock"`
+}
+
+func (ss serverStatus) operations() float64 {
+	o := ss.Opcounters
+	return o.Insert + o.Query + o.Update + o.Delete + o.Getmore + o.Command
+}
+
+// memberLoad is how busy a member was over the sample interval.
+type memberLoad struct {
+	opsPerSec         float64
+	activeConnections float64
+	cacheDirtyRatio   float64
+	cacheUsedRatio    float64
+	queued            float64
+}
+
+// overThresholds lists every metric above its threshold, e.g. "opsPerSec 1520 > 1000".
+func (l memberLoad) overThresholds(t config.LoadThresholds) []string {
+	checks := []struct {
+		name             string
+		value, threshold float64
+	}{
+		{"opsPerSec", l.opsPerSec, t.OpsPerSec},
+		{"activeConnections", l.activeConnections, t.ActiveConnections},
+		{"cacheDirtyRatio", l.cacheDirtyRatio, t.CacheDirtyRatio},
+		{"cacheUsedRatio", l.cacheUsedRatio, t.CacheUsedRatio},
+		{"queued", l.queued, t.Queued},
+	}
+
+	var over []string
+	for _, c := range checks {
+		if c.threshold > 0 && c.value > c.threshold {
+			over = append(over, fmt.Sprintf("%s %.6g > %.6g", c.name, c.value, c.threshold))
+		}
+	}
+
+	return over
+}
+
+// loadSampleTimeout bounds each serverStatus call, so one unresponsive member doesn't hold up the others.
+const loadSampleTimeout = 10 * time.Second
+
+var serverStatusCommand = bson.D{
+	{Key: "serverStatus", Value: 1},
+	{Key: "repl", Value: 0},
+	{Key: "metrics", Value: 0},
+	{Key: "locks", Value: 0},
+}
+
+// sampleLoad connects to each candidate and takes two serverStatus samples LOAD_SAMPLE_INTERVAL apart. Members which cannot be
+// sampled are left out of the result.
+func (s *Service) sampleLoad(candidates []candidate) map[string]memberLoad {
+	ctx := context.Background()
+
+	members := make(map[string]config.MongoDBMemberClient)
+	first := make(map[string]serverStatus)
+	for _, c := range candidates {
+		member, err := s.conf.MongoDBMemberConnector.ConnectToMember(ctx, c.host)
+		if err != nil {
+			slog.Warn("Unable to connect to member to sample its load", "host", c.host, "error", err.Error())
+			continue
+		}
+		defer func() {
+			if err := member.Disconnect(context.Background()); err != nil {
+				slog.Warn("disconnecting from member", "host", c.host, "error", err.Error())
+			}
+		}()
+
+		ss, err := memberServerStatus(member)
+		if err != nil {
+			slog.Warn("Unable to sample member load", "host", c.host, "error", err.Error())
+			continue
+		}
+		members[c.host] = member
+		first[c.host] = ss
+	}
+
+	start := time.Now()
+	time.Sleep(s.conf.LoadSampleInterval)
+
+	loads := make(map[string]memberLoad)
+	for host, member := range members {
+		ss, err := memberServerStatus(member)
+		if err != nil {
+			slog.Warn("Unable to sample member load", "host", host, "error", err.Error())
+			continue
+		}
+
+		load := memberLoad{
+			opsPerSec:         (ss.operations() - first[host].operations()) / time.Since(start).Seconds(),
+			activeConnections: ss.Connections.Active,
+			queued:            ss.GlobalLock.CurrentQueue.Total,
+		}
+		if cache := ss.WiredTiger.Cache; cache.Max > 0 {
+			load.cacheDirtyRatio = cache.Dirty / cache.Max
+			load.cacheUsedRatio = cache.Used / cache.Max
+		}
+		loads[host] = load
+
+		slog.Debug("Member load", "host", host, "opsPerSec", load.opsPerSec, "activeConnections", load.activeConnections,
+			"cacheDirtyRatio", load.cacheDirtyRatio, "cacheUsedRatio", load.cacheUsedRatio, "queued", load.queued)
+	}
+
+	return loads
+}
+
+func memberServerStatus(member config.MongoDBClient) (serverStatus, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), loadSampleTimeout)
+	defer cancel()
+
+	var ss serverStatus
+	if err := member.RunCommand(ctx, serverStatusCommand).Decode(&ss); err != nil {
+		return ss, fmt.Errorf("running serverStatus: %w", err)
+	}
+	if ss.OK != 1 {
+		return ss, fmt.Errorf("serverStatus did not complete successfully: %s", ss.ErrMsg)
+	}
+
+	return ss, nil
+}
+
+// rankByLoad orders the candidates with those under every threshold first, least busy (by operation rate) first, then those which
+// couldn't be sampled, then those over a threshold. The sort is stable, so members with the same load keep their replication lag
+// order. It also reports whether every candidate is over a threshold.
+func (s *Service) rankByLoad(candidates []candidate) ([]candidate, bool) {
+	loads := s.sampleLoad(candidates)
+
+	// How a candidate sorts: under the thresholds before over them. Unsampled candidates sort last of those under them
+	type rank struct {
+		over      bool
+		opsPerSec float64
+	}
+	ranks := make(map[string]rank)
+	allBusy := true
+	for _, c := range candidates {
+		load, found := loads[c.host]
+		if !found {
+			ranks[c.host] = rank{opsPerSec: math.Inf(1)}
+			allBusy = false
+			continue
+		}
+
+		over := load.overThresholds(s.conf.LoadThresholds)
+		if len(over) > 0 {
+			slog.Info("Candidate is above the load thresholds", "host", c.host, "over", over)
+		} else {
+			allBusy = false
+		}
+		ranks[c.host] = rank{over: len(over) > 0, opsPerSec: load.opsPerSec}
+	}
+
+	ranked := slices.Clone(candidates)
+	slices.SortStableFunc(ranked, func(a, b candidate) int {
+		ra, rb := ranks[a.host], ranks[b.host]
+		if ra.over != rb.over {
+			if ra.over {
+				return 1
+			}
+			return -1
+		}
+		switch {
+		case ra.opsPerSec < rb.opsPerSec:
+			return -1
+		case ra.opsPerSec > rb.opsPerSec:
+			return 1
+		}
+		return 0
+	})
+
+	return ranked, allBusy && len(candidates) > 0
+}
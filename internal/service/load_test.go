@@ -0,0 +1,138 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// newLoadedMember returns a member client whose two serverStatus samples are ops operations apart, with active connections.
+func newLoadedMember(ops, active float64) *mockMemberClient {
+	sample := func(queries float64) *mockSingleResult {
+		result := new(mockSingleResult)
+		result.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+			ss := args.Get(0).(*serverStatus)
+			ss.OK = 1
+			ss.Opcounters.Query = queries
+			ss.Connections.Active = active
+		}).Return(nil)
+		return result
+	}
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, serverStatusCommand).Return(sample(1000)).Once()
+	member.On("RunCommand", mock.Anything, serverStatusCommand).Return(sample(1000 + ops)).Once()
+	member.On("Disconnect", mock.Anything).Return(nil)
+
+	return member
+}
+
+func Test_rankByLoad(t *testing.T) {
+	tests := []struct {
+		name            string
+		members         map[string]*mockMemberClient
+		unreachable     []string
+		expectedOrder   []string
+		expectedAllBusy bool
+	}{
+		{
+			name: "least busy first",
+			members: map[string]*mockMemberClient{
+				"mongodb-1": newLoadedMember(500, 10),
+				"mongodb-2": newLoadedMember(50, 10),
+				"mongodb-3": newLoadedMember(200, 10),
+			},
+			expectedOrder: []string{"mongodb-2", "mongodb-3", "mongodb-1"},
+		},
+		{
+			name: "over a threshold last",
+			members: map[string]*mockMemberClient{
+				"mongodb-1": newLoadedMember(500, 10),
+				"mongodb-2": newLoadedMember(50, 200),
+				"mongodb-3": newLoadedMember(200, 10),
+			},
+			expectedOrder: []string{"mongodb-3", "mongodb-1", "mongodb-2"},
+		},
+		{
+			name: "unsampled after those under the thresholds",
+			members: map[string]*mockMemberClient{
+				"mongodb-2": newLoadedMember(50, 200),
+				"mongodb-3": newLoadedMember(200, 10),
+			},
+			unreachable:   []string{"mongodb-1"},
+			expectedOrder: []string{"mongodb-3", "mongodb-1", "mongodb-2"},
+		},
+		{
+			name: "all busy",
+			members: map[string]*mockMemberClient{
+				"mongodb-1": newLoadedMember(500, 200),
+				"mongodb-2": newLoadedMember(50, 200),
+			},
+			expectedOrder:   []string{"mongodb-2", "mongodb-1"},
+			expectedAllBusy: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			connector := new(mockMemberConnector)
+			var candidates []candidate
+			for _, host := range []string{"mongodb-1", "mongodb-2", "mongodb-3"} {
+				if member, found := tt.members[host]; found {
+					connector.On("ConnectToMember", mock.Anything, host).Return(member, nil)
+					candidates = append(candidates, candidate{host: host})
+				}
+			}
+			for _, host := range tt.unreachable {
+				connector.On("ConnectToMember", mock.Anything, host).Return((*mockMemberClient)(nil), errors.New("connection refused"))
+				candidates = append(candidates, candidate{host: host})
+			}
+
+			s := Service{conf: config.Config{
+				MongoDBMemberConnector: connector,
+				LoadThresholds:         config.LoadThresholds{ActiveConnections: 100},
+				LoadSampleInterval:     time.Millisecond,
+			}}
+
+			ranked, allBusy := s.rankByLoad(candidates)
+
+			var order []string
+			for _, c := range ranked {
+				order = append(order, c.host)
+			}
+			assert.Equal(t, tt.expectedOrder, order)
+			assert.Equal(t, tt.expectedAllBusy, allBusy)
+
+			for _, member := range tt.members {
+				member.AssertNumberOfCalls(t, "RunCommand", 2)
+				member.AssertCalled(t, "Disconnect", mock.Anything)
+			}
+		})
+	}
+}
+
+func Test_overThresholds(t *testing.T) {
+	load := memberLoad{opsPerSec: 1520, activeConnections: 20, cacheDirtyRatio: 0.3, cacheUsedRatio: 0.5, queued: 4}
+
+	assert.Empty(t, load.overThresholds(config.LoadThresholds{}))
+	assert.Equal(t, []string{"opsPerSec 1520 > 1000", "cacheDirtyRatio 0.3 > 0.2"},
+		load.overThresholds(config.LoadThresholds{OpsPerSec: 1000, ActiveConnections: 50, CacheDirtyRatio: 0.2, CacheUsedRatio: 0.8, Queued: 10}))
+}
+
+func Test_memberServerStatus(t *testing.T) {
+	result := new(mockSingleResult)
+	result.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*serverStatus).ErrMsg = "not authorized"
+	}).Return(nil)
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, serverStatusCommand).Return(result)
+
+	_, err := memberServerStatus(member)
+	assert.EqualError(t, err, "serverStatus did not complete successfully: not authorized")
+}
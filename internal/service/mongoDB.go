@@ -1,63 +1,219 @@
 package service
 
 import (
-	"context"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"slices"
+	"time"
 
 	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
 )
 
+type optime struct {
+	TS   bson.Timestamp `bson:"ts"`
+	Term int64          `bson:"t"`
+}
+
+// String formats the optime as <seconds>:<increment>, the same form mongodump/mongorestore accept for oplog timestamps.
+func (o optime) String() string {
+	return fmt.Sprintf("%d:%d", o.TS.T, o.TS.I)
+}
+
 type member struct {
-	Name string `bson:"name"`
-	Role string `bson:"stateStr"`
+	Name       string    `bson:"name"`
+	Role       string    `bson:"stateStr"`
+	Optime     optime    `bson:"optime"`
+	OptimeDate time.Time `bson:"optimeDate"`
 }
 
 type replicaSetMembers struct {
 	OK      int      `bson:"ok"`
+	Set     string   `bson:"set"`
+	Term    int64    `bson:"term"`
 	Members []member `bson:"members"`
 }
 
-func (s *Service) mongoDBReadReplicaToTarget() (string, error) {
+// consistencyPoint records where the replica set was at launch time, so a restore knows which point in time a dump represents.
+type consistencyPoint struct {
+	ReplicaSet       string
+	Term             int64
+	MemberOptime     optime
+	MemberOptimeDate time.Time
+	PrimaryOptime    optime
+	PrimaryFound     bool
+}
+
+func (s *Service) replicaSetStatus() (replicaSetMembers, error) {
 	rsMembers := replicaSetMembers{
 		Members: make([]member, 3),
 	}
 
+	ctx, span := s.startSpan("mongodb.replSetGetStatus")
+
 	// https://www.mongodb.com/docs/drivers/go/current/fundamentals/run-command/
-	err := s.conf.MongoDBClient.RunCommand(context.Background(), bson.D{bson.E{Key: "replSetGetStatus", Value: 1}}).Decode(&rsMembers)
+	err := s.conf.MongoDBClient.RunCommand(ctx, bson.D{bson.E{Key: "replSetGetStatus", Value: 1}}).Decode(&rsMembers)
+	endSpan(span, err)
 	if err != nil {
-		return "", fmt.Errorf("getting replica set status: %v", err)
+		return rsMembers, fmt.Errorf("getting replica set status: %v", err)
 	}
 
 	if rsMembers.OK != 1 {
-		return "", fmt.Errorf("database operation did not complete succesfully")
+		return rsMembers, fmt.Errorf("database operation did not complete succesfully")
 	}
 
 	if s.conf.LogLevel == "debug" {
 		members, err := json.MarshalIndent(rsMembers, "", "  ")
 		if err != nil {
-			return "", fmt.Errorf("marshalling replica set payload: %w", err)
+			return rsMembers, fmt.Errorf("marshalling replica set payload: %w", err)
 		}
 		fmt.Printf("Replica set members:\n%s\n", string(members))
 	}
 
-	var target string
+	return rsMembers, nil
+}
+
+// mongoDBPrimary finds the current PRIMARY member, which is the only member a restore can be written to.
+func (s *Service) mongoDBPrimary() (string, error) {
+	rsMembers, err := s.replicaSetStatus()
+	if err != nil {
+		return "", err
+	}
+
 	for _, m := range rsMembers.Members {
-		if m.Role == "SECONDARY" {
-			if s.conf.ExcludeReplica != "" && s.conf.ExcludeReplica == m.Name {
-				continue
+		if m.Role == "PRIMARY" {
+			slog.Debug("Primary Host", "host", m.Name)
+			return m.Name, nil
+		}
+	}
+
+	return "", fmt.Errorf("not found a PRIMARY replica set member")
+}
+
+func (s *Service) mongoDBReadReplicaToTarget() (string, consistencyPoint, error) {
+	candidates, err := s.mongoDBReadReplicaCandidates()
+	if err != nil {
+		return "", consistencyPoint{}, err
+	}
+
+	target := candidates[0]
+
+	s.recordCandidate(CandidateState{Member: target.host, State: CandidateSelected})
+	for _, c := range candidates[1:] {
+		s.recordCandidate(CandidateState{Member: c.host, State: CandidateNotTried})
+	}
+
+	slog.Debug("Target Host", "host", target.host)
+	slog.Debug("Consistency point", "replicaSet", target.cp.ReplicaSet, "term", target.cp.Term, "memberOptime", target.cp.MemberOptime.String(), "primaryOptime", target.cp.PrimaryOptime.String())
+
+	return target.host, target.cp, nil
+}
+
+// mongoDBReadReplicaCandidates returns every SECONDARY which a backup may be taken from, ranked with the most up to date member
+// first or, with LOAD_AWARE_SELECTION, the least busy.
+func (s *Service) mongoDBReadReplicaCandidates() ([]candidate, error) {
+	candidates, err := s.replicaCandidates()
+	if err != nil {
+		return nil, err
+	}
+
+	return s.rankCandidatesByLoad(candidates)
+}
+
+// rankCandidatesByLoad ranks the candidates with the least busy first when LOAD_AWARE_SELECTION is on. If every candidate is
+// too busy it waits up to LOAD_DEFER_TIMEOUT for one not to be, reading the replica set status again each time so the
+// consistency point isn't stale.
+func (s *Service) rankCandidatesByLoad(candidates []candidate) ([]candidate, error) {
+	if !s.conf.LoadAware {
+		return candidates, nil
+	}
+
+	deadline := time.Now().Add(s.conf.LoadDeferTimeout)
+
+	for {
+		ranked, allBusy := s.rankByLoad(candidates)
+		if !allBusy {
+			return ranked, nil
+		}
+		if !time.Now().Add(s.conf.LoadDeferInterval).Before(deadline) {
+			if s.conf.LoadDeferTimeout > 0 {
+				slog.Warn("Every candidate is still above the load thresholds. Using the least busy", "host", ranked[0].host, "deferTimeout", s.conf.LoadDeferTimeout)
+			} else {
+				slog.Warn("Every candidate is above the load thresholds. Using the least busy", "host", ranked[0].host)
 			}
-			target = m.Name
-			break
+			return ranked, nil
+		}
+
+		slog.Info("Every candidate is above the load thresholds. Deferring the backup", "retryIn", s.conf.LoadDeferInterval, "until", deadline.Format(time.RFC3339))
+		s.event(nil, corev1.EventTypeNormal, reasonLaunchDeferred, "reason=%q retryIn=%s", "every candidate is above the load thresholds", s.conf.LoadDeferInterval)
+		time.Sleep(s.conf.LoadDeferInterval)
+
+		var err error
+		if candidates, err = s.replicaCandidates(); err != nil {
+			return nil, err
 		}
 	}
+}
 
-	if target == "" {
-		return "", fmt.Errorf("not found a SECONDARY replica set member which is not in the EXCLUDE_REPLICA env var. EXCLUDE_REPLICA = %s", s.conf.ExcludeReplica)
+// replicaCandidates reads the replica set status and returns the SECONDARY members a backup may be taken from, least lagged first.
+func (s *Service) replicaCandidates() ([]candidate, error) {
+	rsMembers, err := s.replicaSetStatus()
+	if err != nil {
+		return nil, err
+	}
+
+	base := consistencyPoint{
+		ReplicaSet: rsMembers.Set,
+		Term:       rsMembers.Term,
+	}
+	for _, m := range rsMembers.Members {
+		if m.Role == "PRIMARY" {
+			base.PrimaryOptime = m.Optime
+			base.PrimaryFound = true
+		}
+	}
+
+	// EXCLUDE_REPLICA is usually a member which mustn't be read from, e.g. one serving analytics, so it can't be requested either
+	if s.conf.MemberOverride != "" && s.conf.MemberOverride == s.conf.ExcludeReplica {
+		return nil, fmt.Errorf("requested member %s is excluded by EXCLUDE_REPLICA", s.conf.MemberOverride)
+	}
+
+	var candidates []candidate
+	for _, m := range rsMembers.Members {
+		if m.Role != "SECONDARY" {
+			continue
+		}
+
+		// An explicitly requested member must still be a SECONDARY
+		if s.conf.MemberOverride != "" && s.conf.MemberOverride != m.Name {
+			s.event(nil, corev1.EventTypeNormal, reasonMemberRejected, "member=%s reason=%q", m.Name, "not the requested member "+s.conf.MemberOverride)
+			s.recordCandidate(CandidateState{Member: m.Name, State: CandidateExcluded, Reason: "not the requested member"})
+			continue
+		}
+		if s.conf.ExcludeReplica != "" && s.conf.ExcludeReplica == m.Name {
+			s.event(nil, corev1.EventTypeNormal, reasonMemberRejected, "member=%s reason=%q", m.Name, "excluded by EXCLUDE_REPLICA")
+			s.recordCandidate(CandidateState{Member: m.Name, State: CandidateExcluded, Reason: "EXCLUDE_REPLICA"})
+			continue
+		}
+
+		cp := base
+		cp.MemberOptime = m.Optime
+		cp.MemberOptimeDate = m.OptimeDate
+		candidates = append(candidates, candidate{host: m.Name, cp: cp})
+	}
+
+	if len(candidates) == 0 && s.conf.MemberOverride != "" {
+		return nil, fmt.Errorf("requested member %s is not a SECONDARY replica set member", s.conf.MemberOverride)
+	}
+	if len(candidates) == 0 {
+		return nil, fmt.Errorf("not found a SECONDARY replica set member which is not in the EXCLUDE_REPLICA env var. EXCLUDE_REPLICA = %s", s.conf.ExcludeReplica)
 	}
 
-	slog.Debug("Target Host", "host", target)
+	// Least replication lag first. Stable, so members which are level keep their replica set order
+	slices.SortStableFunc(candidates, func(a, b candidate) int {
+		return b.cp.MemberOptime.TS.Compare(a.cp.MemberOptime.TS)
+	})
 
-	return target, nil
+	return candidates, nil
 }
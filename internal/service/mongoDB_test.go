@@ -8,6 +8,7 @@ import (
 	"github.com/michaelprice232/mongodb-backup-launcher/config"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/v2/bson"
 )
 
 type mockSingleResult struct {
@@ -32,17 +33,20 @@ func Test_mongoDBReadReplicaToTarget(t *testing.T) {
 	tests := []struct {
 		name           string
 		ok             int // 1 == succeeded, 0 == failed
+		set            string
+		term           int64
 		members        []member
 		excludeReplica string
+		memberOverride string
 		expectedTarget string
 		expectedError  bool
 		logLevel       string
 	}{
 		{
-			name: "GoodWithExcludeReplica", ok: 1, members: []member{
-			{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
-			{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
-			{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"}},
+			name: "GoodWithExcludeReplica", ok: 1, set: "rs0", term: 7, members: []member{
+			{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY", Optime: optime{TS: bson.Timestamp{T: 200, I: 1}, Term: 7}},
+			{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 150, I: 1}, Term: 7}},
+			{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 190, I: 2}, Term: 7}}},
 			excludeReplica: "mongodb-1.mongodb.database.svc.cluster.local",
 			expectedTarget: "mongodb-2.mongodb.database.svc.cluster.local",
 			expectedError:  false,
@@ -55,6 +59,34 @@ func Test_mongoDBReadReplicaToTarget(t *testing.T) {
 			expectedTarget: "mongodb-0.mongodb.database.svc.cluster.local",
 			expectedError:  false,
 		},
+		{
+			name: "MemberOverride", ok: 1, members: []member{
+			{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+			{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+			{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"}},
+			excludeReplica: "mongodb-1.mongodb.database.svc.cluster.local",
+			memberOverride: "mongodb-2.mongodb.database.svc.cluster.local",
+			expectedTarget: "mongodb-2.mongodb.database.svc.cluster.local",
+			expectedError:  false,
+		},
+		{
+			name: "MemberOverrideIsExcluded", ok: 1, members: []member{
+			{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+			{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+			{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"}},
+			excludeReplica: "mongodb-2.mongodb.database.svc.cluster.local",
+			memberOverride: "mongodb-2.mongodb.database.svc.cluster.local",
+			expectedTarget: "",
+			expectedError:  true,
+		},
+		{
+			name: "MemberOverrideIsPrimary", ok: 1, members: []member{
+			{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+			{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"}},
+			memberOverride: "mongodb-0.mongodb.database.svc.cluster.local",
+			expectedTarget: "",
+			expectedError:  true,
+		},
 		{
 			name: "NotOK", ok: 0, members: []member{},
 			expectedTarget: "",
@@ -98,6 +130,8 @@ func Test_mongoDBReadReplicaToTarget(t *testing.T) {
 			mockResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
 				ptr := args.Get(0).(*replicaSetMembers)
 				ptr.OK = tc.ok
+				ptr.Set = tc.set
+				ptr.Term = tc.term
 				ptr.Members = tc.members
 			}).Return(decodeError)
 
@@ -107,11 +141,12 @@ func Test_mongoDBReadReplicaToTarget(t *testing.T) {
 				conf: config.Config{
 					MongoDBClient:  mockClient,
 					ExcludeReplica: tc.excludeReplica,
+					MemberOverride: tc.memberOverride,
 					LogLevel:       tc.logLevel,
 				},
 			}
 
-			target, err := s.mongoDBReadReplicaToTarget()
+			target, cp, err := s.mongoDBReadReplicaToTarget()
 
 			if tc.expectedError {
 				assert.Error(t, err)
@@ -120,6 +155,29 @@ func Test_mongoDBReadReplicaToTarget(t *testing.T) {
 			}
 
 			assert.Equal(t, tc.expectedTarget, target)
+
+			if tc.name == "GoodWithExcludeReplica" {
+				assert.Equal(t, "rs0", cp.ReplicaSet)
+				assert.Equal(t, int64(7), cp.Term)
+				assert.Equal(t, "190:2", cp.MemberOptime.String())
+				assert.Equal(t, "200:1", cp.PrimaryOptime.String())
+				assert.True(t, cp.PrimaryFound)
+			}
 		})
 	}
 }
+
+// newMockReplicaSet returns a client whose replSetGetStatus reports the given members.
+func newMockReplicaSet(members []member) *mockMongoClient {
+	result := new(mockSingleResult)
+	result.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		ptr := args.Get(0).(*replicaSetMembers)
+		ptr.OK = 1
+		ptr.Members = members
+	}).Return(nil)
+
+	client := new(mockMongoClient)
+	client.On("RunCommand", mock.Anything, mock.Anything).Return(result)
+
+	return client
+}
@@ -0,0 +1,132 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sort"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+var nodePoolGVR = schema.GroupVersionResource{
+	Group:    "karpenter.sh",
+	Version:  "v1",
+	Resource: "nodepools",
+}
+
+// nodePool is the subset of a karpenter.sh/v1 NodePool the preflight checks read.
+type nodePool struct {
+	Spec struct {
+		Template struct {
+			Spec struct {
+				Taints       []corev1.Taint                   `json:"taints"`
+				Requirements []corev1.NodeSelectorRequirement `json:"requirements"`
+			} `json:"spec"`
+		} `json:"template"`
+		Limits corev1.ResourceList `json:"limits"`
+	} `json:"spec"`
+	Status struct {
+		Resources corev1.ResourceList `json:"resources"`
+	} `json:"status"`
+}
+
+// checkNodePool makes sure the backup Job will be schedulable before it is created. Otherwise it would sit Pending with nothing to notice it.
+func (s *Service) checkNodePool(az string) error {
+	if !s.conf.NodePoolPreflight {
+		return nil
+	}
+
+	name := s.nodePoolName()
+
+	obj, err := s.conf.K8sDynamicClient.Resource(nodePoolGVR).Get(context.Background(), name, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return fmt.Errorf("karpenter NodePool '%s' does not exist", name)
+	}
+	if err != nil {
+		return fmt.Errorf("getting karpenter NodePool '%s': %w", name, err)
+	}
+
+	var pool nodePool
+	if err = runtime.DefaultUnstructuredConverter.FromUnstructured(obj.Object, &pool); err != nil {
+		return fmt.Errorf("decoding karpenter NodePool '%s': %w", name, err)
+	}
+
+	if err = checkNodePoolTaint(pool); err != nil {
+		return fmt.Errorf("karpenter NodePool '%s': %w", name, err)
+	}
+
+	if err = checkNodePoolZone(pool, az); err != nil {
+		return fmt.Errorf("karpenter NodePool '%s': %w", name, err)
+	}
+
+	if err = checkNodePoolLimits(pool); err != nil {
+		return fmt.Errorf("karpenter NodePool '%s': %w", name, err)
+	}
+
+	slog.Debug("NodePool preflight passed", "nodePool", name, "az", az)
+
+	return nil
+}
+
+func checkNodePoolTaint(pool nodePool) error {
+	for _, t := range pool.Spec.Template.Spec.Taints {
+		if t.Key == backupTaintKey && t.Value == "true" && t.Effect == corev1.TaintEffectNoSchedule {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("does not have the taint %s=true:%s which backup jobs tolerate", backupTaintKey, corev1.TaintEffectNoSchedule)
+}
+
+func checkNodePoolZone(pool nodePool, az string) error {
+	for _, req := range pool.Spec.Template.Spec.Requirements {
+		if req.Key != azWellKnownLabel {
+			continue
+		}
+
+		switch req.Operator {
+		case corev1.NodeSelectorOpIn:
+			if !slices.Contains(req.Values, az) {
+				return fmt.Errorf("zone requirement only allows %v, not the target AZ %s", req.Values, az)
+			}
+		case corev1.NodeSelectorOpNotIn:
+			if slices.Contains(req.Values, az) {
+				return fmt.Errorf("zone requirement excludes the target AZ %s", az)
+			}
+		case corev1.NodeSelectorOpDoesNotExist:
+			return fmt.Errorf("zone requirement does not allow nodes with a zone label")
+		}
+	}
+
+	return nil
+}
+
+// checkNodePoolLimits fails if the NodePool has already provisioned up to any of its limits, so cannot launch a node for the Job.
+func checkNodePoolLimits(pool nodePool) error {
+	names := make([]string, 0, len(pool.Spec.Limits))
+	for name := range pool.Spec.Limits {
+		names = append(names, string(name))
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		limit := pool.Spec.Limits[corev1.ResourceName(name)]
+
+		usage, found := pool.Status.Resources[corev1.ResourceName(name)]
+		if !found {
+			continue
+		}
+
+		if usage.Cmp(limit) >= 0 {
+			return fmt.Errorf("is at its %s limit (%s used of %s)", name, usage.String(), limit.String())
+		}
+	}
+
+	return nil
+}
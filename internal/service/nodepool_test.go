@@ -0,0 +1,91 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+func newNodePool(requirements []any, limits, resources map[string]any, taints ...any) *unstructured.Unstructured {
+	pool := &unstructured.Unstructured{Object: map[string]any{
+		"apiVersion": "karpenter.sh/v1",
+		"kind":       "NodePool",
+		"metadata":   map[string]any{"name": "backups"},
+		"spec": map[string]any{
+			"template": map[string]any{
+				"spec": map[string]any{
+					"taints":       taints,
+					"requirements": requirements,
+				},
+			},
+		},
+	}}
+
+	if limits != nil {
+		_ = unstructured.SetNestedMap(pool.Object, limits, "spec", "limits")
+	}
+	if resources != nil {
+		_ = unstructured.SetNestedMap(pool.Object, resources, "status", "resources")
+	}
+
+	return pool
+}
+
+func zoneRequirement(operator string, values ...any) any {
+	return map[string]any{"key": azWellKnownLabel, "operator": operator, "values": values}
+}
+
+var backupTaint = map[string]any{"key": backupTaintKey, "value": "true", "effect": "NoSchedule"}
+
+func Test_checkNodePool(t *testing.T) {
+	tests := []struct {
+		name        string
+		pool        *unstructured.Unstructured
+		expectedErr string
+	}{
+		{name: "Valid", pool: newNodePool([]any{zoneRequirement("In", "eu-west-2a", "eu-west-2b")}, map[string]any{"cpu": "100"}, map[string]any{"cpu": "20"}, backupTaint)},
+		{name: "NoZoneRequirement", pool: newNodePool(nil, nil, nil, backupTaint)},
+		{name: "Missing", expectedErr: "karpenter NodePool 'backups' does not exist"},
+		{name: "MissingTaint", pool: newNodePool(nil, nil, nil), expectedErr: "does not have the taint mongodb-backups=true:NoSchedule"},
+		{name: "WrongTaintEffect", pool: newNodePool(nil, nil, nil, map[string]any{"key": backupTaintKey, "value": "true", "effect": "PreferNoSchedule"}), expectedErr: "does not have the taint"},
+		{name: "ZoneNotIn", pool: newNodePool([]any{zoneRequirement("In", "eu-west-2b")}, nil, nil, backupTaint), expectedErr: "not the target AZ eu-west-2a"},
+		{name: "ZoneExcluded", pool: newNodePool([]any{zoneRequirement("NotIn", "eu-west-2a")}, nil, nil, backupTaint), expectedErr: "excludes the target AZ eu-west-2a"},
+		{name: "AtLimit", pool: newNodePool(nil, map[string]any{"cpu": "100", "memory": "1000Gi"}, map[string]any{"cpu": "100", "memory": "200Gi"}, backupTaint), expectedErr: "is at its cpu limit (100 used of 100)"},
+		{name: "OverLimitDifferentUnits", pool: newNodePool(nil, map[string]any{"memory": "1Ti"}, map[string]any{"memory": "1025Gi"}, backupTaint), expectedErr: "is at its memory limit"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			var objects []runtime.Object
+			if tc.pool != nil {
+				objects = append(objects, tc.pool)
+			}
+
+			s := &Service{conf: config.Config{
+				K8sDynamicClient:  dynamicfake.NewSimpleDynamicClient(runtime.NewScheme(), objects...),
+				NodePoolPreflight: true,
+			}}
+
+			err := s.checkNodePool("eu-west-2a")
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.ErrorContains(t, err, tc.expectedErr)
+		})
+	}
+}
+
+func Test_checkNodePoolDisabled(t *testing.T) {
+	s := &Service{conf: config.Config{
+		K8sDynamicClient:  dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+		NodePoolPreflight: false,
+	}}
+
+	assert.NoError(t, s.checkNodePool("eu-west-2a"))
+}
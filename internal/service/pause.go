@@ -0,0 +1,131 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// ErrSkipped is returned when a backup was deliberately not launched, because of a blackout window or the pause switch.
+var ErrSkipped = errors.New("launch skipped")
+
+// pauseConfigMapKey is the key in PAUSE_CONFIGMAP which pauses backups.
+const pauseConfigMapKey = "paused"
+
+// checkBlackout skips the launch if now falls in any of the BLACKOUT_WINDOWS.
+func (s *Service) checkBlackout(now time.Time) error {
+	if spec, active := activeBlackout(s.conf.BlackoutWindows, s.conf.BlackoutLocation, now); active {
+		return fmt.Errorf("%w: in blackout window '%s'", ErrSkipped, spec)
+	}
+
+	return nil
+}
+
+// activeBlackout returns the first window which now falls in. Cron windows are active from each firing for their duration.
+func activeBlackout(windows []config.BlackoutWindow, location *time.Location, now time.Time) (string, bool) {
+	if location == nil {
+		location = time.UTC
+	}
+	now = now.In(location)
+
+	for _, w := range windows {
+		if w.Schedule != nil {
+			// Next is strictly after its argument, so this finds a firing in (now-duration, now]
+			if !w.Schedule.Next(now.Add(-w.Duration)).After(now) {
+				return w.Spec, true
+			}
+			continue
+		}
+
+		if !now.Before(w.Start) && now.Before(w.End) {
+			return w.Spec, true
+		}
+	}
+
+	return "", false
+}
+
+// checkPauseConfigMap skips the launch if the pause switch is set on PAUSE_CONFIGMAP. It only needs the launcher's own
+// namespace, so runs alongside checkBlackout before connecting to MongoDB.
+func (s *Service) checkPauseConfigMap() error {
+	if s.conf.PauseConfigMap == "" {
+		return nil
+	}
+
+	cm, err := s.conf.K8sClient.CoreV1().ConfigMaps(s.conf.PodNamespace).Get(context.Background(), s.conf.PauseConfigMap, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("getting pause ConfigMap %s/%s: %w", s.conf.PodNamespace, s.conf.PauseConfigMap, err)
+	}
+
+	if reason, paused := pauseReason(cm.Data[pauseConfigMapKey]); paused {
+		return fmt.Errorf("%w: paused by ConfigMap %s/%s (%s=%s)", ErrSkipped, cm.Namespace, cm.Name, pauseConfigMapKey, reason)
+	}
+
+	return nil
+}
+
+// checkPauseAnnotation skips the launch if the pause switch is set on the StatefulSet behind the members. The StatefulSet is
+// found from the first of the hosts whose pod exists.
+func (s *Service) checkPauseAnnotation(hosts ...string) error {
+	if s.conf.PauseAnnotation == "" {
+		return nil
+	}
+
+	var pod *corev1.Pod
+	for _, host := range hosts {
+		p, err := s.replicaPod(host)
+		if err != nil {
+			slog.Debug("Unable to find member pod to check for the pause annotation", "host", host, "error", err.Error())
+			continue
+		}
+		pod = p
+		break
+	}
+	if pod == nil {
+		slog.Warn("Unable to find any member pod. Unable to check the MongoDB StatefulSet for the pause annotation", "annotation", s.conf.PauseAnnotation)
+		return nil
+	}
+
+	owner := metav1.GetControllerOf(pod)
+	if owner == nil || owner.Kind != "StatefulSet" {
+		slog.Debug("Member pod is not part of a StatefulSet. Not checking it for the pause annotation", "pod", pod.Name)
+		return nil
+	}
+
+	sts, err := s.conf.K8sClient.AppsV1().StatefulSets(pod.Namespace).Get(context.Background(), owner.Name, metav1.GetOptions{})
+	// Fails closed, as launching while an operator has paused backups could be worse than missing one
+	if apierrors.IsForbidden(err) {
+		return fmt.Errorf("not allowed to read the MongoDB StatefulSet %s/%s to check for the pause annotation %s. Grant 'get statefulsets' or set PAUSE_ANNOTATION to \"\": %w", pod.Namespace, owner.Name, s.conf.PauseAnnotation, err)
+	}
+	if err != nil {
+		return fmt.Errorf("getting the MongoDB StatefulSet %s/%s: %w", pod.Namespace, owner.Name, err)
+	}
+
+	if reason, paused := pauseReason(sts.Annotations[s.conf.PauseAnnotation]); paused {
+		return fmt.Errorf("%w: paused by annotation %s=%s on StatefulSet %s/%s", ErrSkipped, s.conf.PauseAnnotation, reason, sts.Namespace, sts.Name)
+	}
+
+	return nil
+}
+
+// pauseReason reports whether a pause switch value pauses backups. Anything but empty or "false" does, so the value can say why.
+func pauseReason(v string) (string, bool) {
+	v = strings.TrimSpace(v)
+	if v == "" || v == "false" {
+		return "", false
+	}
+
+	return v, true
+}
@@ -0,0 +1,157 @@
+package service
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/robfig/cron/v3"
+	"github.com/stretchr/testify/assert"
+	appsv1 "k8s.io/api/apps/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+	"k8s.io/utils/pointer"
+)
+
+func Test_activeBlackout(t *testing.T) {
+	london, err := time.LoadLocation("Europe/London")
+	assert.NoError(t, err)
+
+	// Saturdays 01:00-05:00 London time, and a fixed upgrade window
+	saturdays, err := cron.ParseStandard("0 1 * * 6")
+	assert.NoError(t, err)
+	windows := []config.BlackoutWindow{
+		{Spec: "0 1 * * 6 for 4h", Schedule: saturdays, Duration: 4 * time.Hour},
+		{Spec: "2025-06-02T00:00/2025-06-02T06:00", Start: time.Date(2025, 6, 2, 0, 0, 0, 0, london), End: time.Date(2025, 6, 2, 6, 0, 0, 0, london)},
+	}
+
+	tests := []struct {
+		name     string
+		now      time.Time
+		expected string
+	}{
+		{name: "BeforeCronWindow", now: time.Date(2025, 5, 31, 0, 59, 0, 0, london)},
+		{name: "CronWindowStart", now: time.Date(2025, 5, 31, 1, 0, 0, 0, london), expected: "0 1 * * 6 for 4h"},
+		{name: "InCronWindow", now: time.Date(2025, 5, 31, 4, 59, 0, 0, london), expected: "0 1 * * 6 for 4h"},
+		{name: "CronWindowEnd", now: time.Date(2025, 5, 31, 5, 0, 0, 0, london)},
+		{name: "CronWindowInUTC", now: time.Date(2025, 5, 31, 0, 30, 0, 0, time.UTC), expected: "0 1 * * 6 for 4h"},
+		{name: "InFixedWindow", now: time.Date(2025, 6, 2, 5, 59, 0, 0, london), expected: "2025-06-02T00:00/2025-06-02T06:00"},
+		{name: "AfterFixedWindow", now: time.Date(2025, 6, 2, 6, 0, 0, 0, london)},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			spec, active := activeBlackout(windows, london, tc.now)
+			assert.Equal(t, tc.expected != "", active)
+			assert.Equal(t, tc.expected, spec)
+		})
+	}
+}
+
+func Test_checkPaused(t *testing.T) {
+	pod := healthyPod("mongodb-1", "node1")
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "mongodb", Controller: pointer.Bool(true)}}
+
+	tests := []struct {
+		name           string
+		stsAnnotations map[string]string
+		configMapData  map[string]string
+		expectedErr    string
+	}{
+		{name: "NotPaused"},
+		{name: "AnnotationFalse", stsAnnotations: map[string]string{"mongodb-backups/paused": "false"}},
+		{name: "PausedByAnnotation", stsAnnotations: map[string]string{"mongodb-backups/paused": "upgrading to 8.0"}, expectedErr: "launch skipped: paused by annotation mongodb-backups/paused=upgrading to 8.0 on StatefulSet database/mongodb"},
+		{name: "PausedByConfigMap", configMapData: map[string]string{"paused": "true"}, expectedErr: "launch skipped: paused by ConfigMap backups/backup-pause (paused=true)"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := fake.NewClientset(
+				pod,
+				&appsv1.StatefulSet{ObjectMeta: metav1.ObjectMeta{Name: "mongodb", Namespace: "database", Annotations: tc.stsAnnotations}},
+				&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "backup-pause", Namespace: "backups"}, Data: tc.configMapData},
+			)
+
+			s := Service{
+				conf: config.Config{
+					K8sClient:       k8sClient,
+					PodNamespace:    "backups",
+					PauseAnnotation: "mongodb-backups/paused",
+					PauseConfigMap:  "backup-pause",
+				},
+			}
+
+			// The first member's pod is missing, so the StatefulSet is found from the second
+			err := s.checkPauseConfigMap()
+			if err == nil {
+				err = s.checkPauseAnnotation("mongodb-2.mongodb.database.svc.cluster.local", "mongodb-1.mongodb.database.svc.cluster.local")
+			}
+			if tc.expectedErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			assert.EqualError(t, err, tc.expectedErr)
+			assert.True(t, errors.Is(err, ErrSkipped))
+		})
+	}
+}
+
+func Test_checkPauseAnnotationForbidden(t *testing.T) {
+	pod := healthyPod("mongodb-1", "node1")
+	pod.OwnerReferences = []metav1.OwnerReference{{APIVersion: "apps/v1", Kind: "StatefulSet", Name: "mongodb", Controller: pointer.Bool(true)}}
+
+	k8sClient := fake.NewClientset(pod)
+	k8sClient.PrependReactor("get", "statefulsets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(schema.GroupResource{Group: "apps", Resource: "statefulsets"}, "mongodb", errors.New("RBAC"))
+	})
+
+	s := Service{conf: config.Config{K8sClient: k8sClient, PodNamespace: "backups", PauseAnnotation: "mongodb-backups/paused"}}
+
+	err := s.checkPauseAnnotation("mongodb-1.mongodb.database.svc.cluster.local")
+	assert.ErrorContains(t, err, "not allowed to read the MongoDB StatefulSet database/mongodb")
+	assert.False(t, errors.Is(err, ErrSkipped), "expected a failure rather than a skip")
+}
+
+func Test_launchSkippedInBlackout(t *testing.T) {
+	always, err := cron.ParseStandard("* * * * *")
+	assert.NoError(t, err)
+
+	s := Service{
+		conf: config.Config{
+			LauncherMode:    "backup",
+			BlackoutWindows: []config.BlackoutWindow{{Spec: "* * * * * for 2m", Schedule: always, Duration: 2 * time.Minute}},
+		},
+	}
+
+	start := time.Now()
+	result, err := s.Launch()
+	assert.ErrorIs(t, err, ErrSkipped)
+	assert.EqualError(t, err, "launch skipped: in blackout window '* * * * * for 2m'")
+
+	report := NewReport(s.conf, start, result, err)
+	assert.Equal(t, "skipped", report.Status)
+}
+
+func Test_launchPausedByConfigMap(t *testing.T) {
+	s := Service{
+		conf: config.Config{
+			LauncherMode: "backup",
+			// Any MongoDB call fails the test, as the ConfigMap is checked before connecting
+			MongoDBClient:  new(mockMongoClient),
+			K8sClient:      fake.NewClientset(&v1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Name: "backup-pause", Namespace: "backups"}, Data: map[string]string{"paused": "maintenance"}}),
+			PodNamespace:   "backups",
+			PauseConfigMap: "backup-pause",
+		},
+	}
+
+	_, err := s.Launch()
+	assert.ErrorIs(t, err, ErrSkipped)
+	assert.EqualError(t, err, "launch skipped: paused by ConfigMap backups/backup-pause (paused=maintenance)")
+}
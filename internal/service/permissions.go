@@ -0,0 +1,276 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"strings"
+	"text/tabwriter"
+
+	authorizationv1 "k8s.io/api/authorization/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// permission is one verb on one resource the launcher will use. An empty namespace means a cluster-scoped resource.
+type permission struct {
+	verb      string
+	group     string
+	resource  string
+	namespace string
+	feature   string
+	// Optional permissions only degrade a feature, so are warned about rather than failing the run
+	optional bool
+}
+
+// requiredPermissions lists what the launcher mode and the enabled features need against MongoDB in the given namespace.
+func (s *Service) requiredPermissions(namespace string) []permission {
+	perms := []permission{
+		{verb: "get", resource: "pods", namespace: namespace, feature: "member lookup"},
+	}
+
+	if s.conf.LaunchEvents {
+		perms = append(perms, permission{verb: "create", resource: "events", namespace: s.conf.PodNamespace, feature: "LAUNCH_EVENTS", optional: true})
+		if namespace != s.conf.PodNamespace {
+			perms = append(perms, permission{verb: "create", resource: "events", namespace: namespace, feature: "LAUNCH_EVENTS", optional: true})
+		}
+	}
+
+	if s.conf.BackupMode == "snapshot" && s.conf.LauncherMode != "restore" {
+		return append(perms,
+			permission{verb: "create", group: "snapshot.storage.k8s.io", resource: "volumesnapshots", namespace: namespace, feature: "snapshot mode"},
+			permission{verb: "get", group: "snapshot.storage.k8s.io", resource: "volumesnapshots", namespace: namespace, feature: "snapshot mode"},
+		)
+	}
+
+	perms = append(perms,
+		permission{verb: "get", resource: "nodes", feature: "AZ from node labels", optional: true},
+		permission{verb: "create", group: "batch", resource: "jobs", namespace: namespace, feature: "job creation"},
+	)
+
+	if s.conf.NodePoolPreflight {
+		perms = append(perms, permission{verb: "get", group: "karpenter.sh", resource: "nodepools", feature: "NODEPOOL_PREFLIGHT"})
+	}
+	if s.conf.ZoneMapConfigMap != "" {
+		perms = append(perms, permission{verb: "get", resource: "configmaps", namespace: s.conf.PodNamespace, feature: "ZONE_MAP_CONFIGMAP", optional: true})
+	}
+	if s.conf.JobProvenance {
+		perms = append(perms,
+			permission{verb: "get", resource: "pods", namespace: s.conf.PodNamespace, feature: "JOB_PROVENANCE", optional: true},
+			permission{verb: "get", group: "batch", resource: "jobs", namespace: s.conf.PodNamespace, feature: "JOB_PROVENANCE", optional: true},
+		)
+	}
+
+	// Restores only create the Job
+	if s.conf.LauncherMode == "restore" {
+		return perms
+	}
+
+	if s.conf.PauseConfigMap != "" {
+		perms = append(perms, permission{verb: "get", resource: "configmaps", namespace: s.conf.PodNamespace, feature: "PAUSE_CONFIGMAP"})
+	}
+	if s.conf.PauseAnnotation != "" {
+		perms = append(perms, permission{verb: "get", group: "apps", resource: "statefulsets", namespace: namespace, feature: "PAUSE_ANNOTATION"})
+	}
+	if s.conf.FreshnessWindow > 0 {
+		perms = append(perms, permission{verb: "list", group: "batch", resource: "jobs", namespace: namespace, feature: "FRESHNESS_WINDOW"})
+	}
+	if s.conf.UnschedulableTimeout > 0 {
+		perms = append(perms,
+			permission{verb: "list", resource: "pods", namespace: namespace, feature: "UNSCHEDULABLE_TIMEOUT"},
+			permission{verb: "delete", group: "batch", resource: "jobs", namespace: namespace, feature: "UNSCHEDULABLE_TIMEOUT"},
+		)
+	}
+	if s.conf.VerifyBackups || s.conf.ProtectSourcePod || s.conf.MemberFreezeDuration > 0 {
+		perms = append(perms, permission{verb: "get", group: "batch", resource: "jobs", namespace: namespace, feature: "waiting for the backup job"})
+	}
+	if s.conf.VerifyBackups {
+		perms = append(perms,
+			permission{verb: "patch", group: "batch", resource: "jobs", namespace: namespace, feature: "VERIFY_BACKUPS"},
+			permission{verb: "create", resource: "configmaps", namespace: namespace, feature: "VERIFY_BACKUPS"},
+		)
+	}
+	if s.conf.ProtectSourcePod {
+		perms = append(perms,
+			permission{verb: "list", resource: "pods", namespace: namespace, feature: "PROTECT_SOURCE_POD", optional: true},
+			permission{verb: "patch", resource: "pods", namespace: namespace, feature: "PROTECT_SOURCE_POD", optional: true},
+		)
+	}
+	if s.conf.ProtectSourceNode {
+		perms = append(perms,
+			permission{verb: "list", resource: "nodes", feature: "PROTECT_SOURCE_NODE", optional: true},
+			permission{verb: "patch", resource: "nodes", feature: "PROTECT_SOURCE_NODE", optional: true},
+		)
+	}
+
+	return perms
+}
+
+// seedNamespace is the namespace a MONGODB_URI seed host runs in. Seeds can be members (<pod>.<service>.<namespace>.svc) or the
+// headless service itself (<service>.<namespace>.svc). Anything else, e.g. localhost or a member outside the cluster, uses the
+// launcher's namespace, as that is where their Jobs go.
+func (s *Service) seedNamespace(host string) string {
+	name, _, _ := strings.Cut(host, ":")
+	if parts := strings.Split(name, "."); len(parts) > 2 && parts[2] == "svc" {
+		return parts[1]
+	}
+
+	return s.memberNamespace(host)
+}
+
+// memberNamespaces are the namespaces the MONGODB_URI seed hosts run in, which is where Jobs, pods and StatefulSets are used.
+func (s *Service) memberNamespaces() []string {
+	var namespaces []string
+	for _, host := range s.conf.MongoDBSeedHosts {
+		if namespace := s.seedNamespace(host); !slices.Contains(namespaces, namespace) {
+			namespaces = append(namespaces, namespace)
+		}
+	}
+	if len(namespaces) == 0 {
+		namespaces = append(namespaces, s.conf.PodNamespace)
+	}
+
+	return namespaces
+}
+
+// CheckPermissions runs a SelfSubjectAccessReview for every permission needed in MongoDB's namespaces, failing with all of the
+// missing ones at once rather than part way through a run. It is run once at startup, before connecting to MongoDB.
+func (s *Service) CheckPermissions() error {
+	if !s.conf.RBACSelfCheck {
+		return nil
+	}
+
+	var perms []permission
+	for _, namespace := range s.memberNamespaces() {
+		for _, p := range s.requiredPermissions(namespace) {
+			if !slices.Contains(perms, p) {
+				perms = append(perms, p)
+			}
+		}
+	}
+
+	var missing, degraded []permission
+	for _, p := range perms {
+		review, err := s.conf.K8sClient.AuthorizationV1().SelfSubjectAccessReviews().Create(context.Background(), &authorizationv1.SelfSubjectAccessReview{
+			Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+				ResourceAttributes: &authorizationv1.ResourceAttributes{
+					Namespace: p.namespace,
+					Verb:      p.verb,
+					Group:     p.group,
+					Resource:  p.resource,
+				},
+			},
+		}, metav1.CreateOptions{})
+		if err != nil {
+			return fmt.Errorf("creating SelfSubjectAccessReview: %w", err)
+		}
+
+		if review.Status.Allowed {
+			continue
+		}
+		if p.optional {
+			degraded = append(degraded, p)
+			continue
+		}
+		missing = append(missing, p)
+	}
+
+	for _, p := range degraded {
+		slog.Warn("Missing optional RBAC permission", "verb", p.verb, "resource", p.qualifiedResource(), "namespace", p.namespace, "feature", p.feature)
+	}
+
+	if len(missing) == 0 {
+		slog.Debug("RBAC self-check passed", "permissions", len(perms))
+		return nil
+	}
+
+	return fmt.Errorf("missing RBAC permissions:\n%s", formatPermissions(missing))
+}
+
+func (p permission) qualifiedResource() string {
+	if p.group == "" {
+		return p.resource
+	}
+
+	return p.resource + "." + p.group
+}
+
+// formatPermissions renders the missing permissions as a table, followed by the Role and ClusterRole rules which would grant them.
+func formatPermissions(perms []permission) string {
+	var b strings.Builder
+
+	w := tabwriter.NewWriter(&b, 0, 0, 2, ' ', 0)
+	_, _ = fmt.Fprintln(w, "VERB\tRESOURCE\tNAMESPACE\tNEEDED FOR")
+	for _, p := range perms {
+		namespace := p.namespace
+		if namespace == "" {
+			namespace = "(cluster)"
+		}
+		_, _ = fmt.Fprintf(w, "%s\t%s\t%s\t%s\n", p.verb, p.qualifiedResource(), namespace, p.feature)
+	}
+	_ = w.Flush()
+
+	// One Role per namespace, and a ClusterRole for the cluster-scoped resources
+	var scopes []string
+	for _, p := range perms {
+		if !slices.Contains(scopes, p.namespace) {
+			scopes = append(scopes, p.namespace)
+		}
+	}
+
+	for _, scope := range scopes {
+		if scope == "" {
+			b.WriteString("\nClusterRole rules:\n")
+		} else {
+			fmt.Fprintf(&b, "\nRole rules (namespace %s):\n", scope)
+		}
+
+		for _, r := range policyRules(perms, scope) {
+			fmt.Fprintf(&b, "- apiGroups: [%s]\n  resources: [%s]\n  verbs: [%s]\n", quoteJoin(r.APIGroups), quoteJoin(r.Resources), quoteJoin(r.Verbs))
+		}
+	}
+
+	return b.String()
+}
+
+// policyRules merges the permissions in one namespace (or "" for cluster-scoped) into a rule per resource.
+func policyRules(perms []permission, namespace string) []rbacv1.PolicyRule {
+	var rules []rbacv1.PolicyRule
+
+	for _, p := range perms {
+		if p.namespace != namespace {
+			continue
+		}
+
+		i := slices.IndexFunc(rules, func(r rbacv1.PolicyRule) bool {
+			return r.APIGroups[0] == p.group && r.Resources[0] == p.resource
+		})
+		if i == -1 {
+			rules = append(rules, rbacv1.PolicyRule{APIGroups: []string{p.group}, Resources: []string{p.resource}})
+			i = len(rules) - 1
+		}
+		if !slices.Contains(rules[i].Verbs, p.verb) {
+			rules[i].Verbs = append(rules[i].Verbs, p.verb)
+		}
+	}
+
+	return rules
+}
+
+// PolicyRules returns the Role rules (in the MongoDB namespace) and ClusterRole rules the launcher needs for its mode and enabled features,
+// including the optional ones.
+func (s *Service) PolicyRules(namespace string) ([]rbacv1.PolicyRule, []rbacv1.PolicyRule) {
+	perms := s.requiredPermissions(namespace)
+
+	return policyRules(perms, namespace), policyRules(perms, "")
+}
+
+func quoteJoin(values []string) string {
+	quoted := make([]string, len(values))
+	for i, v := range values {
+		quoted[i] = fmt.Sprintf("%q", v)
+	}
+
+	return strings.Join(quoted, ", ")
+}
@@ -0,0 +1,146 @@
+package service
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// withAccessReviews answers SelfSubjectAccessReviews, allowing everything except the denied "<verb> <resource>" pairs.
+func withAccessReviews(client *fake.Clientset, denied ...string) *fake.Clientset {
+	client.PrependReactor("create", "selfsubjectaccessreviews", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		review := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).DeepCopy()
+		attrs := review.Spec.ResourceAttributes
+
+		review.Status.Allowed = true
+		for _, d := range denied {
+			if d == attrs.Verb+" "+attrs.Resource {
+				review.Status.Allowed = false
+			}
+		}
+
+		return true, review, nil
+	})
+
+	return client
+}
+
+func Test_checkPermissions(t *testing.T) {
+	tests := []struct {
+		name          string
+		denied        []string
+		expectedError []string
+	}{
+		{name: "AllAllowed"},
+		{name: "OptionalMissing", denied: []string{"get nodes"}},
+		{name: "RequiredMissing", denied: []string{"create jobs", "delete jobs", "get nodepools"}, expectedError: []string{
+			"missing RBAC permissions:",
+			"create  jobs.batch              database   job creation",
+			"get     nodepools.karpenter.sh  (cluster)  NODEPOOL_PREFLIGHT",
+			"delete  jobs.batch              database   UNSCHEDULABLE_TIMEOUT",
+			"Role rules (namespace database):\n- apiGroups: [\"batch\"]\n  resources: [\"jobs\"]\n  verbs: [\"create\", \"delete\"]",
+			"ClusterRole rules:\n- apiGroups: [\"karpenter.sh\"]\n  resources: [\"nodepools\"]\n  verbs: [\"get\"]",
+		}},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := withAccessReviews(fake.NewClientset(), tc.denied...)
+
+			// No MongoDB client, as the check runs at startup before connecting
+			s := Service{conf: config.Config{
+				K8sClient:         k8sClient,
+				BackupType:        "daily",
+				PodNamespace:      "database",
+				RBACSelfCheck:     true,
+				NodePoolPreflight: true,
+			}}
+
+			perms := s.requiredPermissions("database")
+			assert.Contains(t, perms, permission{verb: "get", resource: "pods", namespace: "database", feature: "member lookup"})
+
+			if tc.expectedError == nil {
+				assert.NoError(t, s.CheckPermissions())
+				return
+			}
+
+			// Enable a feature with extra permissions
+			s.conf.UnschedulableTimeout = time.Minute
+			err := s.CheckPermissions()
+			assert.Error(t, err)
+			for _, e := range tc.expectedError {
+				assert.Contains(t, err.Error(), e)
+			}
+		})
+	}
+}
+
+func Test_checkPermissionsDisabled(t *testing.T) {
+	k8sClient := withAccessReviews(fake.NewClientset(), "create jobs")
+
+	s := Service{conf: config.Config{K8sClient: k8sClient, PodNamespace: "database"}}
+	assert.NoError(t, s.CheckPermissions())
+	assert.Empty(t, k8sClient.Actions(), "expected no access reviews when RBAC_SELF_CHECK is off")
+}
+
+func Test_checkPermissionsMemberNamespace(t *testing.T) {
+	k8sClient := withAccessReviews(fake.NewClientset())
+
+	// The launcher runs in its own namespace, apart from MongoDB
+	s := Service{conf: config.Config{
+		K8sClient:     k8sClient,
+		BackupType:    "daily",
+		PodNamespace:  "backups",
+		RBACSelfCheck: true,
+		LaunchEvents:  true,
+		MongoDBSeedHosts: []string{
+			"mongodb-0.mongodb.database.svc.cluster.local:27017",
+			"mongodb-1.mongodb.database.svc.cluster.local:27017",
+		},
+	}}
+	assert.NoError(t, s.CheckPermissions())
+
+	var reviewed []string
+	for _, action := range k8sClient.Actions() {
+		attrs := action.(k8stesting.CreateAction).GetObject().(*authorizationv1.SelfSubjectAccessReview).Spec.ResourceAttributes
+		reviewed = append(reviewed, attrs.Verb+" "+attrs.Resource+" "+attrs.Namespace)
+	}
+
+	assert.Contains(t, reviewed, "create jobs database")
+	assert.Contains(t, reviewed, "get pods database")
+	assert.NotContains(t, reviewed, "create jobs backups", "expected Jobs to be checked where MongoDB runs")
+	assert.Contains(t, reviewed, "create events backups", "expected events on the launcher's own pod to be checked in its namespace")
+	assert.Len(t, reviewed, len(slices.Compact(slices.Sorted(slices.Values(reviewed)))), "expected each permission to be checked once")
+}
+
+func Test_seedNamespace(t *testing.T) {
+	s := Service{conf: config.Config{PodNamespace: "backups"}}
+
+	tests := []struct {
+		host     string
+		expected string
+	}{
+		{host: "mongodb-0.mongodb.database.svc.cluster.local:27017", expected: "database"},
+		{host: "mongodb-0.mongodb.database.svc", expected: "database"},
+		{host: "mongodb-0.mongodb.database", expected: "backups"},
+		{host: "db1.example.com:27017", expected: "backups"},
+		{host: "mongodb.database.svc.cluster.local:27017", expected: "database"},
+		{host: "mongodb.database.svc", expected: "database"},
+		{host: "localhost:27017", expected: "backups"},
+		{host: "ip-10-0-1-5.eu-west-1.compute.internal:27017", expected: "backups"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.host, func(t *testing.T) {
+			assert.Equal(t, tc.expected, s.seedNamespace(tc.host))
+		})
+	}
+}
@@ -0,0 +1,222 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+
+	batchv1 "k8s.io/api/batch/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const (
+	doNotDisruptAnnotation = "karpenter.sh/do-not-disrupt"
+
+	// Set on the pods and nodes the launcher protects, holding the backup Job's name. A label, so stale protection can be found with a selector
+	protectedByLabel = "mongodb-backup-protected-by"
+	// The backup Job's namespace, as nodes are not namespaced
+	protectedByNamespaceAnnotation = "mongodb-backup-protected-by-namespace"
+)
+
+// protectedObject is a MongoDB pod or node which the launcher has marked do-not-disrupt.
+type protectedObject struct {
+	kind      string
+	namespace string
+	name      string
+}
+
+func (o protectedObject) String() string {
+	if o.namespace == "" {
+		return fmt.Sprintf("%s/%s", o.kind, o.name)
+	}
+
+	return fmt.Sprintf("%s/%s/%s", o.kind, o.namespace, o.name)
+}
+
+// holdSource keeps the source secondary in place for as long as the backup Job runs: protected from Karpenter disruption and frozen against elections.
+// Both are best effort; failing to apply or remove them never fails the backup.
+func (s *Service) holdSource(c candidate, job *batchv1.Job) {
+	if !s.conf.ProtectSourcePod && s.conf.MemberFreezeDuration == 0 {
+		return
+	}
+
+	protected := s.protectSource(c, job)
+	unfreeze := s.freezeMember(c.host)
+
+	if _, err := s.waitForJob(job.Namespace, job.Name, s.conf.JobWaitTimeout); err != nil {
+		// Both expire or get cleaned up on their own, and the backup may still be running
+		slog.Warn("Stopped waiting for the backup job. The source stays protected until a later run finds the job has finished, and frozen until the freeze expires", "Job", job.Name, "error", err.Error())
+		unfreeze(false)
+		return
+	}
+
+	unfreeze(true)
+	for _, o := range protected {
+		s.unprotect(o, job.Name)
+	}
+}
+
+// protectSource stops Karpenter disrupting the secondary being backed up, by marking its pod (and optionally node) do-not-disrupt, returning what it marked.
+func (s *Service) protectSource(c candidate, job *batchv1.Job) []protectedObject {
+	if !s.conf.ProtectSourcePod {
+		return nil
+	}
+	if c.pod == nil {
+		slog.Debug("Source member is outside the cluster. Nothing to protect", "host", c.host)
+		return nil
+	}
+
+	s.cleanupSourceProtection(c.pod.Namespace)
+
+	type target struct {
+		object protectedObject
+		meta   metav1.ObjectMeta
+	}
+
+	targets := []target{{object: protectedObject{kind: "pod", namespace: c.pod.Namespace, name: c.pod.Name}, meta: c.pod.ObjectMeta}}
+	if s.conf.ProtectSourceNode && c.node != nil {
+		targets = append(targets, target{object: protectedObject{kind: "node", name: c.node.Name}, meta: c.node.ObjectMeta})
+	}
+
+	var protected []protectedObject
+	for _, t := range targets {
+		// Already protected by someone else, who is responsible for removing it
+		if _, found := t.meta.Annotations[doNotDisruptAnnotation]; found && t.meta.Labels[protectedByLabel] == "" {
+			slog.Info("Source is already protected from disruption", "object", t.object.String())
+			continue
+		}
+
+		patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q},"annotations":{%q:"true",%q:%q}}}`,
+			protectedByLabel, job.Name, doNotDisruptAnnotation, protectedByNamespaceAnnotation, job.Namespace)
+		if err := s.patchProtectedObject(t.object, patch); err != nil {
+			slog.Warn("Unable to protect the source from disruption", "object", t.object.String(), "error", err.Error())
+			continue
+		}
+
+		slog.Info("Protected the source from disruption until the backup finishes", "object", t.object.String(), "Job", job.Name)
+		protected = append(protected, t.object)
+	}
+
+	return protected
+}
+
+// unprotect removes the protection, unless another backup Job has since taken it over.
+func (s *Service) unprotect(o protectedObject, jobName string) {
+	labels, err := s.protectedObjectLabels(o)
+	if errors.IsNotFound(err) {
+		return
+	}
+	if err != nil {
+		slog.Warn("Unable to remove disruption protection from the source", "object", o.String(), "error", err.Error())
+		return
+	}
+
+	if labels[protectedByLabel] != jobName {
+		slog.Debug("Source protection has been taken over by another backup", "object", o.String(), "Job", labels[protectedByLabel])
+		return
+	}
+
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:null},"annotations":{%q:null,%q:null}}}`,
+		protectedByLabel, doNotDisruptAnnotation, protectedByNamespaceAnnotation)
+	if err = s.patchProtectedObject(o, patch); err != nil {
+		slog.Warn("Unable to remove disruption protection from the source", "object", o.String(), "error", err.Error())
+		return
+	}
+
+	slog.Info("Removed disruption protection from the source", "object", o.String(), "Job", jobName)
+}
+
+// cleanupSourceProtection removes protection left behind by a launcher which exited before its backup Job finished.
+// Protection is stale once the Job it was applied for has finished or no longer exists.
+func (s *Service) cleanupSourceProtection(namespace string) {
+	ctx := context.Background()
+	selector := metav1.ListOptions{LabelSelector: protectedByLabel}
+
+	var stale []protectedObject
+	var jobs []string
+
+	pods, err := s.conf.K8sClient.CoreV1().Pods(namespace).List(ctx, selector)
+	if err != nil {
+		slog.Warn("Unable to list protected pods for cleanup", "namespace", namespace, "error", err.Error())
+	} else {
+		for _, pod := range pods.Items {
+			if s.protectionStale(pod.Namespace, pod.Labels[protectedByLabel]) {
+				stale = append(stale, protectedObject{kind: "pod", namespace: pod.Namespace, name: pod.Name})
+				jobs = append(jobs, pod.Labels[protectedByLabel])
+			}
+		}
+	}
+
+	if s.conf.ProtectSourceNode {
+		nodes, err := s.conf.K8sClient.CoreV1().Nodes().List(ctx, selector)
+		if err != nil {
+			slog.Warn("Unable to list protected nodes for cleanup", "error", err.Error())
+		} else {
+			for _, node := range nodes.Items {
+				if s.protectionStale(node.Annotations[protectedByNamespaceAnnotation], node.Labels[protectedByLabel]) {
+					stale = append(stale, protectedObject{kind: "node", name: node.Name})
+					jobs = append(jobs, node.Labels[protectedByLabel])
+				}
+			}
+		}
+	}
+
+	for i, o := range stale {
+		slog.Info("Cleaning up stale disruption protection", "object", o.String(), "Job", jobs[i])
+		s.unprotect(o, jobs[i])
+	}
+}
+
+func (s *Service) protectionStale(namespace, jobName string) bool {
+	if namespace == "" {
+		return false
+	}
+
+	job, err := s.conf.K8sClient.BatchV1().Jobs(namespace).Get(context.Background(), jobName, metav1.GetOptions{})
+	if errors.IsNotFound(err) {
+		return true
+	}
+	if err != nil {
+		slog.Warn("Unable to check whether source protection is stale", "Job", jobName, "namespace", namespace, "error", err.Error())
+		return false
+	}
+
+	finished, _ := jobFinished(job)
+
+	return finished
+}
+
+func (s *Service) protectedObjectLabels(o protectedObject) (map[string]string, error) {
+	if o.kind == "node" {
+		node, err := s.conf.K8sClient.CoreV1().Nodes().Get(context.Background(), o.name, metav1.GetOptions{})
+		if err != nil {
+			return nil, err
+		}
+		return node.Labels, nil
+	}
+
+	pod, err := s.conf.K8sClient.CoreV1().Pods(o.namespace).Get(context.Background(), o.name, metav1.GetOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	return pod.Labels, nil
+}
+
+func (s *Service) patchProtectedObject(o protectedObject, patch string) error {
+	var err error
+
+	switch o.kind {
+	case "pod":
+		_, err = s.conf.K8sClient.CoreV1().Pods(o.namespace).Patch(context.Background(), o.name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	case "node":
+		_, err = s.conf.K8sClient.CoreV1().Nodes().Patch(context.Background(), o.name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	}
+	if err != nil {
+		return fmt.Errorf("patching %s: %w", o.String(), err)
+	}
+
+	return nil
+}
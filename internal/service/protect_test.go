@@ -0,0 +1,142 @@
+package service
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_protectSource(t *testing.T) {
+	jobPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name               string
+		protectNode        bool
+		existingAnnotation bool
+		expectedPatched    []string
+	}{
+		{name: "PodOnly", expectedPatched: []string{"pods", "pods"}},
+		{name: "PodAndNode", protectNode: true, expectedPatched: []string{"pods", "nodes", "pods", "nodes"}},
+		{name: "AlreadyProtectedBySomeoneElse", existingAnnotation: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			pod := healthyPod("mongodb-1", "node1")
+			if tc.existingAnnotation {
+				pod.Annotations = map[string]string{doNotDisruptAnnotation: "true"}
+			}
+			node := healthyNode("node1", "eu-west-1a")
+			job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "targeted-mongodb-backups-00001", Namespace: "database"}}
+
+			k8sClient := withJobResults(fake.NewClientset(pod, node, job), map[string]batchv1.JobConditionType{"targeted-mongodb-backups-": batchv1.JobComplete})
+
+			s := Service{conf: config.Config{
+				K8sClient:         k8sClient,
+				ProtectSourcePod:  true,
+				ProtectSourceNode: tc.protectNode,
+				JobWaitTimeout:    time.Second,
+			}}
+
+			s.holdSource(candidate{pod: pod, node: node}, job)
+
+			var patched []string
+			for _, a := range k8sClient.Actions() {
+				if a.GetVerb() == "patch" {
+					patched = append(patched, a.GetResource().Resource)
+				}
+			}
+			assert.Equal(t, tc.expectedPatched, patched, "expected protection to be applied and then removed")
+
+			pod, err := k8sClient.CoreV1().Pods("database").Get(context.Background(), "mongodb-1", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Empty(t, pod.Labels[protectedByLabel])
+			if tc.existingAnnotation {
+				assert.Equal(t, "true", pod.Annotations[doNotDisruptAnnotation], "expected protection applied by someone else to be left alone")
+			} else {
+				assert.NotContains(t, pod.Annotations, doNotDisruptAnnotation)
+			}
+
+			node, err = k8sClient.CoreV1().Nodes().Get(context.Background(), "node1", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.NotContains(t, node.Annotations, doNotDisruptAnnotation)
+		})
+	}
+}
+
+func Test_protectSourceWhileRunning(t *testing.T) {
+	jobPollInterval = 10 * time.Millisecond
+
+	pod := healthyPod("mongodb-1", "node1")
+	node := healthyNode("node1", "eu-west-1a")
+	job := &batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "targeted-mongodb-backups-00001", Namespace: "database"}}
+	k8sClient := fake.NewClientset(pod, node, job)
+
+	s := Service{conf: config.Config{
+		K8sClient:        k8sClient,
+		ProtectSourcePod: true,
+		JobWaitTimeout:   50 * time.Millisecond,
+	}}
+
+	s.holdSource(candidate{pod: pod, node: node}, job)
+
+	// The launcher gave up waiting, so the protection is left for a later run to clean up
+	pod, err := k8sClient.CoreV1().Pods("database").Get(context.Background(), "mongodb-1", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, "true", pod.Annotations[doNotDisruptAnnotation])
+	assert.Equal(t, "targeted-mongodb-backups-00001", pod.Labels[protectedByLabel])
+	assert.Equal(t, "database", pod.Annotations[protectedByNamespaceAnnotation])
+}
+
+func Test_cleanupSourceProtection(t *testing.T) {
+	protectedPod := func(name, jobName string) *v1.Pod {
+		pod := healthyPod(name, "node1")
+		pod.Labels = map[string]string{protectedByLabel: jobName}
+		pod.Annotations = map[string]string{doNotDisruptAnnotation: "true", protectedByNamespaceAnnotation: "database"}
+		return pod
+	}
+
+	node := healthyNode("node2", "eu-west-1b")
+	node.Labels[protectedByLabel] = "finished-job"
+	node.Annotations = map[string]string{doNotDisruptAnnotation: "true", protectedByNamespaceAnnotation: "database"}
+
+	k8sClient := fake.NewClientset(
+		protectedPod("mongodb-0", "deleted-job"),
+		protectedPod("mongodb-1", "finished-job"),
+		protectedPod("mongodb-2", "running-job"),
+		node,
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{Name: "finished-job", Namespace: "database"},
+			Status:     batchv1.JobStatus{Conditions: []batchv1.JobCondition{{Type: batchv1.JobFailed, Status: v1.ConditionTrue}}},
+		},
+		&batchv1.Job{ObjectMeta: metav1.ObjectMeta{Name: "running-job", Namespace: "database"}},
+	)
+
+	s := Service{conf: config.Config{
+		K8sClient:         k8sClient,
+		ProtectSourcePod:  true,
+		ProtectSourceNode: true,
+	}}
+
+	s.cleanupSourceProtection("database")
+
+	for name, expected := range map[string]bool{"mongodb-0": false, "mongodb-1": false, "mongodb-2": true} {
+		pod, err := k8sClient.CoreV1().Pods("database").Get(context.Background(), name, metav1.GetOptions{})
+		assert.NoError(t, err)
+		_, protected := pod.Annotations[doNotDisruptAnnotation]
+		assert.Equal(t, expected, protected, name)
+	}
+
+	got, err := k8sClient.CoreV1().Nodes().Get(context.Background(), "node2", metav1.GetOptions{})
+	assert.NoError(t, err)
+	assert.NotContains(t, got.Annotations, doNotDisruptAnnotation)
+	assert.NotContains(t, got.Labels, protectedByLabel)
+}
@@ -0,0 +1,110 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"maps"
+
+	batchv1 "k8s.io/api/batch/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+const (
+	launcherPodLabel       = "launcher-pod"
+	launcherJobLabel       = "launcher-job"
+	launcherCronJobLabel   = "launcher-cronjob"
+	launcherNamespaceLabel = "launcher-namespace"
+)
+
+// provenance records which launcher Pod, and the Job and CronJob above it, created a backup Job.
+type provenance struct {
+	namespace string
+	pod       string
+	job       *batchv1.Job
+	cronJob   string
+}
+
+// launcherProvenance walks up the ownerReferences from the launcher's own Pod. It is looked up once per Service.
+func (s *Service) launcherProvenance() (*provenance, error) {
+	if s.provenance != nil {
+		return s.provenance, nil
+	}
+
+	ctx := context.Background()
+	p := &provenance{namespace: s.conf.PodNamespace, pod: s.conf.PodName}
+
+	pod, err := s.conf.K8sClient.CoreV1().Pods(s.conf.PodNamespace).Get(ctx, s.conf.PodName, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting launcher pod %s/%s: %w", s.conf.PodNamespace, s.conf.PodName, err)
+	}
+
+	if owner := metav1.GetControllerOf(pod); owner != nil && owner.Kind == "Job" {
+		p.job, err = s.conf.K8sClient.BatchV1().Jobs(s.conf.PodNamespace).Get(ctx, owner.Name, metav1.GetOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("getting launcher job %s/%s: %w", s.conf.PodNamespace, owner.Name, err)
+		}
+
+		if owner := metav1.GetControllerOf(p.job); owner != nil && owner.Kind == "CronJob" {
+			p.cronJob = owner.Name
+		}
+	}
+
+	slog.Debug("Launcher provenance", "pod", p.pod, "job", p.jobName(), "cronJob", p.cronJob)
+
+	s.provenance = p
+
+	return p, nil
+}
+
+func (p *provenance) jobName() string {
+	if p.job == nil {
+		return ""
+	}
+
+	return p.job.Name
+}
+
+// applyProvenance labels the Job with where it was launched from and, if configured, makes the launcher's Job its owner.
+// Provenance is best effort; failing to find it never stops a backup being launched.
+func (s *Service) applyProvenance(job *batchv1.Job) {
+	if !s.conf.JobProvenance {
+		return
+	}
+
+	p, err := s.launcherProvenance()
+	if err != nil {
+		slog.Warn("Unable to find launcher provenance. Created job will not be linked to the launcher", "error", err.Error())
+		return
+	}
+
+	// The pod template shares the same map, and only the Job should carry provenance
+	job.Labels = maps.Clone(job.Labels)
+	job.Labels[launcherNamespaceLabel] = p.namespace
+	job.Labels[launcherPodLabel] = p.pod
+	if p.job != nil {
+		job.Labels[launcherJobLabel] = p.job.Name
+	}
+	if p.cronJob != "" {
+		job.Labels[launcherCronJobLabel] = p.cronJob
+	}
+
+	if !s.conf.JobOwnerCascade {
+		return
+	}
+
+	// ownerReferences cannot cross namespaces, so the labels are the only link when the backup runs elsewhere
+	if p.job == nil || p.job.Namespace != job.Namespace {
+		slog.Warn("Not setting an owner on the created job. The launcher must be run by a Job in the same namespace", "namespace", job.Namespace, "launcherNamespace", p.namespace)
+		return
+	}
+
+	job.OwnerReferences = append(job.OwnerReferences, metav1.OwnerReference{
+		APIVersion:         batchv1.SchemeGroupVersion.String(),
+		Kind:               "Job",
+		Name:               p.job.Name,
+		UID:                p.job.UID,
+		BlockOwnerDeletion: pointer.Bool(true),
+	})
+}
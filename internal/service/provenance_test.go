@@ -0,0 +1,92 @@
+package service
+
+import (
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/utils/pointer"
+)
+
+func launcherObjects(namespace string) []runtime.Object {
+	return []runtime.Object{
+		&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "launcher-hourly-28000000-abcde",
+				Namespace: namespace,
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "batch/v1", Kind: "Job", Name: "launcher-hourly-28000000", UID: "job-uid", Controller: pointer.Bool(true)},
+				},
+			},
+		},
+		&batchv1.Job{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      "launcher-hourly-28000000",
+				Namespace: namespace,
+				UID:       "job-uid",
+				OwnerReferences: []metav1.OwnerReference{
+					{APIVersion: "batch/v1", Kind: "CronJob", Name: "launcher-hourly", UID: "cronjob-uid", Controller: pointer.Bool(true)},
+				},
+			},
+		},
+	}
+}
+
+func Test_applyProvenance(t *testing.T) {
+	tests := []struct {
+		name              string
+		launcherNamespace string
+		provenance        bool
+		cascade           bool
+		podName           string
+		expectLabels      bool
+		expectOwner       bool
+	}{
+		{name: "Disabled", launcherNamespace: "database", podName: "launcher-hourly-28000000-abcde"},
+		{name: "LabelsOnly", launcherNamespace: "database", provenance: true, podName: "launcher-hourly-28000000-abcde", expectLabels: true},
+		{name: "Cascade", launcherNamespace: "database", provenance: true, cascade: true, podName: "launcher-hourly-28000000-abcde", expectLabels: true, expectOwner: true},
+		{name: "CascadeOtherNamespace", launcherNamespace: "backups", provenance: true, cascade: true, podName: "launcher-hourly-28000000-abcde", expectLabels: true},
+		{name: "MissingPod", launcherNamespace: "database", provenance: true, podName: "not-a-pod"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewService(config.Config{
+				K8sClient:       fake.NewClientset(launcherObjects(tc.launcherNamespace)...),
+				BackupType:      "hourly",
+				PodName:         tc.podName,
+				PodNamespace:    tc.launcherNamespace,
+				JobProvenance:   tc.provenance,
+				JobOwnerCascade: tc.cascade,
+			})
+			assert.NoError(t, err)
+
+			job, err := s.createJob("mongodb-1.mongodb.database.svc.cluster.local", "eu-west-1a", "database", consistencyPoint{})
+			assert.NoError(t, err, "provenance must never stop a job being created")
+
+			if tc.expectLabels {
+				assert.Equal(t, "launcher-hourly-28000000-abcde", job.Labels[launcherPodLabel])
+				assert.Equal(t, "launcher-hourly-28000000", job.Labels[launcherJobLabel])
+				assert.Equal(t, "launcher-hourly", job.Labels[launcherCronJobLabel])
+				assert.Equal(t, tc.launcherNamespace, job.Labels[launcherNamespaceLabel])
+				assert.NotContains(t, job.Spec.Template.Labels, launcherPodLabel, "expected provenance only on the job")
+			} else {
+				assert.NotContains(t, job.Labels, launcherPodLabel)
+			}
+
+			if tc.expectOwner {
+				assert.Len(t, job.OwnerReferences, 1)
+				assert.Equal(t, "launcher-hourly-28000000", job.OwnerReferences[0].Name)
+				assert.Equal(t, "job-uid", string(job.OwnerReferences[0].UID))
+			} else {
+				assert.Empty(t, job.OwnerReferences)
+			}
+		})
+	}
+}
@@ -0,0 +1,172 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+)
+
+// Candidate states recorded in a launch's Result.
+const (
+	CandidateExcluded   = "excluded"
+	CandidateRejected   = "rejected"
+	CandidateFailedOver = "failed-over"
+	CandidateSelected   = "selected"
+	CandidateNotTried   = "not-tried"
+)
+
+// terminationMessageLimit is the most the kubelet reads from the termination log.
+const terminationMessageLimit = 4096
+
+// CandidateState is what happened to one replica set member during a launch.
+type CandidateState struct {
+	Member string `json:"member"`
+	State  string `json:"state"`
+	AZ     string `json:"az,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	// The zone resolver which found the AZ
+	ZoneResolver string `json:"zoneResolver,omitempty"`
+}
+
+// Report is the machine-readable record of a run, written on every exit.
+type Report struct {
+	Status          string    `json:"status"`
+	StartTime       time.Time `json:"startTime"`
+	EndTime         time.Time `json:"endTime"`
+	DurationSeconds float64   `json:"durationSeconds"`
+
+	Inputs ReportInputs `json:"inputs"`
+
+	Candidates []CandidateState `json:"candidates,omitempty"`
+	Member     string           `json:"member,omitempty"`
+	AZ         string           `json:"az,omitempty"`
+	Namespace  string           `json:"namespace,omitempty"`
+	JobName    string           `json:"jobName,omitempty"`
+	JobUID     string           `json:"jobUID,omitempty"`
+	Snapshot   string           `json:"snapshot,omitempty"`
+	CoveredBy  string           `json:"coveredBy,omitempty"`
+
+	Error string `json:"error,omitempty"`
+
+	// Set when the candidates were dropped to fit the termination message limit
+	Truncated bool `json:"truncated,omitempty"`
+}
+
+// ReportInputs are the settings which decide what a run does.
+type ReportInputs struct {
+	LauncherMode   string `json:"launcherMode"`
+	BackupMode     string `json:"backupMode"`
+	BackupType     string `json:"backupType,omitempty"`
+	ExcludeReplica string `json:"excludeReplica,omitempty"`
+	MemberOverride string `json:"memberOverride,omitempty"`
+	VerifyBackups  bool   `json:"verifyBackups"`
+}
+
+// NewReport builds the report for a run which started at start, from what it launched and the error it ended with.
+func NewReport(conf config.Config, start time.Time, result Result, err error) Report {
+	end := time.Now()
+
+	r := Report{
+		Status:          "succeeded",
+		StartTime:       start.UTC(),
+		EndTime:         end.UTC(),
+		DurationSeconds: end.Sub(start).Seconds(),
+		Inputs: ReportInputs{
+			LauncherMode:   conf.LauncherMode,
+			BackupMode:     conf.BackupMode,
+			BackupType:     conf.BackupType,
+			ExcludeReplica: conf.ExcludeReplica,
+			MemberOverride: conf.MemberOverride,
+			VerifyBackups:  conf.VerifyBackups,
+		},
+		Candidates: result.Candidates,
+		Member:     result.Member,
+		AZ:         result.AZ,
+		Namespace:  result.Namespace,
+		JobName:    result.JobName,
+		JobUID:     result.JobUID,
+		Snapshot:   result.Snapshot,
+		CoveredBy:  result.CoveredBy,
+	}
+
+	switch {
+	case errors.Is(err, ErrSkipped):
+		r.Status = "skipped"
+		r.Error = err.Error()
+	case err != nil:
+		r.Status = "failed"
+		r.Error = err.Error()
+	}
+
+	return r
+}
+
+// WriteReport writes the report to RUN_REPORT_FILE, if set, and to the termination log so it shows in the Pod's status.
+// Failing to write it is logged rather than changing the outcome of the run.
+func WriteReport(conf config.Config, r Report) {
+	if conf.ReportFile != "" {
+		b, err := json.MarshalIndent(r, "", "  ")
+		if err == nil {
+			err = os.WriteFile(conf.ReportFile, b, 0o644)
+		}
+		if err != nil {
+			slog.Warn("Unable to write the run report", "file", conf.ReportFile, "error", err.Error())
+		}
+	}
+
+	if conf.TerminationLogPath != "" {
+		b, err := terminationMessage(r)
+		if err == nil {
+			err = os.WriteFile(conf.TerminationLogPath, b, 0o644)
+		}
+		if err != nil {
+			slog.Debug("Unable to write the run report to the termination log", "file", conf.TerminationLogPath, "error", err.Error())
+		}
+	}
+}
+
+// terminationMessage marshals the report compactly, dropping the candidates if needed to fit in the termination message.
+func terminationMessage(r Report) ([]byte, error) {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling report: %w", err)
+	}
+	if len(b) <= terminationMessageLimit {
+		return b, nil
+	}
+
+	r.Candidates = nil
+	r.Truncated = true
+
+	b, err = json.Marshal(r)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling report: %w", err)
+	}
+	if len(b) > terminationMessageLimit {
+		// Cutting the bytes over the limit, plus a margin in case a multi-byte character is split, is always enough
+		cut := max(0, len(r.Error)-(len(b)-terminationMessageLimit)-8)
+		r.Error = strings.ToValidUTF8(r.Error[:cut], "")
+		return json.Marshal(r)
+	}
+
+	return b, nil
+}
+
+// recordCandidate sets the state of a member for the current launch, replacing any earlier state from before a failover.
+func (s *Service) recordCandidate(state CandidateState) {
+	for i := range s.candidates {
+		if s.candidates[i].Member == state.Member {
+			s.candidates[i] = state
+			return
+		}
+	}
+
+	s.candidates = append(s.candidates, state)
+}
@@ -0,0 +1,113 @@
+package service
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_runReport(t *testing.T) {
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-3.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-4.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+
+	dir := t.TempDir()
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient:      newMockReplicaSet(members),
+			K8sClient:          withGeneratedNames(fake.NewClientset(healthyPod("mongodb-2", "node2"), healthyNode("node2", "eu-west-1b"), healthyPod("mongodb-4", "node2"))),
+			LauncherMode:       "backup",
+			BackupMode:         "job",
+			BackupType:         "daily",
+			ExcludeReplica:     "mongodb-3.mongodb.database.svc.cluster.local",
+			ReportFile:         filepath.Join(dir, "report.json"),
+			TerminationLogPath: filepath.Join(dir, "termination-log"),
+		},
+	}
+
+	require.NoError(t, s.Run())
+
+	for _, file := range []string{"report.json", "termination-log"} {
+		b, err := os.ReadFile(filepath.Join(dir, file))
+		require.NoError(t, err)
+
+		var report Report
+		require.NoError(t, json.Unmarshal(b, &report), file)
+
+		assert.Equal(t, "succeeded", report.Status)
+		assert.Equal(t, "daily", report.Inputs.BackupType)
+		assert.Equal(t, "mongodb-3.mongodb.database.svc.cluster.local", report.Inputs.ExcludeReplica)
+		assert.Equal(t, "mongodb-2.mongodb.database.svc.cluster.local", report.Member)
+		assert.Equal(t, "eu-west-1b", report.AZ)
+		assert.Equal(t, "database", report.Namespace)
+		assert.NotEmpty(t, report.JobName)
+		assert.Empty(t, report.Error)
+		assert.False(t, report.EndTime.Before(report.StartTime))
+
+		// Members are ranked in replica set order here, as the mock doesn't report optimes
+		assert.Equal(t, []CandidateState{
+			{Member: "mongodb-3.mongodb.database.svc.cluster.local", State: CandidateExcluded, Reason: "EXCLUDE_REPLICA"},
+			{Member: "mongodb-1.mongodb.database.svc.cluster.local", State: CandidateRejected, Reason: `finding which availabilty zone to target: unable to find pod mongodb-1 in namespace database based on hostname mongodb-1.mongodb.database.svc.cluster.local: pods "mongodb-1" not found`},
+			{Member: "mongodb-2.mongodb.database.svc.cluster.local", State: CandidateSelected, AZ: "eu-west-1b", ZoneResolver: zoneResolverNodeLabel},
+			{Member: "mongodb-4.mongodb.database.svc.cluster.local", State: CandidateNotTried},
+		}, report.Candidates)
+	}
+}
+
+func Test_runReportFailure(t *testing.T) {
+	dir := t.TempDir()
+	conf := config.Config{TerminationLogPath: filepath.Join(dir, "termination-log")}
+
+	WriteReport(conf, NewReport(conf, time.Now(), Result{Member: "mongodb-1"}, errors.New("creating job: boom")))
+
+	b, err := os.ReadFile(conf.TerminationLogPath)
+	require.NoError(t, err)
+
+	var report Report
+	require.NoError(t, json.Unmarshal(b, &report))
+	assert.Equal(t, "failed", report.Status)
+	assert.Equal(t, "creating job: boom", report.Error)
+	assert.Equal(t, "mongodb-1", report.Member)
+}
+
+func Test_terminationMessageLimit(t *testing.T) {
+	long := strings.Repeat("é", terminationMessageLimit)
+
+	tests := []struct {
+		name      string
+		report    Report
+		truncated bool
+	}{
+		{name: "FitsAsIs", report: Report{Status: "succeeded", Candidates: []CandidateState{{Member: "mongodb-1", State: CandidateSelected}}}},
+		{name: "DropsCandidates", report: Report{Status: "failed", Candidates: []CandidateState{{Member: "mongodb-1", State: CandidateRejected, Reason: long}}}, truncated: true},
+		{name: "CutsError", report: Report{Status: "failed", Error: long}, truncated: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			b, err := terminationMessage(tc.report)
+			require.NoError(t, err)
+			assert.LessOrEqual(t, len(b), terminationMessageLimit)
+
+			var report Report
+			require.NoError(t, json.Unmarshal(b, &report))
+			assert.Equal(t, tc.truncated, report.Truncated)
+			assert.Equal(t, tc.report.Status, report.Status)
+		})
+	}
+}
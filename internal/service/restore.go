@@ -0,0 +1,93 @@
+package service
+
+import (
+	"fmt"
+	"log/slog"
+	"slices"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/pointer"
+)
+
+// restore launches a restore Job next to the current PRIMARY, which is the only member that accepts writes.
+func (s *Service) restore() (Result, error) {
+	var result Result
+
+	if !s.conf.RestoreConfirmed {
+		return result, fmt.Errorf("restore has not been confirmed")
+	}
+
+	targetHost, err := s.mongoDBPrimary()
+	if err != nil {
+		return result, fmt.Errorf("finding the MongoDB primary to restore to: %w", err)
+	}
+	result.Member = targetHost
+
+	targetAZ, targetNamespace, err := s.availabilityZoneToTarget(targetHost)
+	if err != nil {
+		return result, fmt.Errorf("finding which availabilty zone to target: %w", err)
+	}
+	result.AZ = targetAZ
+	result.Namespace = targetNamespace
+	s.event(nil, corev1.EventTypeNormal, reasonAZResolved, "member=%s az=%s", targetHost, targetAZ)
+	s.recordCandidate(CandidateState{Member: targetHost, State: CandidateSelected, AZ: targetAZ})
+
+	if slices.Contains(s.conf.ProtectedNamespaces, targetNamespace) {
+		return result, fmt.Errorf("refusing to restore to PRIMARY %s in protected namespace %s. Restore to a scratch replica set instead", targetHost, targetNamespace)
+	}
+
+	if err = s.checkNodePool(targetAZ); err != nil {
+		return result, fmt.Errorf("checking the NodePool can schedule the job: %w", err)
+	}
+
+	job, err := s.createRestoreJob(targetHost, targetAZ, targetNamespace)
+	if err != nil {
+		return result, fmt.Errorf("creating restore job: %w", err)
+	}
+	result.JobName = job.Name
+	result.JobUID = string(job.UID)
+	s.event(job, corev1.EventTypeNormal, reasonJobCreated, "job=%s namespace=%s member=%s az=%s backupID=%s", job.Name, job.Namespace, targetHost, targetAZ, s.conf.RestoreBackupID)
+
+	return result, nil
+}
+
+func (s *Service) createRestoreJob(mongoDBHost, az, namespace string) (*batchv1.Job, error) {
+	labels := map[string]string{
+		"app": "mongodb-restores",
+	}
+	annotations := map[string]string{
+		"restore-backup-id": s.conf.RestoreBackupID,
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "MONGO_HOSTLIST",
+			Value: mongoDBHost,
+		},
+		{
+			Name:  "RESTORE_BACKUP_ID",
+			Value: s.conf.RestoreBackupID,
+		},
+	}
+
+	job := s.newJob("targeted-mongodb-restores-", namespace, az, labels, annotations,
+		[]string{"/usr/local/bin/mongorestore_k8s.sh", s.conf.RestoreBackupID}, env)
+
+	// A restore which fails part way leaves a half restored database, so it is never retried automatically
+	job.Spec.BackoffLimit = pointer.Int32(0)
+
+	ctx, span := s.startSpan("k8s.job.create", attrMember.String(mongoDBHost), attrAZ.String(az), attrNamespace.String(namespace))
+	job, err := s.conf.K8sClient.BatchV1().Jobs(namespace).Create(ctx, job, metav1.CreateOptions{})
+	if err == nil {
+		span.SetAttributes(attrJob.String(job.Name))
+	}
+	endSpan(span, err)
+	if err != nil {
+		return nil, fmt.Errorf("creating K8s jobs client: %w", err)
+	}
+
+	slog.Info("Restore job created", "Job", job.Name, "backupID", s.conf.RestoreBackupID, "host", mongoDBHost)
+
+	return job, nil
+}
@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_restore(t *testing.T) {
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+	}
+
+	tests := []struct {
+		name                string
+		members             []member
+		confirmed           bool
+		protectedNamespaces []string
+		expectedError       bool
+	}{
+		{name: "Good", members: members, confirmed: true, protectedNamespaces: []string{"production"}},
+		{name: "NotConfirmed", members: members, confirmed: false, expectedError: true},
+		{name: "ProtectedNamespace", members: members, confirmed: true, protectedNamespaces: []string{"database"}, expectedError: true},
+		{name: "NoPrimary", members: members[:1], confirmed: true, expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := fake.NewClientset(
+				&v1.Pod{
+					ObjectMeta: metav1.ObjectMeta{Name: "mongodb-1", Namespace: "database"},
+					Spec:       v1.PodSpec{NodeName: "node1"},
+				},
+				&v1.Node{
+					ObjectMeta: metav1.ObjectMeta{
+						Name:   "node1",
+						Labels: map[string]string{"topology.kubernetes.io/zone": "eu-west-1b"},
+					},
+				},
+			)
+
+			s := Service{
+				conf: config.Config{
+					MongoDBClient:       newMockReplicaSet(tc.members),
+					K8sClient:           k8sClient,
+					LauncherMode:        "restore",
+					RestoreBackupID:     "daily/2025-01-01T00:00:00Z",
+					RestoreConfirmed:    tc.confirmed,
+					ProtectedNamespaces: tc.protectedNamespaces,
+				},
+			}
+
+			err := s.Run()
+
+			jobs, listErr := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+			assert.NoError(t, listErr)
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				assert.Empty(t, jobs.Items, "expected no restore job to be created")
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Len(t, jobs.Items, 1)
+
+			job := jobs.Items[0]
+			assert.Equal(t, "mongodb-restores", job.Labels["app"])
+			assert.Equal(t, "daily/2025-01-01T00:00:00Z", job.Annotations["restore-backup-id"])
+			assert.Equal(t, "mongodb-backups", job.Spec.Template.Spec.Tolerations[0].Key, "expected the same toleration as backup jobs")
+			assert.Equal(t, []string{"/usr/local/bin/mongorestore_k8s.sh", "daily/2025-01-01T00:00:00Z"}, job.Spec.Template.Spec.Containers[0].Command)
+			assert.Equal(t, int32(0), *job.Spec.BackoffLimit, "expected a failed restore not to be retried")
+
+			zone := job.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0]
+			assert.Equal(t, []string{"eu-west-1b"}, zone.Values, "expected the job to be pinned to the primary's AZ")
+
+			env := map[string]string{}
+			for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+				env[e.Name] = e.Value
+			}
+			assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", env["MONGO_HOSTLIST"])
+		})
+	}
+}
@@ -1,33 +1,194 @@
 package service
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"github.com/michaelprice232/mongodb-backup-launcher/config"
+	"log/slog"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
 )
 
 type Service struct {
 	conf config.Config
+
+	provenance *provenance
+
+	// Set once reading nodes has been forbidden, so zone resolution stops trying
+	nodesForbidden bool
+
+	// Only set while a launch is running, if LAUNCH_EVENTS is enabled
+	recorder record.EventRecorder
+
+	// The context of the current launch's span, which every step's span is a child of
+	traceCtx context.Context
+
+	// What happened to each member during the current launch
+	candidates []CandidateState
+
+	// Tried in order to find each member's AZ
+	zoneResolvers []ZoneResolver
+
+	// Resolvers added by the caller, which ZONE_RESOLVERS can name alongside the built-in ones
+	extraZoneResolvers []ZoneResolver
+
+	// Changes the caller makes to every Job, e.g. per-schedule settings in controller mode
+	jobOverrides JobOverrides
+
+	// ZONE_MAP_CONFIGMAP's mappings, read at most once per launch
+	configMapZones       []config.ZoneMapping
+	configMapZonesLoaded bool
 }
 
-func NewService(conf config.Config) (*Service, error) {
-	return &Service{conf: conf}, nil
+// Result describes what a launch selected and created, for callers that need more than success or failure.
+type Result struct {
+	Member    string
+	AZ        string
+	Namespace string
+	JobName   string
+	JobUID    string
+	Snapshot  string
+
+	// Every member considered, in the order they were first considered
+	Candidates []CandidateState
+
+	// The <namespace>/<name> of the recent backup Job which made this run unnecessary, when it was skipped for freshness
+	CoveredBy string
 }
 
-func (s *Service) Run() error {
-	targetHost, err := s.mongoDBReadReplicaToTarget()
-	if err != nil {
-		return fmt.Errorf("finding which secondary MongoDB replica to target: %w", err)
+// Option customises a Service with what can't be set through config.Config, such as extra zone resolvers.
+type Option func(*Service)
+
+func NewService(conf config.Config, opts ...Option) (*Service, error) {
+	s := &Service{conf: conf}
+	for _, opt := range opts {
+		opt(s)
 	}
 
-	targetAZ, targetNamespace, err := s.availabilityZoneToTarget(targetHost)
+	resolvers, err := s.newZoneResolvers(conf.ZoneResolvers)
 	if err != nil {
-		return fmt.Errorf("finding which availabilty zone to target: %w", err)
+		return nil, err
+	}
+	s.zoneResolvers = resolvers
+
+	return s, nil
+}
+
+// Run launches once and writes the run report, whatever the outcome.
+func (s *Service) Run() error {
+	start := time.Now()
+
+	result, err := s.Launch()
+	WriteReport(s.conf, NewReport(s.conf, start, result, err))
+
+	return err
+}
+
+// Launch selects a target member and creates the backup (or restore) against it, returning what was selected and created.
+func (s *Service) Launch() (Result, error) {
+	stopEvents := s.startEvents()
+	defer stopEvents()
+
+	ctx, span := otel.Tracer(tracerName).Start(context.Background(), "launch", trace.WithAttributes(
+		attribute.String("launcher.mode", s.conf.LauncherMode),
+		attribute.String("backup.mode", s.conf.BackupMode),
+		attribute.String("backup.type", s.conf.BackupType),
+	))
+	s.traceCtx = ctx
+	defer func() { s.traceCtx = nil }()
+
+	s.candidates = nil
+	s.configMapZones, s.configMapZonesLoaded = nil, false
+	result, err := s.launch()
+	result.Candidates = s.candidates
+	switch {
+	case errors.Is(err, ErrSkipped):
+		slog.Info("Skipped launching", "reason", err.Error())
+		s.event(nil, corev1.EventTypeNormal, reasonLaunchSkipped, "reason=%q", err.Error())
+	case err != nil:
+		s.event(nil, corev1.EventTypeWarning, reasonLaunchFailed, "member=%s error=%q", result.Member, err.Error())
+	}
+
+	span.SetAttributes(attrMember.String(result.Member), attrAZ.String(result.AZ), attrNamespace.String(result.Namespace), attrJob.String(result.JobName))
+	if errors.Is(err, ErrSkipped) {
+		span.SetAttributes(attribute.String("launch.skipped", err.Error()))
+		span.End()
+	} else {
+		endSpan(span, err)
+	}
+
+	return result, err
+}
+
+// pinger is implemented by MongoDB clients which connect lazily, so the connection can be timed separately from the first command.
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+func (s *Service) connectMongoDB() error {
+	p, ok := s.conf.MongoDBClient.(pinger)
+	if !ok {
+		return nil
 	}
 
-	_, err = s.createJob(targetHost, targetAZ, targetNamespace)
+	ctx, span := s.startSpan("mongodb.connect")
+	err := p.Ping(ctx)
+	endSpan(span, err)
 	if err != nil {
-		return fmt.Errorf("creating job: %w", err)
+		return fmt.Errorf("connecting to MongoDB: %w", err)
 	}
 
 	return nil
 }
+
+func (s *Service) launch() (Result, error) {
+	// Restores are run by hand, so are never held back by blackout windows or the pause switch
+	if s.conf.LauncherMode != "restore" {
+		if err := s.checkBlackout(time.Now()); err != nil {
+			return Result{}, err
+		}
+		if err := s.checkPauseConfigMap(); err != nil {
+			return Result{}, err
+		}
+	}
+
+	if err := s.connectMongoDB(); err != nil {
+		return Result{}, err
+	}
+
+	if s.conf.LauncherMode == "restore" {
+		return s.restore()
+	}
+
+	if s.conf.BackupMode == "snapshot" {
+		var result Result
+
+		targetHost, cp, err := s.mongoDBReadReplicaToTarget()
+		if err != nil {
+			return result, fmt.Errorf("finding which secondary MongoDB replica to target: %w", err)
+		}
+		result.Member = targetHost
+		s.event(nil, corev1.EventTypeNormal, reasonMemberSelected, "member=%s", targetHost)
+
+		if err = s.checkPauseAnnotation(targetHost); err != nil {
+			return result, err
+		}
+
+		snapshot, err := s.createSnapshot(targetHost, cp)
+		if err != nil {
+			return result, fmt.Errorf("creating snapshot: %w", err)
+		}
+		result.Namespace = snapshot.GetNamespace()
+		result.Snapshot = snapshot.GetName()
+
+		return result, nil
+	}
+
+	return s.launchBackupJob()
+}
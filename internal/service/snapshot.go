@@ -0,0 +1,182 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+var volumeSnapshotGVR = schema.GroupVersionResource{
+	Group:    "snapshot.storage.k8s.io",
+	Version:  "v1",
+	Resource: "volumesnapshots",
+}
+
+// fsyncUnlockTimeout bounds the fsyncUnlock, so a hung member can't hold the launcher forever. The lock is then left for an operator.
+const fsyncUnlockTimeout = 30 * time.Second
+
+// snapshotPollInterval is how often the VolumeSnapshot is checked for readiness. Overridden in tests.
+var snapshotPollInterval = 5 * time.Second
+
+type commandResult struct {
+	OK     int    `bson:"ok"`
+	ErrMsg string `bson:"errmsg"`
+}
+
+// runMemberCommand runs an admin command against a single member and checks it completed successfully.
+func runMemberCommand(ctx context.Context, client config.MongoDBClient, cmd bson.D) error {
+	var result commandResult
+	if err := client.RunCommand(ctx, cmd).Decode(&result); err != nil {
+		return err
+	}
+	if result.OK != 1 {
+		return fmt.Errorf("command did not complete successfully: %s", result.ErrMsg)
+	}
+
+	return nil
+}
+
+// snapshotPVCName finds the PVC backing the MongoDB data volume of the pod.
+func (s *Service) snapshotPVCName(pod *corev1.Pod) (string, error) {
+	var claims []string
+	for _, v := range pod.Spec.Volumes {
+		if v.PersistentVolumeClaim == nil {
+			continue
+		}
+		if s.conf.SnapshotVolume != "" && v.Name == s.conf.SnapshotVolume {
+			return v.PersistentVolumeClaim.ClaimName, nil
+		}
+		claims = append(claims, v.PersistentVolumeClaim.ClaimName)
+	}
+
+	if s.conf.SnapshotVolume != "" {
+		return "", fmt.Errorf("pod %s has no PVC backed volume named '%s'", pod.Name, s.conf.SnapshotVolume)
+	}
+	if len(claims) != 1 {
+		return "", fmt.Errorf("pod %s has %d PVC backed volumes. Set SNAPSHOT_VOLUME to choose which to snapshot", pod.Name, len(claims))
+	}
+
+	return claims[0], nil
+}
+
+// createSnapshot takes a CSI VolumeSnapshot of the target member's PVC, whilst the member is fsyncLocked so the files on disk are consistent.
+func (s *Service) createSnapshot(mongoDBHost string, cp consistencyPoint) (*unstructured.Unstructured, error) {
+	pod, err := s.replicaPod(mongoDBHost)
+	if err != nil {
+		return nil, fmt.Errorf("finding pod for snapshot: %w", err)
+	}
+
+	pvcName, err := s.snapshotPVCName(pod)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx := context.Background()
+
+	member, err := s.conf.MongoDBMemberConnector.ConnectToMember(ctx, mongoDBHost)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to member %s: %w", mongoDBHost, err)
+	}
+	defer func() {
+		if err := member.Disconnect(context.Background()); err != nil {
+			slog.Warn("disconnecting from member", "host", mongoDBHost, "error", err.Error())
+		}
+	}()
+
+	// The lock outlives the connection, so it must be released regardless of how the snapshot went. This includes when the lock
+	// command itself errors, as the member may have been locked before the reply was lost
+	defer func() {
+		unlockCtx, cancel := context.WithTimeout(context.Background(), fsyncUnlockTimeout)
+		defer cancel()
+
+		if err := runMemberCommand(unlockCtx, member, bson.D{{Key: "fsyncUnlock", Value: 1}}); err != nil {
+			slog.Error("Unable to run fsyncUnlock. The member may still be locked against writes until db.fsyncUnlock() is run on it by hand",
+				"host", mongoDBHost, "timeout", fsyncUnlockTimeout, "error", err.Error())
+			s.event(nil, corev1.EventTypeWarning, reasonUnlockFailed, "member=%s error=%q. Run db.fsyncUnlock() on the member by hand", mongoDBHost, err.Error())
+			return
+		}
+		slog.Info("Unlocked member", "host", mongoDBHost)
+	}()
+
+	// https://www.mongodb.com/docs/manual/reference/command/fsync/
+	slog.Info("Locking member for snapshot", "host", mongoDBHost)
+	if err = runMemberCommand(ctx, member, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}}); err != nil {
+		return nil, fmt.Errorf("running fsyncLock on %s: %w", mongoDBHost, err)
+	}
+
+	annotations := consistencyAnnotations(cp)
+	annotations["created-by"] = s.conf.Hostname
+
+	labels := map[string]interface{}{}
+	for k, v := range s.backupLabels() {
+		labels[k] = v
+	}
+	annotationsObj := map[string]interface{}{}
+	for k, v := range annotations {
+		annotationsObj[k] = v
+	}
+
+	spec := map[string]interface{}{
+		"source": map[string]interface{}{
+			"persistentVolumeClaimName": pvcName,
+		},
+	}
+	if s.conf.SnapshotClass != "" {
+		spec["volumeSnapshotClassName"] = s.conf.SnapshotClass
+	}
+
+	snapshot := &unstructured.Unstructured{Object: map[string]interface{}{
+		"apiVersion": "snapshot.storage.k8s.io/v1",
+		"kind":       "VolumeSnapshot",
+		"metadata": map[string]interface{}{
+			"name":        fmt.Sprintf("targeted-mongodb-backups-%s-%d", s.conf.BackupType, time.Now().Unix()),
+			"namespace":   pod.Namespace,
+			"labels":      labels,
+			"annotations": annotationsObj,
+		},
+		"spec": spec,
+	}}
+
+	snapshots := s.conf.K8sDynamicClient.Resource(volumeSnapshotGVR).Namespace(pod.Namespace)
+
+	created, err := snapshots.Create(ctx, snapshot, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating VolumeSnapshot: %w", err)
+	}
+	slog.Info("VolumeSnapshot created", "snapshot", created.GetName(), "pvc", pvcName)
+
+	err = wait.PollUntilContextTimeout(ctx, snapshotPollInterval, s.conf.SnapshotReadyTimeout, true, func(ctx context.Context) (bool, error) {
+		current, err := snapshots.Get(ctx, created.GetName(), metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting VolumeSnapshot: %w", err)
+		}
+
+		if msg, found, _ := unstructured.NestedString(current.Object, "status", "error", "message"); found {
+			return false, fmt.Errorf("VolumeSnapshot reported an error: %s", msg)
+		}
+
+		ready, _, _ := unstructured.NestedBool(current.Object, "status", "readyToUse")
+		if ready {
+			created = current
+		}
+
+		return ready, nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("waiting for VolumeSnapshot %s to be ready: %w", created.GetName(), err)
+	}
+
+	slog.Info("VolumeSnapshot ready", "snapshot", created.GetName())
+
+	return created, nil
+}
@@ -0,0 +1,199 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+type mockMemberClient struct {
+	mockMongoClient
+}
+
+func (m *mockMemberClient) Database(name string) config.MongoDBClient {
+	args := m.Called(name)
+	return args.Get(0).(config.MongoDBClient)
+}
+
+func (m *mockMemberClient) Disconnect(ctx context.Context) error {
+	args := m.Called(ctx)
+	return args.Error(0)
+}
+
+type mockMemberConnector struct {
+	mock.Mock
+}
+
+func (m *mockMemberConnector) ConnectToMember(ctx context.Context, host string) (config.MongoDBMemberClient, error) {
+	args := m.Called(ctx, host)
+	return args.Get(0).(config.MongoDBMemberClient), args.Error(1)
+}
+
+// newMockMember returns a member client which answers every command with ok: 1.
+func newMockMember() *mockMemberClient {
+	result := new(mockSingleResult)
+	result.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*commandResult).OK = 1
+	}).Return(nil)
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, mock.Anything).Return(result)
+	member.On("Disconnect", mock.Anything).Return(nil)
+
+	return member
+}
+
+func mongoPodWithVolumes(volumes ...v1.Volume) *v1.Pod {
+	return &v1.Pod{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      "mongodb-1",
+			Namespace: "database",
+		},
+		Spec: v1.PodSpec{
+			NodeName: "node1",
+			Volumes:  volumes,
+		},
+	}
+}
+
+func pvcVolume(name, claim string) v1.Volume {
+	return v1.Volume{
+		Name: name,
+		VolumeSource: v1.VolumeSource{
+			PersistentVolumeClaim: &v1.PersistentVolumeClaimVolumeSource{ClaimName: claim},
+		},
+	}
+}
+
+func Test_createSnapshot(t *testing.T) {
+	snapshotPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name          string
+		status        map[string]interface{}
+		expectedError bool
+	}{
+		{name: "Ready", status: map[string]interface{}{"readyToUse": true}},
+		{name: "SnapshotError", status: map[string]interface{}{"error": map[string]interface{}{"message": "quota exceeded"}}, expectedError: true},
+		{name: "NeverReady", status: map[string]interface{}{"readyToUse": false}, expectedError: true},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			dynamicClient := dynamicfake.NewSimpleDynamicClient(runtime.NewScheme())
+			dynamicClient.PrependReactor("get", "volumesnapshots", func(action k8stesting.Action) (bool, runtime.Object, error) {
+				name := action.(k8stesting.GetAction).GetName()
+				obj, err := dynamicClient.Tracker().Get(volumeSnapshotGVR, "database", name)
+				if err != nil {
+					return true, nil, err
+				}
+				u := obj.(*unstructured.Unstructured).DeepCopy()
+				u.Object["status"] = tc.status
+				return true, u, nil
+			})
+
+			member := newMockMember()
+			connector := new(mockMemberConnector)
+			connector.On("ConnectToMember", mock.Anything, "mongodb-1.mongodb.database.svc.cluster.local").Return(member, nil)
+
+			s := Service{
+				conf: config.Config{
+					K8sClient:              fake.NewClientset(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1"))),
+					K8sDynamicClient:       dynamicClient,
+					MongoDBMemberConnector: connector,
+					BackupType:             "daily",
+					SnapshotReadyTimeout:   50 * time.Millisecond,
+				},
+			}
+
+			snapshot, err := s.createSnapshot("mongodb-1.mongodb.database.svc.cluster.local", consistencyPoint{ReplicaSet: "rs0"})
+
+			if tc.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+				assert.Equal(t, "mongodb-backups", snapshot.GetLabels()["app"])
+				assert.Equal(t, "daily", snapshot.GetLabels()["backup-type"])
+				assert.Equal(t, "rs0", snapshot.GetAnnotations()["mongodb-replica-set"])
+
+				pvc, _, _ := unstructured.NestedString(snapshot.Object, "spec", "source", "persistentVolumeClaimName")
+				assert.Equal(t, "datadir-mongodb-1", pvc)
+			}
+
+			// The member must be unlocked whatever happened to the snapshot
+			member.AssertCalled(t, "RunCommand", mock.Anything, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}})
+			member.AssertCalled(t, "RunCommand", mock.MatchedBy(func(ctx context.Context) bool {
+				_, bounded := ctx.Deadline()
+				return bounded
+			}), bson.D{{Key: "fsyncUnlock", Value: 1}})
+			member.AssertCalled(t, "Disconnect", mock.Anything)
+		})
+	}
+}
+
+func Test_createSnapshotLockFails(t *testing.T) {
+	lockResult := new(mockSingleResult)
+	lockResult.On("Decode", mock.Anything).Return(errors.New("connection reset"))
+	unlockResult := new(mockSingleResult)
+	unlockResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		args.Get(0).(*commandResult).OK = 1
+	}).Return(nil)
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, bson.D{{Key: "fsync", Value: 1}, {Key: "lock", Value: true}}).Return(lockResult)
+	member.On("RunCommand", mock.Anything, bson.D{{Key: "fsyncUnlock", Value: 1}}).Return(unlockResult)
+	member.On("Disconnect", mock.Anything).Return(nil)
+
+	connector := new(mockMemberConnector)
+	connector.On("ConnectToMember", mock.Anything, "mongodb-1.mongodb.database.svc.cluster.local").Return(member, nil)
+
+	s := Service{
+		conf: config.Config{
+			K8sClient:              fake.NewClientset(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1"))),
+			K8sDynamicClient:       dynamicfake.NewSimpleDynamicClient(runtime.NewScheme()),
+			MongoDBMemberConnector: connector,
+			BackupType:             "daily",
+		},
+	}
+
+	_, err := s.createSnapshot("mongodb-1.mongodb.database.svc.cluster.local", consistencyPoint{ReplicaSet: "rs0"})
+	assert.ErrorContains(t, err, "running fsyncLock")
+
+	// The reply to the lock may have been lost after the member locked, so the unlock must still be sent
+	member.AssertCalled(t, "RunCommand", mock.Anything, bson.D{{Key: "fsyncUnlock", Value: 1}})
+	member.AssertCalled(t, "Disconnect", mock.Anything)
+}
+
+func Test_snapshotPVCName(t *testing.T) {
+	s := Service{}
+
+	name, err := s.snapshotPVCName(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1"), v1.Volume{Name: "config"}))
+	assert.NoError(t, err)
+	assert.Equal(t, "datadir-mongodb-1", name)
+
+	_, err = s.snapshotPVCName(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1"), pvcVolume("logs", "logs-mongodb-1")))
+	assert.Error(t, err, "expected an error as there are multiple PVCs and no SNAPSHOT_VOLUME")
+
+	s.conf.SnapshotVolume = "logs"
+	name, err = s.snapshotPVCName(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1"), pvcVolume("logs", "logs-mongodb-1")))
+	assert.NoError(t, err)
+	assert.Equal(t, "logs-mongodb-1", name)
+
+	s.conf.SnapshotVolume = "missing"
+	_, err = s.snapshotPVCName(mongoPodWithVolumes(pvcVolume("datadir", "datadir-mongodb-1")))
+	assert.Error(t, err, "expected an error as the named volume does not exist")
+}
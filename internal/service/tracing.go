@@ -0,0 +1,62 @@
+package service
+
+import (
+	"context"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Span attribute keys, shared by every step so a trace can be filtered by member or Job.
+const (
+	attrMember    = attribute.Key("mongodb.member")
+	attrAZ        = attribute.Key("k8s.availability_zone")
+	attrNamespace = attribute.Key("k8s.namespace.name")
+	attrJob       = attribute.Key("k8s.job.name")
+)
+
+const tracerName = "github.com/michaelprice232/mongodb-backup-launcher/internal/service"
+
+// startSpan starts a span for one step of the launch, as a child of the launch's span. Without a TracerProvider it is a no-op.
+func (s *Service) startSpan(name string, attrs ...attribute.KeyValue) (context.Context, trace.Span) {
+	ctx := s.traceCtx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attrs...))
+}
+
+// endSpan records the error, if any, on the span and ends it.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// traceEnv passes the launch's trace context to a Job as TRACEPARENT (and TRACESTATE), so the backup script can attach child spans.
+// Nothing is returned when tracing isn't enabled.
+func (s *Service) traceEnv() []corev1.EnvVar {
+	if s.traceCtx == nil {
+		return nil
+	}
+
+	carrier := propagation.MapCarrier{}
+	otel.GetTextMapPropagator().Inject(s.traceCtx, carrier)
+
+	var env []corev1.EnvVar
+	if v := carrier.Get("traceparent"); v != "" {
+		env = append(env, corev1.EnvVar{Name: "TRACEPARENT", Value: v})
+	}
+	if v := carrier.Get("tracestate"); v != "" {
+		env = append(env, corev1.EnvVar{Name: "TRACESTATE", Value: v})
+	}
+
+	return env
+}
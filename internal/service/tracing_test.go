@@ -0,0 +1,91 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace/noop"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_launchTracing(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+
+	// The default global provider delegates to the first one set, so it is replaced with a no-op provider afterwards rather than restored
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+	t.Cleanup(func() {
+		otel.SetTracerProvider(noop.NewTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	})
+
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+	k8sClient := withGeneratedNames(fake.NewClientset(
+		healthyPod("mongodb-1", "node1"),
+		healthyNode("node1", "eu-west-1a"),
+	))
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient: newMockReplicaSet(members),
+			K8sClient:     k8sClient,
+			BackupType:    "daily",
+		},
+	}
+
+	result, err := s.Launch()
+	assert.NoError(t, err)
+
+	spans := exporter.GetSpans()
+	var names []string
+	for _, span := range spans {
+		names = append(names, span.Name)
+	}
+	assert.Equal(t, []string{"mongodb.replSetGetStatus", "k8s.pod.get", "k8s.node.get", "k8s.job.create", "launch"}, names)
+
+	// Every step is a child of the launch span
+	launch := spans[len(spans)-1]
+	for _, span := range spans[:len(spans)-1] {
+		assert.Equal(t, launch.SpanContext.SpanID(), span.Parent.SpanID(), span.Name)
+	}
+
+	attrs := map[string]string{}
+	for _, a := range launch.Attributes {
+		attrs[string(a.Key)] = a.Value.Emit()
+	}
+	assert.Equal(t, "mongodb-1.mongodb.database.svc.cluster.local", attrs["mongodb.member"])
+	assert.Equal(t, "eu-west-1a", attrs["k8s.availability_zone"])
+	assert.Equal(t, "database", attrs["k8s.namespace.name"])
+	assert.Equal(t, result.JobName, attrs["k8s.job.name"])
+
+	// The Job carries the trace context so the backup script can attach its own spans
+	job, err := k8sClient.BatchV1().Jobs("database").Get(context.Background(), result.JobName, metav1.GetOptions{})
+	assert.NoError(t, err)
+
+	env := map[string]string{}
+	for _, e := range job.Spec.Template.Spec.Containers[0].Env {
+		env[e.Name] = e.Value
+	}
+	assert.Equal(t, "00-"+launch.SpanContext.TraceID().String()+"-"+launch.SpanContext.SpanID().String()+"-01", env["TRACEPARENT"])
+}
+
+func Test_traceEnvWithoutTracing(t *testing.T) {
+	s := Service{}
+	assert.Empty(t, s.traceEnv())
+
+	_, span := s.startSpan("step")
+	assert.False(t, span.SpanContext().IsValid())
+	span.End()
+}
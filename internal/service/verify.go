@@ -0,0 +1,363 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"slices"
+	"time"
+
+	"go.mongodb.org/mongo-driver/v2/bson"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// ErrVerificationFailed is returned when a backup was created but the verification Job could not restore it, or it did not match the source.
+var ErrVerificationFailed = errors.New("backup verification failed")
+
+const verificationLabel = "backup-verification"
+
+// expectedDBHashKey is the key of the verification ConfigMap holding the expected dbHash, mounted into the verification Job under expectedDBHashDir.
+const (
+	expectedDBHashKey = "expected-dbhash.json"
+	expectedDBHashDir = "/etc/mongodb-backup-verification"
+)
+
+// verifyLabelGrace is how long a finished backup Job is kept beyond VERIFY_JOB_TIMEOUT, so the verification result can still be labelled on it.
+const verifyLabelGrace = 15 * time.Minute
+
+// jobPollInterval is how often Jobs are checked for completion. Overridden in tests.
+var jobPollInterval = 15 * time.Second
+
+type databaseHash struct {
+	Collections map[string]string `bson:"collections" json:"collections"`
+	MD5         string            `bson:"md5" json:"md5"`
+}
+
+type dbHashResult struct {
+	OK          int               `bson:"ok"`
+	ErrMsg      string            `bson:"errmsg"`
+	Collections map[string]string `bson:"collections"`
+	MD5         string            `bson:"md5"`
+}
+
+type listDatabasesResult struct {
+	OK        int    `bson:"ok"`
+	ErrMsg    string `bson:"errmsg"`
+	Databases []struct {
+		Name string `bson:"name"`
+	} `bson:"databases"`
+}
+
+// captureDBHash records the per-collection hashes of every user database on the member, for the verification Job to compare the restored dump against.
+func (s *Service) captureDBHash(mongoDBHost string) (map[string]databaseHash, error) {
+	ctx := context.Background()
+
+	member, err := s.conf.MongoDBMemberConnector.ConnectToMember(ctx, mongoDBHost)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to member %s: %w", mongoDBHost, err)
+	}
+	defer func() {
+		if err := member.Disconnect(context.Background()); err != nil {
+			slog.Warn("disconnecting from member", "host", mongoDBHost, "error", err.Error())
+		}
+	}()
+
+	var dbs listDatabasesResult
+	err = member.RunCommand(ctx, bson.D{{Key: "listDatabases", Value: 1}, {Key: "nameOnly", Value: true}}).Decode(&dbs)
+	if err != nil {
+		return nil, fmt.Errorf("listing databases: %w", err)
+	}
+	if dbs.OK != 1 {
+		return nil, fmt.Errorf("listing databases did not complete successfully: %s", dbs.ErrMsg)
+	}
+
+	hashes := make(map[string]databaseHash)
+	for _, db := range dbs.Databases {
+		if db.Name == "admin" || db.Name == "local" || db.Name == "config" {
+			continue
+		}
+
+		// https://www.mongodb.com/docs/manual/reference/command/dbHash/
+		var result dbHashResult
+		err = member.Database(db.Name).RunCommand(ctx, bson.D{{Key: "dbHash", Value: 1}}).Decode(&result)
+		if err != nil {
+			return nil, fmt.Errorf("getting dbHash of database %s: %w", db.Name, err)
+		}
+		if result.OK != 1 {
+			return nil, fmt.Errorf("dbHash of database %s did not complete successfully: %s", db.Name, result.ErrMsg)
+		}
+
+		hashes[db.Name] = databaseHash{
+			Collections: result.Collections,
+			MD5:         result.MD5,
+		}
+	}
+
+	slog.Debug("Captured dbHash", "host", mongoDBHost, "databases", len(hashes))
+
+	return hashes, nil
+}
+
+// stableHashes keeps only the collections whose hash was the same before and after the backup, as any written to during the run
+// may legitimately differ from the dump. A database's md5 covers every collection, so it is dropped if any were left out. The
+// collections left out are returned as <database>.<collection>.
+func stableHashes(before, after map[string]databaseHash) (map[string]databaseHash, []string) {
+	stable := make(map[string]databaseHash)
+	var changed []string
+
+	for db, b := range before {
+		a, found := after[db]
+		if !found {
+			for coll := range b.Collections {
+				changed = append(changed, db+"."+coll)
+			}
+			continue
+		}
+
+		collections := make(map[string]string)
+		for coll, hash := range b.Collections {
+			if a.Collections[coll] == hash {
+				collections[coll] = hash
+			} else {
+				changed = append(changed, db+"."+coll)
+			}
+		}
+
+		h := databaseHash{Collections: collections}
+		if len(collections) == len(b.Collections) && b.MD5 == a.MD5 {
+			h.MD5 = b.MD5
+		}
+		stable[db] = h
+	}
+	slices.Sort(changed)
+
+	return stable, changed
+}
+
+// waitForJob blocks until the Job completes or fails, returning whether it succeeded.
+func (s *Service) waitForJob(namespace, name string, timeout time.Duration) (bool, error) {
+	var succeeded bool
+
+	spanCtx, span := s.startSpan("k8s.job.wait", attrNamespace.String(namespace), attrJob.String(name))
+	defer span.End()
+
+	err := wait.PollUntilContextTimeout(spanCtx, jobPollInterval, timeout, true, func(ctx context.Context) (bool, error) {
+		job, err := s.conf.K8sClient.BatchV1().Jobs(namespace).Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return false, fmt.Errorf("getting job: %w", err)
+		}
+
+		var finished bool
+		finished, succeeded = jobFinished(job)
+
+		return finished, nil
+	})
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return false, fmt.Errorf("waiting for job %s to finish: %w", name, err)
+	}
+	span.SetAttributes(attribute.Bool("k8s.job.succeeded", succeeded))
+
+	return succeeded, nil
+}
+
+// jobFinished reports whether the Job has completed or failed, and if so whether it succeeded.
+func jobFinished(job *batchv1.Job) (bool, bool) {
+	for _, c := range job.Status.Conditions {
+		if c.Status != corev1.ConditionTrue {
+			continue
+		}
+		switch c.Type {
+		case batchv1.JobComplete:
+			return true, true
+		case batchv1.JobFailed:
+			return true, false
+		}
+	}
+
+	return false, false
+}
+
+// createExpectedHashConfigMap stores the expected dbHash for the verification Job. It is owned by the backup Job, so is removed along with it.
+// The hashes have an entry per collection, which can outgrow what is sensible to pass as an env var.
+func (s *Service) createExpectedHashConfigMap(backupJob *batchv1.Job, hashes map[string]databaseHash) (*corev1.ConfigMap, error) {
+	expected, err := json.Marshal(hashes)
+	if err != nil {
+		return nil, fmt.Errorf("marshalling dbHash: %w", err)
+	}
+
+	configMap := &corev1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      backupJob.Name + "-dbhash",
+			Namespace: backupJob.Namespace,
+			Labels: map[string]string{
+				"app":         "mongodb-backup-verification",
+				"backup-type": s.conf.BackupType,
+			},
+			OwnerReferences: []metav1.OwnerReference{
+				*metav1.NewControllerRef(backupJob, batchv1.SchemeGroupVersion.WithKind("Job")),
+			},
+		},
+		Data: map[string]string{
+			expectedDBHashKey: string(expected),
+		},
+	}
+
+	configMap, err = s.conf.K8sClient.CoreV1().ConfigMaps(backupJob.Namespace).Create(context.Background(), configMap, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating ConfigMap: %w", err)
+	}
+
+	return configMap, nil
+}
+
+func (s *Service) createVerifyJob(backupJob *batchv1.Job, az string, hashes map[string]databaseHash) (*batchv1.Job, error) {
+	configMap, err := s.createExpectedHashConfigMap(backupJob, hashes)
+	if err != nil {
+		return nil, fmt.Errorf("storing the expected dbHash: %w", err)
+	}
+
+	labels := map[string]string{
+		"app":         "mongodb-backup-verification",
+		"backup-type": s.conf.BackupType,
+	}
+	annotations := map[string]string{
+		"verifies": backupJob.Name,
+	}
+	env := []corev1.EnvVar{
+		{
+			Name:  "VERIFY_BACKUP_JOB",
+			Value: backupJob.Name,
+		},
+		{
+			Name:  "VERIFY_EXPECTED_DBHASH_FILE",
+			Value: expectedDBHashDir + "/" + expectedDBHashKey,
+		},
+	}
+
+	// Pass through the consistency point so the script can find the artifact the backup Job wrote
+	for _, e := range backupJob.Spec.Template.Spec.Containers[0].Env {
+		if e.ValueFrom == nil && e.Name != "MONGO_HOSTLIST" {
+			env = append(env, e)
+		}
+	}
+
+	job := s.newJob("mongodb-backup-verification-", backupJob.Namespace, az, labels, annotations,
+		[]string{"/usr/local/bin/verify_k8s.sh", s.conf.BackupType}, env)
+	podSpec := &job.Spec.Template.Spec
+	podSpec.Containers[0].Image = s.conf.VerifyImageURI
+	podSpec.Volumes = append(podSpec.Volumes, corev1.Volume{
+		Name: "expected-dbhash",
+		VolumeSource: corev1.VolumeSource{
+			ConfigMap: &corev1.ConfigMapVolumeSource{
+				LocalObjectReference: corev1.LocalObjectReference{Name: configMap.Name},
+			},
+		},
+	})
+	podSpec.Containers[0].VolumeMounts = append(podSpec.Containers[0].VolumeMounts, corev1.VolumeMount{
+		Name:      "expected-dbhash",
+		MountPath: expectedDBHashDir,
+		ReadOnly:  true,
+	})
+
+	job, err = s.conf.K8sClient.BatchV1().Jobs(backupJob.Namespace).Create(context.Background(), job, metav1.CreateOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("creating K8s jobs client: %w", err)
+	}
+
+	slog.Info("Verification job created", "Job", job.Name, "backupJob", backupJob.Name)
+
+	return job, nil
+}
+
+// hasCollections reports whether any database has a collection hash left to verify.
+func hasCollections(hashes map[string]databaseHash) bool {
+	for _, h := range hashes {
+		if len(h.Collections) > 0 {
+			return true
+		}
+	}
+
+	return false
+}
+
+// verifyBackup waits for the backup Job, launches a verification Job against its artifact and records the outcome as a label on the backup Job.
+// hashes were captured from the member before the backup. They are captured again once it has finished, and only the collections which
+// didn't change in between are verified, as the member kept replicating writes while the dump ran.
+func (s *Service) verifyBackup(backupJob *batchv1.Job, mongoDBHost, az string, hashes map[string]databaseHash) error {
+	slog.Info("Waiting for backup job to finish before verifying", "Job", backupJob.Name)
+
+	succeeded, err := s.waitForJob(backupJob.Namespace, backupJob.Name, s.conf.JobWaitTimeout)
+	if err != nil {
+		return err
+	}
+	if !succeeded {
+		return fmt.Errorf("backup job %s failed, so there is nothing to verify", backupJob.Name)
+	}
+
+	after, err := s.captureDBHash(mongoDBHost)
+	if err != nil {
+		return fmt.Errorf("capturing dbHash after the backup for verification: %w", err)
+	}
+	hashes, changed := stableHashes(hashes, after)
+	if len(changed) > 0 {
+		slog.Info("Collections were written to during the backup. Leaving them out of verification", "Job", backupJob.Name, "collections", changed)
+
+		// A verification Job with nothing to compare against would pass without checking anything
+		if !hasCollections(hashes) {
+			slog.Info("Backup verification finished", "Job", backupJob.Name, "result", "unverified")
+			outcome := fmt.Errorf("%w: every collection was written to during the backup, so none could be verified", ErrVerificationFailed)
+			return s.labelVerification(backupJob, "unverified", outcome)
+		}
+	}
+
+	verifyJob, err := s.createVerifyJob(backupJob, az, hashes)
+	if err != nil {
+		return fmt.Errorf("creating verification job: %w", err)
+	}
+
+	result := "failed"
+	passed, err := s.waitForJob(verifyJob.Namespace, verifyJob.Name, s.conf.VerifyJobTimeout)
+	if err != nil {
+		result = "unknown"
+	} else if passed {
+		result = "passed"
+	}
+
+	var outcome error
+	switch {
+	case err != nil:
+		outcome = err
+	case !passed:
+		outcome = fmt.Errorf("%w: verification job %s did not succeed", ErrVerificationFailed, verifyJob.Name)
+	}
+
+	slog.Info("Backup verification finished", "Job", backupJob.Name, "result", result)
+
+	return s.labelVerification(backupJob, result, outcome)
+}
+
+// labelVerification records the verification result as a label on the backup Job. The outcome matters more than the label, so a failed
+// patch never hides it.
+func (s *Service) labelVerification(backupJob *batchv1.Job, result string, outcome error) error {
+	patch := fmt.Sprintf(`{"metadata":{"labels":{%q:%q}}}`, verificationLabel, result)
+	_, patchErr := s.conf.K8sClient.BatchV1().Jobs(backupJob.Namespace).Patch(context.Background(), backupJob.Name, types.MergePatchType, []byte(patch), metav1.PatchOptions{})
+	if patchErr != nil {
+		patchErr = fmt.Errorf("labelling backup job with verification result: %w", patchErr)
+		if outcome == nil {
+			return patchErr
+		}
+		return fmt.Errorf("%w (and %w)", outcome, patchErr)
+	}
+
+	return outcome
+}
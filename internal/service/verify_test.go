@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// withJobResults makes Jobs report the given condition as soon as they are read, keyed by GenerateName prefix.
+func withJobResults(client *fake.Clientset, results map[string]batchv1.JobConditionType) *fake.Clientset {
+	client.PrependReactor("get", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		get := action.(k8stesting.GetAction)
+		obj, err := client.Tracker().Get(batchv1.SchemeGroupVersion.WithResource("jobs"), get.GetNamespace(), get.GetName())
+		if err != nil {
+			return true, nil, err
+		}
+
+		job := obj.(*batchv1.Job).DeepCopy()
+		for prefix, condition := range results {
+			if strings.HasPrefix(job.Name, prefix) {
+				job.Status.Conditions = append(job.Status.Conditions, batchv1.JobCondition{Type: condition, Status: v1.ConditionTrue})
+			}
+		}
+
+		return true, job, nil
+	})
+
+	return client
+}
+
+// newHashConnector returns a member connector whose member has a single user database, shop, with the collection hashes.
+func newHashConnector(collections map[string]string, md5 string) *mockMemberConnector {
+	listResult := new(mockSingleResult)
+	listResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		ptr := args.Get(0).(*listDatabasesResult)
+		ptr.OK = 1
+		ptr.Databases = append(ptr.Databases, struct {
+			Name string `bson:"name"`
+		}{Name: "shop"})
+	}).Return(nil)
+
+	hashResult := new(mockSingleResult)
+	hashResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		ptr := args.Get(0).(*dbHashResult)
+		ptr.OK = 1
+		ptr.Collections = collections
+		ptr.MD5 = md5
+	}).Return(nil)
+
+	shop := new(mockMongoClient)
+	shop.On("RunCommand", mock.Anything, bson.D{{Key: "dbHash", Value: 1}}).Return(hashResult)
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, mock.Anything).Return(listResult)
+	member.On("Database", "shop").Return(shop)
+	member.On("Disconnect", mock.Anything).Return(nil)
+
+	connector := new(mockMemberConnector)
+	connector.On("ConnectToMember", mock.Anything, mock.Anything).Return(member, nil)
+
+	return connector
+}
+
+func Test_verifyBackup(t *testing.T) {
+	jobPollInterval = 10 * time.Millisecond
+
+	tests := []struct {
+		name            string
+		backupResult    batchv1.JobConditionType
+		verifyResult    batchv1.JobConditionType
+		expectedLabel   string
+		expectedError   bool
+		verifyFailure   bool
+		expectVerifyJob bool
+		patchFails      bool
+
+		// Collection hashes of the shop database once the backup has finished, and which of them are expected to be verified
+		after          map[string]string
+		expectedHashes map[string]databaseHash
+	}{
+		{name: "Passed", backupResult: batchv1.JobComplete, verifyResult: batchv1.JobComplete, expectedLabel: "passed", expectVerifyJob: true},
+		{name: "Failed", backupResult: batchv1.JobComplete, verifyResult: batchv1.JobFailed, expectedLabel: "failed", expectedError: true, verifyFailure: true, expectVerifyJob: true},
+		{name: "BackupFailed", backupResult: batchv1.JobFailed, expectedError: true},
+		{
+			name: "FailedAndUnlabelled", backupResult: batchv1.JobComplete, verifyResult: batchv1.JobFailed, patchFails: true,
+			expectedError: true, verifyFailure: true, expectVerifyJob: true,
+		},
+		{
+			name: "WrittenDuringBackup", backupResult: batchv1.JobComplete, verifyResult: batchv1.JobComplete, expectedLabel: "passed", expectVerifyJob: true,
+			after:          map[string]string{"orders": "abc", "carts": "new"},
+			expectedHashes: map[string]databaseHash{"shop": {Collections: map[string]string{"orders": "abc"}}},
+		},
+		{
+			name: "AllWrittenDuringBackup", backupResult: batchv1.JobComplete, expectedLabel: "unverified", expectedError: true, verifyFailure: true,
+			after: map[string]string{"orders": "new", "carts": "new"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := withGeneratedNames(fake.NewClientset())
+			withJobResults(k8sClient, map[string]batchv1.JobConditionType{
+				"targeted-mongodb-backups-":    tc.backupResult,
+				"mongodb-backup-verification-": tc.verifyResult,
+			})
+
+			if tc.patchFails {
+				k8sClient.PrependReactor("patch", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+					return true, nil, apierrors.NewNotFound(batchv1.Resource("jobs"), action.(k8stesting.PatchAction).GetName())
+				})
+			}
+
+			hashes := map[string]databaseHash{"shop": {Collections: map[string]string{"orders": "abc", "carts": "xyz"}, MD5: "def"}}
+			after, expectedHashes := hashes["shop"].Collections, hashes
+			if tc.after != nil {
+				after, expectedHashes = tc.after, tc.expectedHashes
+			}
+
+			s := Service{
+				conf: config.Config{
+					K8sClient:              k8sClient,
+					MongoDBMemberConnector: newHashConnector(after, "def"),
+					VerifyBackups:          true,
+					BackupType:             "daily",
+					DockerImageURI:         "backup:latest",
+					VerifyImageURI:         "verify:latest",
+					JobWaitTimeout:         time.Second,
+					VerifyJobTimeout:       time.Second,
+				},
+			}
+
+			backupJob, err := s.createJob("mongodb-1.mongodb.database.svc.cluster.local", "eu-west-1a", "database", consistencyPoint{ReplicaSet: "rs0"})
+			assert.NoError(t, err)
+			assert.Equal(t, int32(901), *backupJob.Spec.TTLSecondsAfterFinished, "expected the backup job to outlive the verification job")
+
+			err = s.verifyBackup(backupJob, "mongodb-1.mongodb.database.svc.cluster.local", "eu-west-1a", hashes)
+
+			if tc.expectedError {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.verifyFailure, errors.Is(err, ErrVerificationFailed))
+
+			updated, err := k8sClient.Tracker().Get(batchv1.SchemeGroupVersion.WithResource("jobs"), "database", backupJob.Name)
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedLabel, updated.(*batchv1.Job).Labels[verificationLabel])
+
+			verifyJobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{LabelSelector: "app=mongodb-backup-verification"})
+			assert.NoError(t, err)
+			if !tc.expectVerifyJob {
+				assert.Empty(t, verifyJobs.Items)
+				return
+			}
+
+			assert.Len(t, verifyJobs.Items, 1)
+			container := verifyJobs.Items[0].Spec.Template.Spec.Containers[0]
+			assert.Equal(t, "verify:latest", container.Image)
+
+			env := map[string]string{}
+			for _, e := range container.Env {
+				env[e.Name] = e.Value
+			}
+			assert.Equal(t, backupJob.Name, env["VERIFY_BACKUP_JOB"])
+			assert.Equal(t, "rs0", env["MONGO_REPLICA_SET"])
+
+			assert.Equal(t, "/etc/mongodb-backup-verification/expected-dbhash.json", env["VERIFY_EXPECTED_DBHASH_FILE"])
+
+			podSpec := verifyJobs.Items[0].Spec.Template.Spec
+			assert.Contains(t, container.VolumeMounts, v1.VolumeMount{Name: "expected-dbhash", MountPath: "/etc/mongodb-backup-verification", ReadOnly: true})
+			assert.Contains(t, podSpec.Volumes, v1.Volume{Name: "expected-dbhash", VolumeSource: v1.VolumeSource{
+				ConfigMap: &v1.ConfigMapVolumeSource{LocalObjectReference: v1.LocalObjectReference{Name: backupJob.Name + "-dbhash"}},
+			}})
+
+			configMap, err := k8sClient.CoreV1().ConfigMaps("database").Get(context.Background(), backupJob.Name+"-dbhash", metav1.GetOptions{})
+			assert.NoError(t, err)
+			assert.Equal(t, backupJob.Name, configMap.OwnerReferences[0].Name, "expected the ConfigMap to be removed along with the backup job")
+
+			var expected map[string]databaseHash
+			assert.NoError(t, json.Unmarshal([]byte(configMap.Data["expected-dbhash.json"]), &expected))
+			assert.Equal(t, expectedHashes, expected)
+		})
+	}
+}
+
+func Test_captureDBHash(t *testing.T) {
+	listResult := new(mockSingleResult)
+	listResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		ptr := args.Get(0).(*listDatabasesResult)
+		ptr.OK = 1
+		ptr.Databases = append(ptr.Databases, struct {
+			Name string `bson:"name"`
+		}{Name: "admin"}, struct {
+			Name string `bson:"name"`
+		}{Name: "shop"})
+	}).Return(nil)
+
+	hashResult := new(mockSingleResult)
+	hashResult.On("Decode", mock.Anything).Run(func(args mock.Arguments) {
+		ptr := args.Get(0).(*dbHashResult)
+		ptr.OK = 1
+		ptr.Collections = map[string]string{"orders": "abc"}
+		ptr.MD5 = "def"
+	}).Return(nil)
+
+	shop := new(mockMongoClient)
+	shop.On("RunCommand", mock.Anything, bson.D{{Key: "dbHash", Value: 1}}).Return(hashResult)
+
+	member := new(mockMemberClient)
+	member.On("RunCommand", mock.Anything, mock.Anything).Return(listResult)
+	member.On("Database", "shop").Return(shop)
+	member.On("Disconnect", mock.Anything).Return(nil)
+
+	connector := new(mockMemberConnector)
+	connector.On("ConnectToMember", mock.Anything, "mongodb-1.mongodb.database.svc.cluster.local").Return(member, nil)
+
+	s := Service{conf: config.Config{MongoDBMemberConnector: connector}}
+
+	hashes, err := s.captureDBHash("mongodb-1.mongodb.database.svc.cluster.local")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]databaseHash{"shop": {Collections: map[string]string{"orders": "abc"}, MD5: "def"}}, hashes)
+	member.AssertNotCalled(t, "Database", "admin")
+	member.AssertCalled(t, "Disconnect", mock.Anything)
+}
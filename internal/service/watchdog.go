@@ -0,0 +1,78 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	batchv1 "k8s.io/api/batch/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/wait"
+)
+
+// schedulingPollInterval is how often the backup pod is checked for being scheduled. Overridden in tests.
+var schedulingPollInterval = 10 * time.Second
+
+// jobUnschedulable watches the Job's pod until it is scheduled, returning true if it was still unschedulable when UNSCHEDULABLE_TIMEOUT expired.
+func (s *Service) jobUnschedulable(job *batchv1.Job) (bool, error) {
+	var scheduled bool
+	var message string
+
+	err := wait.PollUntilContextTimeout(context.Background(), schedulingPollInterval, s.conf.UnschedulableTimeout, true, func(ctx context.Context) (bool, error) {
+		pods, err := s.conf.K8sClient.CoreV1().Pods(job.Namespace).List(ctx, metav1.ListOptions{
+			LabelSelector: fmt.Sprintf("%s=%s", batchv1.JobNameLabel, job.Name),
+		})
+		if err != nil {
+			return false, fmt.Errorf("listing pods of job %s: %w", job.Name, err)
+		}
+
+		message = ""
+		for _, pod := range pods.Items {
+			for _, c := range pod.Status.Conditions {
+				if c.Type != corev1.PodScheduled {
+					continue
+				}
+				if c.Status == corev1.ConditionTrue {
+					scheduled = true
+					return true, nil
+				}
+				if c.Reason == corev1.PodReasonUnschedulable {
+					message = c.Message
+				}
+			}
+		}
+
+		return false, nil
+	})
+	if scheduled {
+		slog.Debug("Backup pod scheduled", "Job", job.Name)
+		return false, nil
+	}
+	if err != nil && !wait.Interrupted(err) {
+		return false, err
+	}
+
+	// Only a pod the scheduler has given up on is worth moving. Anything else (e.g. the pod not being created yet) is left alone
+	if message == "" {
+		slog.Warn("Backup pod not scheduled within the timeout, but is not reported as unschedulable. Leaving the job in place", "Job", job.Name, "timeout", s.conf.UnschedulableTimeout)
+		return false, nil
+	}
+
+	slog.Warn("Backup pod is unschedulable", "Job", job.Name, "timeout", s.conf.UnschedulableTimeout, "reason", message)
+
+	return true, nil
+}
+
+func (s *Service) deleteJob(job *batchv1.Job) error {
+	propagation := metav1.DeletePropagationBackground
+	err := s.conf.K8sClient.BatchV1().Jobs(job.Namespace).Delete(context.Background(), job.Name, metav1.DeleteOptions{PropagationPolicy: &propagation})
+	if err != nil {
+		return fmt.Errorf("deleting job %s: %w", job.Name, err)
+	}
+
+	slog.Info("Deleted unschedulable job", "Job", job.Name)
+
+	return nil
+}
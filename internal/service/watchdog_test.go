@@ -0,0 +1,166 @@
+package service
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/v2/bson"
+	batchv1 "k8s.io/api/batch/v1"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+)
+
+// withJobPods creates a pod for every created Job, scheduled or not depending on the AZ the Job is pinned to. AZs missing from the map get no pod.
+func withJobPods(client *fake.Clientset, scheduledByAZ map[string]bool) *fake.Clientset {
+	client.PrependReactor("create", "jobs", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		job := action.(k8stesting.CreateAction).GetObject().(*batchv1.Job)
+		az := job.Spec.Template.Spec.Affinity.NodeAffinity.RequiredDuringSchedulingIgnoredDuringExecution.NodeSelectorTerms[0].MatchExpressions[0].Values[0]
+
+		scheduled, found := scheduledByAZ[az]
+		if !found {
+			return false, nil, nil
+		}
+
+		condition := v1.PodCondition{Type: v1.PodScheduled, Status: v1.ConditionTrue}
+		if !scheduled {
+			condition = v1.PodCondition{
+				Type:    v1.PodScheduled,
+				Status:  v1.ConditionFalse,
+				Reason:  v1.PodReasonUnschedulable,
+				Message: "0/3 nodes are available: 3 node(s) didn't match Pod's node affinity/selector",
+			}
+		}
+
+		err := client.Tracker().Add(&v1.Pod{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:      job.Name + "-pod",
+				Namespace: job.Namespace,
+				Labels:    map[string]string{batchv1.JobNameLabel: job.Name},
+			},
+			Status: v1.PodStatus{Conditions: []v1.PodCondition{condition}},
+		})
+
+		return false, nil, err
+	})
+
+	return withGeneratedNames(client)
+}
+
+func Test_launchUnschedulableFailover(t *testing.T) {
+	schedulingPollInterval = 10 * time.Millisecond
+
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY"},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+		{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY"},
+	}
+
+	tests := []struct {
+		name           string
+		scheduledByAZ  map[string]bool
+		memberOverride string
+		expectedMember string
+		expectedJobs   int
+		expectedError  bool
+	}{
+		{name: "ScheduledFirstTime", scheduledByAZ: map[string]bool{"eu-west-1a": true}, expectedMember: "mongodb-1.mongodb.database.svc.cluster.local", expectedJobs: 1},
+		{name: "FailsOverToAnotherAZ", scheduledByAZ: map[string]bool{"eu-west-1a": false, "eu-west-1b": true}, expectedMember: "mongodb-2.mongodb.database.svc.cluster.local", expectedJobs: 1},
+		{name: "UnschedulableEverywhere", scheduledByAZ: map[string]bool{"eu-west-1a": false, "eu-west-1b": false}, expectedJobs: 0, expectedError: true},
+		{name: "NoFailoverForRequestedMember", scheduledByAZ: map[string]bool{"eu-west-1a": false, "eu-west-1b": true}, memberOverride: "mongodb-1.mongodb.database.svc.cluster.local", expectedJobs: 0, expectedError: true},
+		{name: "PendingButNotUnschedulable", scheduledByAZ: map[string]bool{}, expectedMember: "mongodb-1.mongodb.database.svc.cluster.local", expectedJobs: 1},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			k8sClient := withJobPods(fake.NewClientset(
+				healthyPod("mongodb-1", "node1"),
+				healthyPod("mongodb-2", "node2"),
+				healthyNode("node1", "eu-west-1a"),
+				healthyNode("node2", "eu-west-1b"),
+			), tc.scheduledByAZ)
+
+			s := Service{
+				conf: config.Config{
+					MongoDBClient:        newMockReplicaSet(members),
+					K8sClient:            k8sClient,
+					BackupType:           "daily",
+					MemberOverride:       tc.memberOverride,
+					UnschedulableTimeout: 50 * time.Millisecond,
+				},
+			}
+
+			result, err := s.Launch()
+
+			jobs, listErr := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+			assert.NoError(t, listErr)
+			assert.Len(t, jobs.Items, tc.expectedJobs, "expected unschedulable jobs to be deleted")
+
+			if tc.expectedError {
+				assert.Error(t, err)
+				return
+			}
+
+			assert.NoError(t, err)
+			assert.Equal(t, tc.expectedMember, result.Member)
+			assert.Equal(t, jobs.Items[0].Name, result.JobName)
+		})
+	}
+}
+
+func Test_launchFailoverSkipsTriedMembers(t *testing.T) {
+	schedulingPollInterval = 10 * time.Millisecond
+
+	// mongodb-1 is the most up to date, so is tried first and rejected. mongodb-2's backup pod is unschedulable, so the
+	// launch fails over, and mongodb-3's is too
+	members := []member{
+		{Name: "mongodb-0.mongodb.database.svc.cluster.local", Role: "PRIMARY", Optime: optime{TS: bson.Timestamp{T: 200, I: 1}}},
+		{Name: "mongodb-1.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 190, I: 1}}},
+		{Name: "mongodb-2.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 180, I: 1}}},
+		{Name: "mongodb-3.mongodb.database.svc.cluster.local", Role: "SECONDARY", Optime: optime{TS: bson.Timestamp{T: 170, I: 1}}},
+	}
+
+	notReady := healthyPod("mongodb-1", "node1")
+	notReady.Status.Conditions[0].Status = v1.ConditionFalse
+
+	k8sClient := withJobPods(fake.NewClientset(
+		notReady,
+		healthyPod("mongodb-2", "node2"),
+		healthyPod("mongodb-3", "node3"),
+		healthyNode("node1", "eu-west-1a"),
+		healthyNode("node2", "eu-west-1b"),
+		healthyNode("node3", "eu-west-1c"),
+	), map[string]bool{"eu-west-1b": false, "eu-west-1c": false})
+
+	s := Service{
+		conf: config.Config{
+			MongoDBClient:        newMockReplicaSet(members),
+			K8sClient:            k8sClient,
+			BackupType:           "daily",
+			UnschedulableTimeout: 50 * time.Millisecond,
+		},
+	}
+
+	result, err := s.Launch()
+	assert.Error(t, err)
+
+	// Each member is only reported once, however many times the launch failed over
+	assert.Equal(t, 1, strings.Count(err.Error(), "mongodb-1.mongodb.database.svc.cluster.local:"), err.Error())
+	assert.Equal(t, 1, strings.Count(err.Error(), "mongodb-2.mongodb.database.svc.cluster.local:"), err.Error())
+	assert.Equal(t, 1, strings.Count(err.Error(), "mongodb-3.mongodb.database.svc.cluster.local:"), err.Error())
+
+	states := map[string]string{}
+	for _, c := range result.Candidates {
+		states[c.Member] = c.State
+	}
+	assert.Equal(t, CandidateRejected, states["mongodb-1.mongodb.database.svc.cluster.local"])
+	assert.Equal(t, CandidateFailedOver, states["mongodb-2.mongodb.database.svc.cluster.local"])
+	assert.Equal(t, CandidateFailedOver, states["mongodb-3.mongodb.database.svc.cluster.local"])
+}
@@ -0,0 +1,240 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"slices"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Names of the zone resolvers, as listed in ZONE_RESOLVERS.
+const (
+	zoneResolverNodeLabel     = "node-label"
+	zoneResolverPodLabel      = "pod-label"
+	zoneResolverPodAnnotation = "pod-annotation"
+	zoneResolverStaticMap     = "static-map"
+	zoneResolverDNSTXT        = "dns-txt"
+)
+
+// defaultZoneResolvers is the order the resolvers are tried in when ZONE_RESOLVERS is unset. DNS TXT records are opt in.
+var defaultZoneResolvers = []string{zoneResolverNodeLabel, zoneResolverPodLabel, zoneResolverPodAnnotation, zoneResolverStaticMap}
+
+// dnsTXTTimeout bounds each TXT record lookup, so a slow resolver doesn't hold up the launch.
+const dnsTXTTimeout = 5 * time.Second
+
+// ZoneQuery is what is known about a member when finding its AZ. Pod is nil for members outside the cluster, and Node is
+// nil for those and when RBAC doesn't allow reading nodes.
+type ZoneQuery struct {
+	Host string
+	Pod  *corev1.Pod
+	Node *corev1.Node
+}
+
+// ZoneResolver finds the AZ of a replica set member from a single source.
+type ZoneResolver interface {
+	// Name identifies the resolver in ZONE_RESOLVERS, logs and the run report.
+	Name() string
+
+	// ResolveZone returns the member's AZ, or "" if the source has no answer for it. source describes where it looked, e.g. a
+	// label on a named node, and is "" if the resolver doesn't apply to the member at all, e.g. a pod label with no pod.
+	ResolveZone(ctx context.Context, q ZoneQuery) (az, source string, err error)
+}
+
+// builtinZoneResolvers names every resolver built into the launcher.
+var builtinZoneResolvers = []string{zoneResolverNodeLabel, zoneResolverPodLabel, zoneResolverPodAnnotation, zoneResolverStaticMap, zoneResolverDNSTXT}
+
+// WithZoneResolvers adds resolvers for other sources, e.g. a CMDB, to those built in. ZONE_RESOLVERS can name them alongside
+// the built-in ones. When it is unset they are tried after the default chain.
+func WithZoneResolvers(resolvers ...ZoneResolver) Option {
+	return func(s *Service) {
+		s.extraZoneResolvers = append(s.extraZoneResolvers, resolvers...)
+	}
+}
+
+// newZoneResolvers builds the resolver chain in the order named, defaulting to defaultZoneResolvers followed by any added with
+// WithZoneResolvers.
+func (s *Service) newZoneResolvers(names []string) ([]ZoneResolver, error) {
+	known := slices.Clone(builtinZoneResolvers)
+	for _, r := range s.extraZoneResolvers {
+		if slices.Contains(known, r.Name()) {
+			return nil, fmt.Errorf("zone resolver name '%s' is already in use", r.Name())
+		}
+		known = append(known, r.Name())
+	}
+
+	if len(names) == 0 {
+		names = slices.Clone(defaultZoneResolvers)
+		for _, r := range s.extraZoneResolvers {
+			names = append(names, r.Name())
+		}
+	}
+
+	resolvers := make([]ZoneResolver, 0, len(names))
+	for _, name := range names {
+		if r := s.builtinZoneResolver(name); r != nil {
+			resolvers = append(resolvers, r)
+			continue
+		}
+
+		i := slices.IndexFunc(s.extraZoneResolvers, func(r ZoneResolver) bool { return r.Name() == name })
+		if i == -1 {
+			return nil, fmt.Errorf("unknown zone resolver '%s' in ZONE_RESOLVERS. Expected one of %s", name, strings.Join(known, ", "))
+		}
+		resolvers = append(resolvers, s.extraZoneResolvers[i])
+	}
+
+	return resolvers, nil
+}
+
+// builtinZoneResolver returns the built-in resolver with the name, or nil if there isn't one.
+func (s *Service) builtinZoneResolver(name string) ZoneResolver {
+	switch name {
+	case zoneResolverNodeLabel:
+		return nodeLabelResolver{}
+	case zoneResolverPodLabel:
+		return podLabelResolver{}
+	case zoneResolverPodAnnotation:
+		return podAnnotationResolver{annotation: s.conf.ZonePodAnnotation}
+	case zoneResolverStaticMap:
+		return staticMapResolver{s: s}
+	case zoneResolverDNSTXT:
+		return dnsTXTResolver{name: s.conf.ZoneDNSTXTName, lookupTXT: net.DefaultResolver.LookupTXT}
+	}
+
+	return nil
+}
+
+// zoneResolverChain returns the configured resolvers. Services built without NewService use the default chain.
+func (s *Service) zoneResolverChain() []ZoneResolver {
+	if s.zoneResolvers == nil {
+		s.zoneResolvers, _ = s.newZoneResolvers(nil)
+	}
+
+	return s.zoneResolvers
+}
+
+// resolveZone tries each resolver in turn, returning the AZ and which resolver and source answered, or every source it tried
+// if none did. A resolver which fails is passed over, as the next one may still answer.
+func (s *Service) resolveZone(q ZoneQuery) (string, string, string, []string) {
+	var tried []string
+
+	for _, r := range s.zoneResolverChain() {
+		az, source, err := r.ResolveZone(context.Background(), q)
+		if err != nil {
+			slog.Debug("Zone resolver failed. Trying the next one", "host", q.Host, "resolver", r.Name(), "error", err.Error())
+			tried = append(tried, fmt.Sprintf("%s (%s)", source, err))
+			continue
+		}
+		if az != "" {
+			return az, r.Name(), source, nil
+		}
+		if source != "" {
+			tried = append(tried, source)
+		}
+	}
+
+	return "", "", "", tried
+}
+
+// nodeLabelResolver reads the well known zone label on the member's node.
+type nodeLabelResolver struct{}
+
+func (nodeLabelResolver) Name() string { return zoneResolverNodeLabel }
+
+func (nodeLabelResolver) ResolveZone(_ context.Context, q ZoneQuery) (string, string, error) {
+	if q.Node == nil {
+		return "", "", nil
+	}
+
+	return q.Node.Labels[azWellKnownLabel], fmt.Sprintf("'%s' label on node %s", azWellKnownLabel, q.Node.Name), nil
+}
+
+// podLabelResolver reads the well known zone label on the member's pod, copied from the node by clusters which propagate pod
+// topology labels.
+type podLabelResolver struct{}
+
+func (podLabelResolver) Name() string { return zoneResolverPodLabel }
+
+func (podLabelResolver) ResolveZone(_ context.Context, q ZoneQuery) (string, string, error) {
+	if q.Pod == nil {
+		return "", "", nil
+	}
+
+	return q.Pod.Labels[azWellKnownLabel], fmt.Sprintf("'%s' label on pod %s", azWellKnownLabel, q.Pod.Name), nil
+}
+
+// podAnnotationResolver reads ZONE_POD_ANNOTATION on the member's pod, e.g. written by an init container.
+type podAnnotationResolver struct {
+	annotation string
+}
+
+func (podAnnotationResolver) Name() string { return zoneResolverPodAnnotation }
+
+func (r podAnnotationResolver) ResolveZone(_ context.Context, q ZoneQuery) (string, string, error) {
+	if q.Pod == nil || r.annotation == "" {
+		return "", "", nil
+	}
+
+	return q.Pod.Annotations[r.annotation], fmt.Sprintf("'%s' annotation on pod %s", r.annotation, q.Pod.Name), nil
+}
+
+// staticMapResolver looks the member up in ZONE_MAP, ZONE_MAP_FILE and ZONE_MAP_CONFIGMAP. It goes through the Service, which
+// reads the ConfigMap once per launch.
+type staticMapResolver struct {
+	s *Service
+}
+
+func (staticMapResolver) Name() string { return zoneResolverStaticMap }
+
+func (r staticMapResolver) ResolveZone(_ context.Context, q ZoneQuery) (string, string, error) {
+	if az, source, found := r.s.staticZone(q.Host); found {
+		return az, source, nil
+	}
+
+	return "", strings.Join(r.s.staticZoneSources(), ", "), nil
+}
+
+// dnsTXTResolver reads the member's AZ from a TXT record, named by ZONE_DNS_TXT_NAME with {host} replaced by the member's
+// hostname. The record holds either '<az>' or 'zone=<az>'.
+type dnsTXTResolver struct {
+	name      string
+	lookupTXT func(ctx context.Context, name string) ([]string, error)
+}
+
+func (dnsTXTResolver) Name() string { return zoneResolverDNSTXT }
+
+func (r dnsTXTResolver) ResolveZone(ctx context.Context, q ZoneQuery) (string, string, error) {
+	host, _, _ := strings.Cut(q.Host, ":")
+	name := strings.ReplaceAll(r.name, "{host}", host)
+	source := fmt.Sprintf("DNS TXT record %s", name)
+
+	ctx, cancel := context.WithTimeout(ctx, dnsTXTTimeout)
+	defer cancel()
+
+	records, err := r.lookupTXT(ctx, name)
+	var dnsErr *net.DNSError
+	if errors.As(err, &dnsErr) && dnsErr.IsNotFound {
+		return "", source, nil
+	}
+	if err != nil {
+		return "", source, fmt.Errorf("looking up TXT record: %w", err)
+	}
+
+	for _, record := range records {
+		record = strings.TrimSpace(record)
+		if az, found := strings.CutPrefix(record, "zone="); found {
+			return strings.TrimSpace(az), source, nil
+		}
+		if record != "" && !strings.Contains(record, "=") {
+			return record, source, nil
+		}
+	}
+
+	return "", source, nil
+}
@@ -0,0 +1,200 @@
+package service
+
+import (
+	"context"
+	"errors"
+	"net"
+	"slices"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const zoneTestHost = "mongodb-0.mongodb.database.svc.cluster.local:27017"
+
+func zoneTestQuery() ZoneQuery {
+	return ZoneQuery{
+		Host: zoneTestHost,
+		Pod: &v1.Pod{ObjectMeta: metav1.ObjectMeta{
+			Name:        "mongodb-0",
+			Labels:      map[string]string{azWellKnownLabel: "eu-west-1b"},
+			Annotations: map[string]string{"mongodb-backups/zone": "eu-west-1c"},
+		}},
+		Node: &v1.Node{ObjectMeta: metav1.ObjectMeta{Name: "node1", Labels: map[string]string{azWellKnownLabel: "eu-west-1a"}}},
+	}
+}
+
+// fakeTXT answers TXT lookups from records, and with NXDOMAIN for any other name.
+func fakeTXT(records map[string][]string) func(context.Context, string) ([]string, error) {
+	return func(_ context.Context, name string) ([]string, error) {
+		if r, found := records[name]; found {
+			return r, nil
+		}
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+}
+
+func Test_zoneResolvers(t *testing.T) {
+	s := &Service{conf: config.Config{ZoneMap: []config.ZoneMapping{{Pattern: "mongodb-0.*", AZ: "eu-west-1d", Source: "ZONE_MAP"}}}}
+
+	tests := []struct {
+		name           string
+		resolver       ZoneResolver
+		query          ZoneQuery
+		expectedAZ     string
+		expectedSource string
+		expectedErr    string
+	}{
+		{name: "NodeLabel", resolver: nodeLabelResolver{}, query: zoneTestQuery(), expectedAZ: "eu-west-1a", expectedSource: "'topology.kubernetes.io/zone' label on node node1"},
+		{name: "NodeLabelWithoutNode", resolver: nodeLabelResolver{}, query: ZoneQuery{Host: zoneTestHost}},
+		{name: "PodLabel", resolver: podLabelResolver{}, query: zoneTestQuery(), expectedAZ: "eu-west-1b", expectedSource: "'topology.kubernetes.io/zone' label on pod mongodb-0"},
+		{name: "PodLabelWithoutPod", resolver: podLabelResolver{}, query: ZoneQuery{Host: zoneTestHost}},
+		{name: "PodAnnotation", resolver: podAnnotationResolver{annotation: "mongodb-backups/zone"}, query: zoneTestQuery(), expectedAZ: "eu-west-1c", expectedSource: "'mongodb-backups/zone' annotation on pod mongodb-0"},
+		{name: "PodAnnotationUnset", resolver: podAnnotationResolver{}, query: zoneTestQuery()},
+		{name: "StaticMap", resolver: staticMapResolver{s: s}, query: ZoneQuery{Host: zoneTestHost}, expectedAZ: "eu-west-1d", expectedSource: "ZONE_MAP"},
+		{name: "StaticMapNoMatch", resolver: staticMapResolver{s: s}, query: ZoneQuery{Host: "mongodb-1.mongodb.database.svc.cluster.local"}, expectedSource: "ZONE_MAP"},
+		{
+			name:           "DNSTXT",
+			resolver:       dnsTXTResolver{name: "_zone.{host}", lookupTXT: fakeTXT(map[string][]string{"_zone.mongodb-0.mongodb.database.svc.cluster.local": {"v=1", "zone=eu-west-1e"}})},
+			query:          ZoneQuery{Host: zoneTestHost},
+			expectedAZ:     "eu-west-1e",
+			expectedSource: "DNS TXT record _zone.mongodb-0.mongodb.database.svc.cluster.local",
+		},
+		{
+			name:           "DNSTXTBareValue",
+			resolver:       dnsTXTResolver{name: "{host}", lookupTXT: fakeTXT(map[string][]string{"mongodb-0.mongodb.database.svc.cluster.local": {"eu-west-1e"}})},
+			query:          ZoneQuery{Host: zoneTestHost},
+			expectedAZ:     "eu-west-1e",
+			expectedSource: "DNS TXT record mongodb-0.mongodb.database.svc.cluster.local",
+		},
+		{
+			name:           "DNSTXTNotFound",
+			resolver:       dnsTXTResolver{name: "_zone.{host}", lookupTXT: fakeTXT(nil)},
+			query:          ZoneQuery{Host: zoneTestHost},
+			expectedSource: "DNS TXT record _zone.mongodb-0.mongodb.database.svc.cluster.local",
+		},
+		{
+			name: "DNSTXTFailed",
+			resolver: dnsTXTResolver{name: "_zone.{host}", lookupTXT: func(context.Context, string) ([]string, error) {
+				return nil, errors.New("server misbehaving")
+			}},
+			query:          ZoneQuery{Host: zoneTestHost},
+			expectedSource: "DNS TXT record _zone.mongodb-0.mongodb.database.svc.cluster.local",
+			expectedErr:    "looking up TXT record: server misbehaving",
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			az, source, err := tc.resolver.ResolveZone(context.Background(), tc.query)
+			if tc.expectedErr != "" {
+				assert.EqualError(t, err, tc.expectedErr)
+			} else {
+				assert.NoError(t, err)
+			}
+			assert.Equal(t, tc.expectedAZ, az)
+			assert.Equal(t, tc.expectedSource, source)
+		})
+	}
+}
+
+func Test_resolveZoneOrder(t *testing.T) {
+	tests := []struct {
+		name             string
+		resolvers        []string
+		query            ZoneQuery
+		expectedAZ       string
+		expectedResolver string
+		expectedTried    []string
+	}{
+		{name: "Default", query: zoneTestQuery(), expectedAZ: "eu-west-1a", expectedResolver: zoneResolverNodeLabel},
+		{name: "PodAnnotationFirst", resolvers: []string{"pod-annotation", "node-label"}, query: zoneTestQuery(), expectedAZ: "eu-west-1c", expectedResolver: zoneResolverPodAnnotation},
+		{name: "DNSBeforeStaticMap", resolvers: []string{"dns-txt", "static-map"}, query: ZoneQuery{Host: zoneTestHost}, expectedAZ: "eu-west-1e", expectedResolver: zoneResolverDNSTXT},
+		{
+			name:          "NoneAnswer",
+			resolvers:     []string{"node-label", "pod-label", "dns-txt"},
+			query:         ZoneQuery{Host: "mongodb-1.mongodb.database.svc.cluster.local"},
+			expectedTried: []string{"DNS TXT record _zone.mongodb-1.mongodb.database.svc.cluster.local"},
+		},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			s, err := NewService(config.Config{
+				ZoneResolvers:     tc.resolvers,
+				ZonePodAnnotation: "mongodb-backups/zone",
+				ZoneDNSTXTName:    "_zone.{host}",
+				ZoneMap:           []config.ZoneMapping{{Pattern: "mongodb-0.*", AZ: "eu-west-1d", Source: "ZONE_MAP"}},
+			})
+			assert.NoError(t, err)
+
+			// Swap the real DNS lookups for canned records
+			for i, r := range s.zoneResolvers {
+				if d, ok := r.(dnsTXTResolver); ok {
+					d.lookupTXT = fakeTXT(map[string][]string{"_zone.mongodb-0.mongodb.database.svc.cluster.local": {"eu-west-1e"}})
+					s.zoneResolvers[i] = d
+				}
+			}
+
+			az, resolver, _, tried := s.resolveZone(tc.query)
+			assert.Equal(t, tc.expectedAZ, az)
+			assert.Equal(t, tc.expectedResolver, resolver)
+			assert.Equal(t, tc.expectedTried, tried)
+		})
+	}
+}
+
+func Test_newServiceUnknownZoneResolver(t *testing.T) {
+	_, err := NewService(config.Config{ZoneResolvers: []string{"node-label", "ec2-metadata"}})
+	assert.ErrorContains(t, err, "unknown zone resolver 'ec2-metadata' in ZONE_RESOLVERS")
+}
+
+// cmdbResolver stands in for a resolver added by the caller, answering from a fixed table.
+type cmdbResolver struct {
+	zones map[string]string
+}
+
+func (cmdbResolver) Name() string { return "cmdb" }
+
+func (r cmdbResolver) ResolveZone(_ context.Context, q ZoneQuery) (string, string, error) {
+	return r.zones[q.Host], "CMDB", nil
+}
+
+func Test_withZoneResolvers(t *testing.T) {
+	cmdb := cmdbResolver{zones: map[string]string{"ip-10-0-1-5.eu-west-1.compute.internal:27017": "eu-west-1b"}}
+	outside := ZoneQuery{Host: "ip-10-0-1-5.eu-west-1.compute.internal:27017"}
+
+	// Tried after the default chain when ZONE_RESOLVERS is unset
+	s, err := NewService(config.Config{}, WithZoneResolvers(cmdb))
+	assert.NoError(t, err)
+	assert.Equal(t, append(slices.Clone(defaultZoneResolvers), "cmdb"), resolverNames(s.zoneResolvers))
+
+	az, resolver, source, _ := s.resolveZone(outside)
+	assert.Equal(t, "eu-west-1b", az)
+	assert.Equal(t, "cmdb", resolver)
+	assert.Equal(t, "CMDB", source)
+
+	// Or placed wherever ZONE_RESOLVERS names it
+	s, err = NewService(config.Config{ZoneResolvers: []string{"cmdb", "node-label"}}, WithZoneResolvers(cmdb))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"cmdb", "node-label"}, resolverNames(s.zoneResolvers))
+
+	_, err = NewService(config.Config{ZoneResolvers: []string{"ec2-metadata"}}, WithZoneResolvers(cmdb))
+	assert.EqualError(t, err, "unknown zone resolver 'ec2-metadata' in ZONE_RESOLVERS. Expected one of node-label, pod-label, pod-annotation, static-map, dns-txt, cmdb")
+
+	_, err = NewService(config.Config{}, WithZoneResolvers(cmdb, cmdb))
+	assert.EqualError(t, err, "zone resolver name 'cmdb' is already in use")
+}
+
+func resolverNames(resolvers []ZoneResolver) []string {
+	names := make([]string, 0, len(resolvers))
+	for _, r := range resolvers {
+		names = append(names, r.Name())
+	}
+
+	return names
+}
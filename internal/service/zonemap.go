@@ -0,0 +1,117 @@
+package service
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// zoneMapConfigMapKey is the key in ZONE_MAP_CONFIGMAP which holds the zone mappings.
+const zoneMapConfigMapKey = "zones"
+
+// staticZone looks the member up in the static zone map, with and without its port, returning the AZ and which source answered.
+func (s *Service) staticZone(replicaHostPath string) (string, string, bool) {
+	m, found := matchZone(s.zoneMappings(), replicaHostPath)
+	if !found {
+		return "", "", false
+	}
+
+	return m.AZ, m.Source, true
+}
+
+// staticZoneSources names every configured static zone map source, for errors listing what was tried.
+func (s *Service) staticZoneSources() []string {
+	sources := []string{"ZONE_MAP"}
+	if slices.ContainsFunc(s.conf.ZoneMap, func(m config.ZoneMapping) bool { return m.Source == "ZONE_MAP_FILE" }) {
+		sources = append(sources, "ZONE_MAP_FILE")
+	}
+	if s.conf.ZoneMapConfigMap != "" {
+		sources = append(sources, "ZONE_MAP_CONFIGMAP")
+	}
+
+	return sources
+}
+
+// zoneMappings returns every static zone mapping: ZONE_MAP, then ZONE_MAP_FILE, then ZONE_MAP_CONFIGMAP. The ConfigMap is read
+// once per launch. If it cannot be read the other mappings are still used.
+func (s *Service) zoneMappings() []config.ZoneMapping {
+	if s.conf.ZoneMapConfigMap == "" {
+		return s.conf.ZoneMap
+	}
+
+	if !s.configMapZonesLoaded {
+		s.configMapZonesLoaded = true
+
+		zones, err := s.readZoneMapConfigMap()
+		if err != nil {
+			slog.Warn("Unable to read the zone map ConfigMap. Using the other static zone mappings only", "configMap", s.conf.ZoneMapConfigMap, "error", err.Error())
+		}
+		s.configMapZones = zones
+	}
+
+	return append(append([]config.ZoneMapping(nil), s.conf.ZoneMap...), s.configMapZones...)
+}
+
+func (s *Service) readZoneMapConfigMap() ([]config.ZoneMapping, error) {
+	cm, err := s.conf.K8sClient.CoreV1().ConfigMaps(s.conf.PodNamespace).Get(context.Background(), s.conf.ZoneMapConfigMap, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("getting ConfigMap %s/%s: %w", s.conf.PodNamespace, s.conf.ZoneMapConfigMap, err)
+	}
+
+	return config.ParseZoneMap("ZONE_MAP_CONFIGMAP", cm.Data[zoneMapConfigMapKey])
+}
+
+// matchZone finds the mapping for the host, trying it with and then without its port. Exact matches win over patterns, and
+// otherwise the first matching pattern wins.
+func matchZone(mappings []config.ZoneMapping, replicaHostPath string) (config.ZoneMapping, bool) {
+	hosts := []string{replicaHostPath}
+	if host, _, found := strings.Cut(replicaHostPath, ":"); found {
+		hosts = append(hosts, host)
+	}
+
+	for _, host := range hosts {
+		for _, m := range mappings {
+			if m.Pattern == host {
+				return m, true
+			}
+		}
+	}
+
+	for _, host := range hosts {
+		for _, m := range mappings {
+			if matched, _ := path.Match(m.Pattern, host); matched {
+				return m, true
+			}
+		}
+	}
+
+	return config.ZoneMapping{}, false
+}
+
+// clusterHostname reports whether the host is a K8s headless service hostname, i.e. <pod>.<service>.<namespace>.svc optionally
+// followed by the cluster domain. Without the .svc a three label host such as db1.example.com can't be told apart from one.
+func clusterHostname(replicaHostPath string) bool {
+	host, _, _ := strings.Cut(replicaHostPath, ":")
+	parts := strings.Split(host, ".")
+
+	return len(parts) > 3 && parts[3] == "svc"
+}
+
+// memberNamespace is the namespace the member's backup objects live in. Members outside the cluster, e.g. on EC2, have no
+// namespace of their own, so use the launcher's.
+func (s *Service) memberNamespace(replicaHostPath string) string {
+	if !clusterHostname(replicaHostPath) {
+		return s.conf.PodNamespace
+	}
+
+	_, namespace, _ := memberPodName(replicaHostPath)
+
+	return namespace
+}
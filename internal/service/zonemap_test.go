@@ -0,0 +1,121 @@
+package service
+
+import (
+	"context"
+	"testing"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"github.com/stretchr/testify/assert"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+)
+
+func Test_matchZone(t *testing.T) {
+	mappings, err := config.ParseZoneMap("ZONE_MAP", `
+# EC2 hosted members
+ip-10-0-1-*.eu-west-1.compute.internal=eu-west-1a
+ip-10-0-*.eu-west-1.compute.internal=eu-west-1b, ip-10-0-1-5.eu-west-1.compute.internal=eu-west-1c
+mongodb-0.other-cluster.example.com:27017=eu-west-1a
+`)
+	assert.NoError(t, err)
+
+	tests := []struct {
+		host       string
+		expectedAZ string
+	}{
+		{host: "ip-10-0-1-5.eu-west-1.compute.internal:27017", expectedAZ: "eu-west-1c"},
+		{host: "ip-10-0-1-6.eu-west-1.compute.internal:27017", expectedAZ: "eu-west-1a"},
+		{host: "ip-10-0-2-6.eu-west-1.compute.internal", expectedAZ: "eu-west-1b"},
+		{host: "mongodb-0.other-cluster.example.com:27017", expectedAZ: "eu-west-1a"},
+		{host: "mongodb-0.other-cluster.example.com:27018"},
+		{host: "ip-10-1-0-1.eu-west-1.compute.internal"},
+	}
+
+	for _, tc := range tests {
+		t.Run(tc.host, func(t *testing.T) {
+			m, found := matchZone(mappings, tc.host)
+			assert.Equal(t, tc.expectedAZ != "", found)
+			assert.Equal(t, tc.expectedAZ, m.AZ)
+		})
+	}
+}
+
+func Test_parseZoneMapInvalid(t *testing.T) {
+	_, err := config.ParseZoneMap("ZONE_MAP_FILE", "mongodb-0=eu-west-1a\nmongodb-1")
+	assert.EqualError(t, err, "parsing ZONE_MAP_FILE: expected <host>=<az> but got 'mongodb-1'")
+
+	_, err = config.ParseZoneMap("ZONE_MAP", "ip-[=eu-west-1a")
+	assert.ErrorContains(t, err, "parsing ZONE_MAP: invalid host pattern 'ip-['")
+}
+
+func Test_memberPlacementOutsideCluster(t *testing.T) {
+	k8sClient := fake.NewClientset(&v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{Name: "zones", Namespace: "database"},
+		Data:       map[string]string{zoneMapConfigMapKey: "*.eu-west-1.compute.internal=eu-west-1b\ndb1.example.com=eu-west-1c"},
+	})
+
+	s := Service{conf: config.Config{
+		K8sClient:        k8sClient,
+		PodNamespace:     "database",
+		ZoneMapConfigMap: "zones",
+	}}
+
+	p, err := s.memberPlacement("ip-10-0-1-5.eu-west-1.compute.internal:27017")
+	assert.NoError(t, err)
+	assert.Nil(t, p.pod)
+	assert.Nil(t, p.node)
+	assert.Equal(t, "eu-west-1b", p.az)
+	for _, action := range k8sClient.Actions() {
+		assert.NotEqual(t, "pods", action.GetResource().Resource, "expected no pod lookup for a member outside the cluster")
+	}
+
+	assert.Equal(t, "database", s.memberNamespace("ip-10-0-1-5.eu-west-1.compute.internal:27017"))
+
+	// Three labels, like <pod>.<service>.<namespace>, but without .svc so not a headless service hostname
+	p, err = s.memberPlacement("db1.example.com:27017")
+	assert.NoError(t, err)
+	assert.Nil(t, p.pod)
+	assert.Equal(t, "eu-west-1c", p.az)
+	assert.Equal(t, "database", s.memberNamespace("db1.example.com:27017"))
+	for _, action := range k8sClient.Actions() {
+		assert.NotEqual(t, "pods", action.GetResource().Resource, "expected no pod lookup for a three label host outside the cluster")
+	}
+
+	_, err = s.memberPlacement("ip-10-1-0-1.eu-west-2.compute.internal:27017")
+	assert.EqualError(t, err, "unable to find the AZ of member ip-10-1-0-1.eu-west-2.compute.internal:27017, which is outside the cluster. Tried the ZONE_MAP, ZONE_MAP_CONFIGMAP")
+
+	// In-cluster members still need their pod
+	_, err = s.memberPlacement("mongodb-0.mongodb.database.svc.cluster.local:27017")
+	assert.ErrorContains(t, err, "unable to find pod mongodb-0 in namespace database")
+}
+
+func Test_launchBackupJobOutsideCluster(t *testing.T) {
+	k8sClient := withGeneratedNames(fake.NewClientset(
+		healthyPod("mongodb-1", "no-az-label"),
+		healthyNode("no-az-label", ""),
+	))
+
+	s := Service{conf: config.Config{
+		MongoDBClient: newMockReplicaSet([]member{
+			{Name: "mongodb-0.mongodb.database.svc.cluster.local:27017", Role: "PRIMARY"},
+			{Name: "mongodb-1.mongodb.database.svc.cluster.local:27017", Role: "SECONDARY"},
+			{Name: "ip-10-0-1-5.eu-west-1.compute.internal:27017", Role: "SECONDARY"},
+		}),
+		K8sClient:    k8sClient,
+		BackupType:   "daily",
+		PodNamespace: "database",
+		ZoneMap:      []config.ZoneMapping{{Pattern: "*.eu-west-1.compute.internal", AZ: "eu-west-1c", Source: "ZONE_MAP"}},
+	}}
+
+	result, err := s.Launch()
+	assert.NoError(t, err)
+	assert.Equal(t, "ip-10-0-1-5.eu-west-1.compute.internal:27017", result.Member)
+	assert.Equal(t, "eu-west-1c", result.AZ)
+	assert.Equal(t, "database", result.Namespace)
+
+	jobs, err := k8sClient.BatchV1().Jobs("database").List(context.Background(), metav1.ListOptions{})
+	assert.NoError(t, err)
+	assert.Len(t, jobs.Items, 1)
+}
@@ -0,0 +1,59 @@
+package tracing
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"time"
+
+	"github.com/michaelprice232/mongodb-backup-launcher/config"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+)
+
+// serviceName is reported as the service.name resource attribute on every span.
+const serviceName = "mongodb-backup-launcher"
+
+// shutdownTimeout bounds how long exiting waits for the last spans to be exported.
+const shutdownTimeout = 10 * time.Second
+
+// Setup installs an OTLP/HTTP exporter as the global TracerProvider if OTEL_EXPORTER_OTLP_ENDPOINT is set, and the W3C trace context
+// propagator used to pass the trace on to backup Jobs. It returns a func which flushes any spans not yet exported.
+func Setup(conf config.Config) (func(), error) {
+	if conf.OTLPEndpoint == "" {
+		return func() {}, nil
+	}
+
+	exporter, err := otlptracehttp.New(context.Background(), otlptracehttp.WithEndpointURL(conf.OTLPEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("creating OTLP trace exporter: %w", err)
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(resource.NewSchemaless(
+			attribute.String("service.name", serviceName),
+			attribute.String("k8s.pod.name", conf.PodName),
+			attribute.String("k8s.namespace.name", conf.PodNamespace),
+		)),
+	)
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.TraceContext{})
+
+	slog.Debug("Exporting traces", "endpoint", conf.OTLPEndpoint)
+
+	return func() {
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+
+		if err := provider.Shutdown(ctx); err != nil {
+			slog.Warn("Unable to export traces", "error", err.Error())
+		}
+	}, nil
+}